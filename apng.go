@@ -0,0 +1,198 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// https://wiki.mozilla.org/APNG_Specification
+type apngFrameControl struct {
+	Width, Height    uint32
+	XOffset, YOffset uint32
+	DelayNum         uint16
+	DelayDen         uint16
+	DisposeOp        uint8
+	BlendOp          uint8
+}
+
+const (
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+	apngBlendOver         = 1
+)
+
+type pngChunkData struct {
+	Type string
+	Data []byte
+}
+
+func splitPNGChunks(d []byte) ([]pngChunkData, error) {
+	if !isPNG(d) {
+		return nil, errors.New("not a png")
+	}
+
+	var chunks []pngChunkData
+	for i := 8; i+8 <= len(d); {
+		n := int(binary.BigEndian.Uint32(d[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(d) || end < i {
+			return nil, errors.New("invalid png chunk")
+		}
+		chunks = append(chunks, pngChunkData{Type: string(d[i+4 : i+8]), Data: d[i+8 : i+8+n]})
+		i = end
+	}
+	return chunks, nil
+}
+
+func appendPNGChunk(b []byte, typ string, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	start := len(b)
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+// 没有设置Config.MaxPixels时APNG画布的像素数上限
+const maxAPNGPixels = 1 << 24
+
+// parseAPNG composes the frames of an animated PNG onto the canvas, applying the dispose
+// and blend operations. It returns nil without error for a still PNG. The canvas is limited
+// to Config.MaxPixels, or maxAPNGPixels when that is not set.
+func parseAPNG(data []byte, cfg ...Config) ([]Frame, error) {
+	chunks, err := splitPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ihdr []byte
+	var shared []pngChunkData // 每一帧都要带上的PLTE、tRNS等
+	var fcs []apngFrameControl
+	var frameData [][][]byte
+	animated, seenIDAT := false, false
+	for _, c := range chunks {
+		switch c.Type {
+		case "IHDR":
+			ihdr = c.Data
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(c.Data) < 26 {
+				return nil, errors.New("invalid apng fcTL chunk")
+			}
+			var fc apngFrameControl
+			binary.Read(bytes.NewReader(c.Data[4:]), binary.BigEndian, &fc)
+			fcs = append(fcs, fc)
+			frameData = append(frameData, nil)
+		case "IDAT":
+			seenIDAT = true
+			// 在IDAT之前没有fcTL时，默认图像不是动画的一部分
+			if len(fcs) > 0 {
+				frameData[len(frameData)-1] = append(frameData[len(frameData)-1], c.Data)
+			}
+		case "fdAT":
+			if len(c.Data) < 4 || len(fcs) <= 0 {
+				return nil, errors.New("invalid apng fdAT chunk")
+			}
+			frameData[len(frameData)-1] = append(frameData[len(frameData)-1], c.Data[4:])
+		case "IEND":
+		default:
+			if !seenIDAT && len(fcs) <= 0 {
+				shared = append(shared, c)
+			}
+		}
+	}
+	if !animated || len(fcs) <= 0 {
+		return nil, nil
+	}
+	if len(ihdr) < 13 {
+		return nil, errors.New("invalid png IHDR chunk")
+	}
+
+	// 在分配画布前检查尺寸，宽高都来自文件
+	w, h := int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:]))
+	limit := maxAPNGPixels
+	if len(cfg) > 0 && cfg[0].MaxPixels > 0 {
+		limit = cfg[0].MaxPixels
+	}
+	if w <= 0 || h <= 0 || w > limit || h > limit || w*h > limit {
+		return nil, errors.New("invalid apng canvas size")
+	}
+	for _, fc := range fcs {
+		if fc.Width == 0 || fc.Height == 0 || uint64(fc.XOffset)+uint64(fc.Width) > uint64(w) || uint64(fc.YOffset)+uint64(fc.Height) > uint64(h) {
+			return nil, errors.New("apng frame outside the canvas")
+		}
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	var frames []Frame
+	for i, fc := range fcs {
+		// 把帧数据拼成一张独立的PNG来解码
+		hdr := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(hdr, fc.Width)
+		binary.BigEndian.PutUint32(hdr[4:], fc.Height)
+		b := appendPNGChunk([]byte("\211PNG\r\n\032\n"), "IHDR", hdr)
+		for _, c := range shared {
+			b = appendPNGChunk(b, c.Type, c.Data)
+		}
+		for _, d := range frameData[i] {
+			b = appendPNGChunk(b, "IDAT", d)
+		}
+		b = appendPNGChunk(b, "IEND", nil)
+
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+
+		// 第一帧的"恢复上一帧"按清空处理
+		if i == 0 && fc.DisposeOp == apngDisposePrevious {
+			fc.DisposeOp = apngDisposeBackground
+		}
+
+		rect := image.Rect(int(fc.XOffset), int(fc.YOffset), int(fc.XOffset+fc.Width), int(fc.YOffset+fc.Height))
+		var prev *image.RGBA
+		if fc.DisposeOp == apngDisposePrevious {
+			prev = image.NewRGBA(canvas.Bounds())
+			copy(prev.Pix, canvas.Pix)
+		}
+
+		op := draw.Src
+		if fc.BlendOp == apngBlendOver {
+			op = draw.Over
+		}
+		draw.Draw(canvas, rect, img, img.Bounds().Min, op)
+
+		var buf bytes.Buffer
+		if err = png.Encode(&buf, canvas); err != nil {
+			return nil, err
+		}
+
+		// 分母为0时按1/100秒计算
+		den := time.Duration(fc.DelayDen)
+		if den == 0 {
+			den = 100
+		}
+		frames = append(frames, Frame{
+			FrameIndex: i,
+			Width:      w,
+			Height:     h,
+			BitCount:   32,
+			Delay:      time.Duration(fc.DelayNum) * time.Second / den,
+			Data:       buf.Bytes(),
+		})
+
+		switch fc.DisposeOp {
+		case apngDisposeBackground:
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = prev
+		}
+	}
+	return frames, nil
+}
@@ -0,0 +1,106 @@
+package fico
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+type apngTestFrame struct {
+	w, h, x, y uint32
+	c          color.NRGBA
+}
+
+// testAPNG writes an RGBA APNG of a w×h canvas, each frame a solid rectangle drawn with
+// the source blend operation. The first frame is also the default image.
+func testAPNG(w, h uint32, frames ...apngTestFrame) []byte {
+	be := binary.BigEndian
+	ihdr := be.AppendUint32(nil, w)
+	ihdr = be.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	d := append([]byte("\x89PNG\r\n\x1a\n"), pngChunkOf("IHDR", ihdr)...)
+	actl := be.AppendUint32(nil, uint32(len(frames)))
+	d = append(d, pngChunkOf("acTL", be.AppendUint32(actl, 0))...)
+
+	seq := uint32(0)
+	for i, f := range frames {
+		fc := be.AppendUint32(nil, seq)
+		for _, v := range []uint32{f.w, f.h, f.x, f.y} {
+			fc = be.AppendUint32(fc, v)
+		}
+		fc = append(fc, 0, 1, 0, 100, 0, 0)
+		d = append(d, pngChunkOf("fcTL", fc)...)
+		seq++
+
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		row := append([]byte{0}, bytes.Repeat([]byte{f.c.R, f.c.G, f.c.B, f.c.A}, int(f.w))...)
+		for y := uint32(0); y < f.h; y++ {
+			zw.Write(row)
+		}
+		zw.Close()
+		if i == 0 {
+			d = append(d, pngChunkOf("IDAT", z.Bytes())...)
+		} else {
+			d = append(d, pngChunkOf("fdAT", append(be.AppendUint32(nil, seq), z.Bytes()...))...)
+			seq++
+		}
+	}
+	return append(d, pngChunkOf("IEND", nil)...)
+}
+
+func TestAPNGFrames(t *testing.T) {
+	red, blue := color.NRGBA{0xFF, 0, 0, 0xFF}, color.NRGBA{0, 0, 0xFF, 0xFF}
+	path := writeTemp(t, "a.png", testAPNG(16, 16, apngTestFrame{16, 16, 0, 0, red}, apngTestFrame{8, 8, 8, 8, blue}))
+	frames, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	img, err := png.Decode(bytes.NewReader(frames[1].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBAModel.Convert(img.At(4, 4)); got != red {
+		t.Fatalf("got %v, want the first frame kept at (4, 4)", got)
+	}
+	if got := color.NRGBAModel.Convert(img.At(12, 12)); got != blue {
+		t.Fatalf("got %v, want the second frame at (12, 12)", got)
+	}
+}
+
+func TestAPNGInvalidSize(t *testing.T) {
+	c := color.NRGBA{0xFF, 0, 0, 0xFF}
+	for _, c := range []struct {
+		name string
+		d    []byte
+	}{
+		// 画布尺寸只在IHDR中，不分配就不会崩溃
+		{"huge canvas", testAPNG(0x7fffffff, 0x7fffffff, apngTestFrame{1, 1, 0, 0, c})},
+		{"large canvas", testAPNG(30000, 30000, apngTestFrame{1, 1, 0, 0, c})},
+		{"empty canvas", testAPNG(0, 16, apngTestFrame{1, 1, 0, 0, c})},
+		{"frame outside", testAPNG(16, 16, apngTestFrame{16, 16, 0, 0, c}, apngTestFrame{8, 8, 12, 0, c})},
+		{"offset overflow", testAPNG(16, 16, apngTestFrame{16, 16, 0, 0, c}, apngTestFrame{8, 8, 0xFFFFFFF8, 0, c})},
+	} {
+		if _, err := parseAPNG(c.d); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		if _, err := Parse(writeTemp(t, "a.png", c.d)); err == nil {
+			t.Fatalf("%s: expected an error from Parse", c.name)
+		}
+	}
+
+	// 设置了MaxPixels时按它限制
+	d := testAPNG(64, 64, apngTestFrame{64, 64, 0, 0, c})
+	if _, err := parseAPNG(d, Config{MaxPixels: 32 * 32}); err == nil {
+		t.Fatal("expected MaxPixels to limit the canvas")
+	}
+	if frames, err := parseAPNG(d); err != nil || len(frames) != 1 {
+		t.Fatalf("got %d frames, %v", len(frames), err)
+	}
+}
@@ -0,0 +1,84 @@
+package fico
+
+import (
+	"archive/zip"
+	"image/png"
+	"path"
+	"strings"
+)
+
+// msix、appx是Windows应用商店的应用包（zip），AppxManifest.xml中声明了各种尺寸的方形logo，
+// 包里是按缩放比例、目标尺寸限定的文件（如Square44x44Logo.scale-400.png、
+// Square44x44Logo.targetsize-256_altform-unplated.png，或scale-200目录下的同名文件）
+// https://learn.microsoft.com/en-us/uwp/schemas/appxpackage/uapmanifestschema/element-uap-visualelements
+// https://learn.microsoft.com/en-us/windows/uwp/app-resources/tailor-resources-lang-scale-contrast
+type appxManifest struct {
+	Logo         string `xml:"Properties>Logo"`
+	Applications []struct {
+		VisualElements struct {
+			Square44x44Logo   string `xml:"Square44x44Logo,attr"`
+			Square150x150Logo string `xml:"Square150x150Logo,attr"`
+			DefaultTile       struct {
+				Square71x71Logo   string `xml:"Square71x71Logo,attr"`
+				Square310x310Logo string `xml:"Square310x310Logo,attr"`
+			} `xml:"DefaultTile"`
+		} `xml:"VisualElements"`
+	} `xml:"Applications>Application"`
+}
+
+// appxIcon returns the largest PNG among the variants of the square logos declared by the
+// AppxManifest.xml f of an .msix or .appx package. The wide tile and the high contrast
+// variants are left out. Bundles (.msixbundle, .appxbundle) are not looked into.
+func appxIcon(zr *zip.Reader, f *zip.File) ([]byte, error) {
+	var m appxManifest
+	if err := readManifest(f, &m); err != nil {
+		return nil, err
+	}
+	logos := []string{m.Logo}
+	for _, a := range m.Applications {
+		v := a.VisualElements
+		logos = append(logos, v.Square44x44Logo, v.Square150x150Logo, v.DefaultTile.Square71x71Logo, v.DefaultTile.Square310x310Logo)
+	}
+
+	var best *zip.File
+	ba := 0
+	for _, logo := range logos {
+		if logo == "" {
+			continue
+		}
+		logo = zipName(logo)
+		dir, ext := path.Dir(logo), path.Ext(logo)
+		base := strings.TrimSuffix(path.Base(logo), ext)
+		for _, zf := range zr.File {
+			name := zipName(zf.Name)
+			fdir, fbase := path.Dir(name), strings.TrimSuffix(path.Base(name), ext)
+			// 限定符可以在文件名中（base.scale-200.png），也可以是子目录（scale-200/base.png）
+			if path.Ext(name) != ext || (fbase != base && !strings.HasPrefix(fbase, base+".")) {
+				continue
+			}
+			if fdir != dir && dir != "." && !strings.HasPrefix(fdir, dir+"/") {
+				continue
+			}
+			if strings.Contains(name, "contrast-") {
+				continue
+			}
+
+			rc, err := zf.Open()
+			if err != nil {
+				continue
+			}
+			img, err := png.DecodeConfig(rc)
+			rc.Close()
+			if err != nil {
+				continue
+			}
+			if area := img.Width * img.Height; area > ba {
+				best, ba = zf, area
+			}
+		}
+	}
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return readZipEntry(best)
+}
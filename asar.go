@@ -0,0 +1,178 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asar是Electron的归档格式：Pickle封装的JSON索引，后面紧跟所有文件的内容
+// https://github.com/electron/asar
+type asarEntry struct {
+	Files    map[string]*asarEntry `json:"files"`
+	Offset   string                `json:"offset"` // 相对于数据区，为了支持大文件用字符串存储
+	Size     int64                 `json:"size"`
+	Unpacked bool                  `json:"unpacked"` // 解包在.asar.unpacked目录中，不在归档里
+}
+
+type asar struct {
+	r     io.ReaderAt
+	data  int64 // 数据区的起始偏移
+	files map[string]*asarEntry
+}
+
+// asar索引大小的上限
+const maxASARHeaderSize = 64 << 20
+
+func openASAR(r io.ReaderAt) (*asar, error) {
+	le := binary.LittleEndian
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	// 外层Pickle只有一个uint32：索引Pickle的大小；索引Pickle中是负载大小、字符串长度和JSON
+	if le.Uint32(hdr[:]) != 4 {
+		return nil, errors.New("invalid asar header")
+	}
+	size, l := le.Uint32(hdr[4:]), le.Uint32(hdr[12:])
+	if size < 8 || size > maxASARHeaderSize || l > size-8 {
+		return nil, errors.New("invalid asar header")
+	}
+
+	index := make([]byte, l)
+	if _, err := r.ReadAt(index, 16); err != nil {
+		return nil, err
+	}
+	var root asarEntry
+	if err := json.Unmarshal(index, &root); err != nil {
+		return nil, err
+	}
+
+	a := &asar{r: r, data: 8 + int64(size), files: make(map[string]*asarEntry)}
+	var walk func(dir string, e *asarEntry)
+	walk = func(dir string, e *asarEntry) {
+		for name, c := range e.Files {
+			if c == nil {
+				continue
+			}
+			if c.Files != nil {
+				walk(dir+name+"/", c)
+			} else {
+				a.files[dir+name] = c
+			}
+		}
+	}
+	walk("", &root)
+	return a, nil
+}
+
+func (a *asar) readFile(name string) ([]byte, error) {
+	e := a.files[name]
+	if e == nil {
+		return nil, errors.New("no " + name + " in asar")
+	}
+	if e.Unpacked {
+		return nil, errors.New(name + " is unpacked outside of the asar")
+	}
+	off, err := strconv.ParseInt(e.Offset, 10, 64)
+	if err != nil || off < 0 || e.Size < 0 {
+		return nil, errors.New("invalid asar entry")
+	}
+	if e.Size > maxAPKIconSize {
+		return nil, errors.New(name + " too large in asar")
+	}
+	d := make([]byte, e.Size)
+	if _, err = a.r.ReadAt(d, a.data+off); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// asarIcon returns the icon of an Electron app archive: the icon set in package.json if any,
+// otherwise the largest png or ico whose name contains "icon" (or else "logo"), leaving
+// out the dependencies in node_modules.
+func asarIcon(r io.ReaderAt) ([]byte, error) {
+	a, err := openASAR(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if d, err := a.readFile("package.json"); err == nil {
+		var pkg struct {
+			Icon  string `json:"icon"`
+			Build struct {
+				Icon string `json:"icon"`
+			} `json:"build"`
+		}
+		if json.Unmarshal(d, &pkg) == nil {
+			for _, icon := range []string{pkg.Icon, pkg.Build.Icon} {
+				icon = path.Clean(strings.TrimPrefix(icon, "./"))
+				if d, err := a.readFile(icon); err == nil {
+					return d, nil
+				}
+			}
+		}
+	}
+
+	var best []byte
+	bp, ba := 0, 0
+	// map的遍历顺序是随机的，排序后保证相同的文件结果一致
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		base := path.Base(lower)
+		if strings.Contains(lower, "node_modules/") {
+			continue
+		}
+		prio := 0
+		if strings.Contains(base, "icon") {
+			prio = 2
+		} else if strings.Contains(base, "logo") {
+			prio = 1
+		}
+		ext := path.Ext(base)
+		if prio == 0 || prio < bp || (ext != ".png" && ext != ".ico") {
+			continue
+		}
+
+		d, err := a.readFile(name)
+		if err != nil {
+			continue
+		}
+		area := 0
+		if ext == ".png" {
+			img, err := png.DecodeConfig(bytes.NewReader(d))
+			if err != nil {
+				continue
+			}
+			area = img.Width * img.Height
+		} else {
+			_, entries, ed, err := parseICO(d)
+			if err != nil {
+				continue
+			}
+			for i, e := range entries {
+				w, h := entrySize(e, ed[i])
+				area = max(area, w*h)
+			}
+		}
+		if prio > bp || area > ba {
+			best, bp, ba = d, prio, area
+		}
+	}
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return best, nil
+}
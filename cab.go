@@ -0,0 +1,233 @@
+package fico
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+// https://learn.microsoft.com/en-us/previous-versions/bb417343(v=msdn.10)
+type cabHeader struct {
+	Signature    [4]byte
+	Reserved1    uint32
+	CbCabinet    uint32
+	Reserved2    uint32
+	CoffFiles    uint32
+	Reserved3    uint32
+	VersionMinor uint8
+	VersionMajor uint8
+	CFolders     uint16
+	CFiles       uint16
+	Flags        uint16
+	SetID        uint16
+	ICabinet     uint16
+}
+
+type cabFolder struct {
+	CoffCabStart uint32
+	CCFData      uint16
+	TypeCompress uint16
+}
+
+type cabFile struct {
+	Name   string
+	Size   uint32
+	Offset uint32 // 在解压后的folder中的偏移
+	Folder uint16
+}
+
+type cab struct {
+	r       io.ReaderAt
+	folders []cabFolder
+	files   []cabFile
+	dataRes int // CFDATA的保留字段大小
+}
+
+// 从cab中读出的单个文件的大小上限，folder中它之前的数据解压后不保留，防止解压炸弹
+const maxCABFileSize = 32 << 20
+
+const (
+	cabFlagPrev     = 0x0001
+	cabFlagNext     = 0x0002
+	cabFlagReserved = 0x0004
+
+	cabCompressNone  = 0
+	cabCompressMSZIP = 1
+)
+
+func openCAB(r io.ReaderAt) (*cab, error) {
+	sr := io.NewSectionReader(r, 0, 1<<62)
+	le := binary.LittleEndian
+
+	var hdr cabHeader
+	if err := binary.Read(sr, le, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Signature[:]) != "MSCF" {
+		return nil, errors.New("invalid cab signature")
+	}
+
+	c := &cab{r: r}
+	folderRes := 0
+	if hdr.Flags&cabFlagReserved != 0 {
+		var res struct {
+			CbCFHeader uint16
+			CbCFFolder uint8
+			CbCFData   uint8
+		}
+		if err := binary.Read(sr, le, &res); err != nil {
+			return nil, err
+		}
+		folderRes, c.dataRes = int(res.CbCFFolder), int(res.CbCFData)
+		if _, err := sr.Seek(int64(res.CbCFHeader), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	// 跳过前后分卷的名称
+	for _, flag := range []uint16{cabFlagPrev, cabFlagNext} {
+		if hdr.Flags&flag != 0 {
+			for i := 0; i < 2; i++ {
+				if _, err := readCString(sr); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for i := 0; i < int(hdr.CFolders); i++ {
+		var f cabFolder
+		if err := binary.Read(sr, le, &f); err != nil {
+			return nil, err
+		}
+		if _, err := sr.Seek(int64(folderRes), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		c.folders = append(c.folders, f)
+	}
+
+	if _, err := sr.Seek(int64(hdr.CoffFiles), io.SeekStart); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(hdr.CFiles); i++ {
+		var f struct {
+			CbFile          uint32
+			UoffFolderStart uint32
+			IFolder         uint16
+			Date, Time      uint16
+			Attribs         uint16
+		}
+		if err := binary.Read(sr, le, &f); err != nil {
+			return nil, err
+		}
+		name, err := readCString(sr)
+		if err != nil {
+			return nil, err
+		}
+		c.files = append(c.files, cabFile{
+			Name:   strings.ReplaceAll(name, "\\", "/"),
+			Size:   f.CbFile,
+			Offset: f.UoffFolderStart,
+			Folder: f.IFolder,
+		})
+	}
+	return c, nil
+}
+
+func readCString(r io.Reader) (string, error) {
+	var s []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		s = append(s, b[0])
+	}
+}
+
+// extract decompresses folder i up to the end of the size bytes at off and returns them.
+// Only the last 32K of what comes before is kept, as the dictionary of MSZIP blocks.
+func (c *cab) extract(i uint16, off, size uint32) ([]byte, error) {
+	if int(i) >= len(c.folders) {
+		return nil, errors.New("cab folder out of range")
+	}
+
+	f := c.folders[i]
+	switch f.TypeCompress & 0x0F {
+	case cabCompressNone, cabCompressMSZIP:
+	default:
+		return nil, errors.New("unsupported cab compression")
+	}
+
+	le := binary.LittleEndian
+	pos := int64(f.CoffCabStart)
+	end := uint64(off) + uint64(size)
+	out := make([]byte, 0, size)
+	var window []byte
+	var done uint64 // 已解压的字节数
+	for n := 0; n < int(f.CCFData) && done < end; n++ {
+		var hdr struct {
+			Csum     uint32
+			CbData   uint16
+			CbUncomp uint16
+		}
+		if err := binary.Read(io.NewSectionReader(c.r, pos, 8), le, &hdr); err != nil {
+			return nil, err
+		}
+		pos += 8 + int64(c.dataRes)
+
+		d := make([]byte, hdr.CbData)
+		if _, err := c.r.ReadAt(d, pos); err != nil {
+			return nil, err
+		}
+		pos += int64(hdr.CbData)
+
+		if f.TypeCompress&0x0F == cabCompressMSZIP {
+			// 每个块以"CK"开头，后面是deflate数据，字典沿用之前解压的32K数据
+			if len(d) < 2 || d[0] != 'C' || d[1] != 'K' {
+				return nil, errors.New("invalid mszip block")
+			}
+			fr := flate.NewReaderDict(bytes.NewReader(d[2:]), window)
+			block := make([]byte, hdr.CbUncomp)
+			_, err := io.ReadFull(fr, block)
+			fr.Close()
+			if err != nil {
+				return nil, err
+			}
+			d = block
+			window = append(window, d...)
+			if len(window) > 32768 {
+				window = append(window[:0], window[len(window)-32768:]...)
+			}
+		}
+
+		// 只保留与文件重叠的部分
+		if next := done + uint64(len(d)); next > uint64(off) {
+			out = append(out, d[max(uint64(off), done)-done:min(end, next)-done]...)
+		}
+		done += uint64(len(d))
+	}
+	if done < end {
+		return nil, errors.New("cab file out of range")
+	}
+	return out, nil
+}
+
+// readFile returns the content of the named file, matched case-insensitively.
+func (c *cab) readFile(name string) ([]byte, error) {
+	for _, f := range c.files {
+		if !strings.EqualFold(f.Name, name) {
+			continue
+		}
+		if f.Size > maxCABFileSize {
+			return nil, errors.New("file too large in cab: " + name)
+		}
+		return c.extract(f.Folder, f.Offset, f.Size)
+	}
+	return nil, errors.New("file not found in cab: " + name)
+}
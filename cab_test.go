@@ -0,0 +1,95 @@
+package fico
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+type cabTestFile struct {
+	name string
+	data []byte
+}
+
+// buildCAB writes a cabinet with a single MSZIP folder holding files in order, split into
+// 32K blocks, each compressed with the 32K before it as the dictionary.
+func buildCAB(files ...cabTestFile) []byte {
+	le := binary.LittleEndian
+	var content, entries []byte
+	for _, f := range files {
+		entries = le.AppendUint32(entries, uint32(len(f.data)))
+		entries = le.AppendUint32(entries, uint32(len(content)))
+		entries = append(entries, make([]byte, 8)...)
+		entries = append(append(entries, f.name...), 0)
+		content = append(content, f.data...)
+	}
+
+	var blocks []byte
+	n := 0
+	for i := 0; i < len(content); i += 32768 {
+		blk := content[i:min(i+32768, len(content))]
+		var c bytes.Buffer
+		c.WriteString("CK")
+		fw, _ := flate.NewWriterDict(&c, flate.BestCompression, content[max(0, i-32768):i])
+		fw.Write(blk)
+		fw.Close()
+		blocks = le.AppendUint32(blocks, 0)
+		blocks = le.AppendUint16(blocks, uint16(c.Len()))
+		blocks = le.AppendUint16(blocks, uint16(len(blk)))
+		blocks = append(blocks, c.Bytes()...)
+		n++
+	}
+
+	const hdrSize = 36 + 8
+	hdr := append([]byte("MSCF"), make([]byte, 4)...)
+	hdr = le.AppendUint32(hdr, uint32(hdrSize+len(entries)+len(blocks)))
+	hdr = append(hdr, make([]byte, 4)...)
+	hdr = le.AppendUint32(hdr, hdrSize)
+	hdr = append(hdr, make([]byte, 4)...)
+	hdr = append(hdr, 3, 1)
+	hdr = le.AppendUint16(hdr, 1)
+	hdr = le.AppendUint16(hdr, uint16(len(files)))
+	hdr = append(hdr, make([]byte, 6)...)
+	// 唯一的folder
+	hdr = le.AppendUint32(hdr, uint32(hdrSize+len(entries)))
+	hdr = le.AppendUint16(hdr, uint16(n))
+	hdr = le.AppendUint16(hdr, cabCompressMSZIP)
+	return append(append(hdr, entries...), blocks...)
+}
+
+func TestThemepackIcon(t *testing.T) {
+	theme := []byte("[CLSID\\{20D04FE0-3AEA-1069-A2D8-08002B30309D}\\DefaultIcon]\r\nDefaultValue=%WinDir%\\Resources\\Themes\\computer.ico\r\n")
+	// 图标在一个跨多个块的壁纸后面，要用前面的32K做字典解压
+	wallpaper := bytes.Repeat([]byte("wallpaper"), 20000)
+	ico := testICO(t, 16, 32)
+	d := buildCAB(cabTestFile{"other.ico", testICO(t, 48)}, cabTestFile{"a.theme", theme},
+		cabTestFile{"DesktopBackground\\wall.jpg", wallpaper}, cabTestFile{"computer.ico", ico})
+
+	got, err := themepackIcon(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, ico) {
+		t.Fatal("expected the icon the theme refers to")
+	}
+}
+
+func TestCABFileLimit(t *testing.T) {
+	d := buildCAB(cabTestFile{"a.ico", testICO(t, 16)})
+	c, err := openCAB(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 文件大小和偏移量都来自文件头
+	for _, f := range []cabFile{
+		{Name: "big.ico", Size: maxCABFileSize + 1},
+		{Name: "past.ico", Size: 16, Offset: 1 << 20},
+		{Name: "wrap.ico", Size: 16, Offset: 0xFFFFFFF8},
+	} {
+		c.files = append(c.files[:1], f)
+		if _, err := c.readFile(f.Name); err == nil {
+			t.Fatalf("%s: expected an error", f.Name)
+		}
+	}
+}
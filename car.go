@@ -0,0 +1,239 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// Assets.car是BOM格式的文件，RENDITIONS树中每个值是一个CSI（Core Structured Image）
+// https://blog.timac.org/2018/1018-reverse-engineering-the-car-file-format/
+type bomStore struct {
+	d      []byte
+	blocks [][2]uint32 // 块的偏移和长度
+	vars   map[string]uint32
+}
+
+// car文件读入内存的大小上限
+const maxCARSize = 256 << 20
+
+func openBOM(d []byte) (*bomStore, error) {
+	be := binary.BigEndian
+	if len(d) < 32 || string(d[:8]) != "BOMStore" {
+		return nil, errors.New("invalid bom signature")
+	}
+
+	bom := &bomStore{d: d, vars: make(map[string]uint32)}
+	indexOff, varsOff := be.Uint32(d[16:]), be.Uint32(d[24:])
+	if uint64(indexOff)+4 > uint64(len(d)) || uint64(varsOff)+4 > uint64(len(d)) {
+		return nil, errors.New("invalid bom header")
+	}
+
+	n := be.Uint32(d[indexOff:])
+	p := uint64(indexOff) + 4
+	if p+uint64(n)*8 > uint64(len(d)) {
+		return nil, errors.New("invalid bom block table")
+	}
+	bom.blocks = make([][2]uint32, n)
+	for i := range bom.blocks {
+		bom.blocks[i] = [2]uint32{be.Uint32(d[p:]), be.Uint32(d[p+4:])}
+		p += 8
+	}
+
+	n = be.Uint32(d[varsOff:])
+	p = uint64(varsOff) + 4
+	for i := uint32(0); i < n; i++ {
+		if p+5 > uint64(len(d)) {
+			return nil, errors.New("invalid bom vars")
+		}
+		idx, l := be.Uint32(d[p:]), uint64(d[p+4])
+		if p+5+l > uint64(len(d)) {
+			return nil, errors.New("invalid bom vars")
+		}
+		bom.vars[string(d[p+5:p+5+l])] = idx
+		p += 5 + l
+	}
+	return bom, nil
+}
+
+// block returns the data of block i, nil if it lies outside the file.
+func (bom *bomStore) block(i uint32) []byte {
+	if uint64(i) >= uint64(len(bom.blocks)) {
+		return nil
+	}
+	off, l := uint64(bom.blocks[i][0]), uint64(bom.blocks[i][1])
+	if off+l > uint64(len(bom.d)) {
+		return nil
+	}
+	return bom.d[off : off+l]
+}
+
+// treeValues returns the value blocks of every leaf in the tree named name, in key order.
+func (bom *bomStore) treeValues(name string) ([][]byte, error) {
+	be := binary.BigEndian
+	idx, ok := bom.vars[name]
+	if !ok {
+		return nil, errors.New("no " + name + " tree in bom")
+	}
+	tree := bom.block(idx)
+	if len(tree) < 12 || string(tree[:4]) != "tree" {
+		return nil, errors.New("invalid bom tree")
+	}
+
+	var values [][]byte
+	node, seen := be.Uint32(tree[8:]), make(map[uint32]bool)
+	for node != 0 && !seen[node] {
+		// 防止损坏的文件中节点成环
+		seen[node] = true
+		b := bom.block(node)
+		if len(b) < 12 {
+			return nil, errors.New("invalid bom tree node")
+		}
+		isLeaf, count := be.Uint16(b), int(be.Uint16(b[2:]))
+		if 12+count*8 > len(b) {
+			return nil, errors.New("invalid bom tree node")
+		}
+
+		// 非叶子节点一直往第一个子节点走，到最左边的叶子节点后再沿着forward链表遍历
+		if isLeaf == 0 {
+			if count <= 0 {
+				break
+			}
+			node = be.Uint32(b[12:])
+			continue
+		}
+		for i := 0; i < count; i++ {
+			if v := bom.block(be.Uint32(b[12+i*8:])); v != nil {
+				values = append(values, v)
+			}
+		}
+		node = be.Uint32(b[4:])
+	}
+	return values, nil
+}
+
+// csiRendition is the part of a CSI header needed to pick and decode an image.
+type csiRendition struct {
+	Name          string
+	Width, Height int
+	PixelFormat   string
+	Data          []byte // 紧跟在TLV之后的数据，以CELM、RAWD等标记开头
+}
+
+func parseCSI(b []byte) (*csiRendition, error) {
+	le := binary.LittleEndian
+	// 32字节头、136字节元数据、16字节位图列表
+	const hdrSize = 184
+	if len(b) < hdrSize || string(b[:4]) != "ISTC" {
+		return nil, errors.New("invalid csi header")
+	}
+
+	r := &csiRendition{
+		Width:       int(le.Uint32(b[12:])),
+		Height:      int(le.Uint32(b[16:])),
+		PixelFormat: string([]byte{b[27], b[26], b[25], b[24]}),
+	}
+	name := b[40:168]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	r.Name = string(name)
+
+	tlvLen := uint64(le.Uint32(b[168:]))
+	if hdrSize+tlvLen > uint64(len(b)) {
+		return nil, errors.New("invalid csi header")
+	}
+	r.Data = b[hdrSize+tlvLen:]
+	return r, nil
+}
+
+// image decodes the rendition. Only uncompressed pixels and raw PNG/JPEG data are supported,
+// the LZFSE and other compressed bitmaps of newer catalogs are not.
+func (r *csiRendition) image() (image.Image, error) {
+	le := binary.LittleEndian
+	d := r.Data
+	if len(d) < 12 {
+		return nil, errors.New("invalid csi rendition")
+	}
+
+	switch string(d[:4]) {
+	case "DWAR": // RAWD，通常是原样存储的PNG、JPEG
+		l := uint64(le.Uint32(d[8:]))
+		if 12+l > uint64(len(d)) {
+			return nil, errors.New("invalid csi rendition")
+		}
+		img, _, err := image.Decode(bytes.NewReader(d[12 : 12+l]))
+		return img, err
+
+	case "MLEC": // CELM，压缩类型为0时是未压缩的BGRA（预乘）像素
+		if len(d) < 16 {
+			return nil, errors.New("invalid csi rendition")
+		}
+		if le.Uint32(d[8:]) != 0 || r.PixelFormat != "ARGB" {
+			return nil, errors.New("unsupported csi compression")
+		}
+		l := uint64(le.Uint32(d[12:]))
+		w, h := r.Width, r.Height
+		if 16+l > uint64(len(d)) || w <= 0 || h <= 0 || uint64(w)*uint64(h)*4 > l {
+			return nil, errors.New("invalid csi rendition")
+		}
+		px := d[16:]
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				i := (y*w + x) * 4
+				img.SetRGBA(x, y, color.RGBA{R: px[i+2], G: px[i+1], B: px[i], A: px[i+3]})
+			}
+		}
+		return img, nil
+	}
+	return nil, errors.New("unsupported csi rendition")
+}
+
+// carIcon returns the largest decodable AppIcon rendition of an Assets.car, or the largest
+// rendition of any name if the catalog has no AppIcon.
+func carIcon(r io.Reader) (image.Image, error) {
+	d, err := io.ReadAll(io.LimitReader(r, maxCARSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxCARSize {
+		return nil, errors.New("car file too large")
+	}
+
+	bom, err := openBOM(d)
+	if err != nil {
+		return nil, err
+	}
+	values, err := bom.treeValues("RENDITIONS")
+	if err != nil {
+		return nil, err
+	}
+
+	var best image.Image
+	bestApp, bestSize := false, 0
+	for _, v := range values {
+		rd, err := parseCSI(v)
+		if err != nil {
+			continue
+		}
+		isApp := strings.Contains(strings.ToLower(rd.Name), "appicon")
+		size := rd.Width * rd.Height
+		if (bestApp && !isApp) || (bestApp == isApp && size <= bestSize) {
+			continue
+		}
+		img, err := rd.image()
+		if err != nil {
+			continue
+		}
+		best, bestApp, bestSize = img, isApp, size
+	}
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return best, nil
+}
@@ -0,0 +1,253 @@
+package fico
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// chm是ITSF格式的容器，目录由PMGL块组成，文件内容在第0节（未压缩）或第1节（LZX压缩）
+// http://www.russotto.net/chm/chmformat.html
+type chmFile struct {
+	Name    string
+	Section uint64
+	Offset  uint64
+	Length  uint64
+}
+
+type chm struct {
+	r       io.ReaderAt
+	content int64 // 第0节内容的起始偏移
+	files   []chmFile
+}
+
+// chm目录大小的上限，防止损坏的文件申请过大的内存
+const maxCHMDirSize = 16 << 20
+
+func openCHM(r io.ReaderAt) (*chm, error) {
+	le := binary.LittleEndian
+	hdr := make([]byte, 0x60)
+	if _, err := r.ReadAt(hdr[:0x58], 0); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "ITSF" {
+		return nil, errors.New("invalid chm signature")
+	}
+
+	dirOff, dirLen := le.Uint64(hdr[72:]), le.Uint64(hdr[80:])
+	c := &chm{r: r, content: int64(dirOff + dirLen)}
+	// 版本3的头部直接给出了内容的偏移
+	if le.Uint32(hdr[4:]) >= 3 {
+		if _, err := r.ReadAt(hdr[0x58:], 0x58); err != nil {
+			return nil, err
+		}
+		c.content = int64(le.Uint64(hdr[0x58:]))
+	}
+	if dirLen < 0x54 || dirLen > maxCHMDirSize || c.content < 0 {
+		return nil, errors.New("invalid chm header")
+	}
+
+	dir := make([]byte, dirLen)
+	if _, err := r.ReadAt(dir, int64(dirOff)); err != nil {
+		return nil, err
+	}
+	if string(dir[:4]) != "ITSP" {
+		return nil, errors.New("invalid chm directory")
+	}
+	hdrLen, chunkSize, chunks := uint64(le.Uint32(dir[8:])), uint64(le.Uint32(dir[16:])), uint64(le.Uint32(dir[44:]))
+	if chunkSize < 20 || hdrLen+chunkSize*chunks > dirLen {
+		return nil, errors.New("invalid chm directory")
+	}
+
+	for i := uint64(0); i < chunks; i++ {
+		b := dir[hdrLen+i*chunkSize : hdrLen+(i+1)*chunkSize]
+		// PMGI是索引块，只需要遍历PMGL列表块
+		if string(b[:4]) != "PMGL" {
+			continue
+		}
+		free := uint64(le.Uint32(b[4:]))
+		if free > chunkSize-20 {
+			return nil, errors.New("invalid chm listing chunk")
+		}
+		b = b[20 : chunkSize-free]
+		for len(b) > 0 {
+			var f chmFile
+			var n uint64
+			var ok bool
+			if n, b, ok = chmEncInt(b); !ok || n > uint64(len(b)) {
+				return nil, errors.New("invalid chm directory entry")
+			}
+			f.Name, b = string(b[:n]), b[n:]
+			if f.Section, b, ok = chmEncInt(b); !ok {
+				return nil, errors.New("invalid chm directory entry")
+			}
+			if f.Offset, b, ok = chmEncInt(b); !ok {
+				return nil, errors.New("invalid chm directory entry")
+			}
+			if f.Length, b, ok = chmEncInt(b); !ok {
+				return nil, errors.New("invalid chm directory entry")
+			}
+			c.files = append(c.files, f)
+		}
+	}
+	return c, nil
+}
+
+// chmEncInt reads a variable length integer, 7 bits per byte with the most significant
+// group first and the high bit set on all but the last byte.
+func chmEncInt(b []byte) (uint64, []byte, bool) {
+	var v uint64
+	for i := 0; i < len(b) && i < 9; i++ {
+		v = v<<7 | uint64(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return v, b[i+1:], true
+		}
+	}
+	return 0, b, false
+}
+
+// 第1节的压缩参数、重置表和压缩数据都存放在第0节的内部文件中
+const (
+	chmControlData = "::DataSpace/Storage/MSCompressed/ControlData"
+	chmContent     = "::DataSpace/Storage/MSCompressed/Content"
+	chmResetTable  = "::DataSpace/Storage/MSCompressed/Transform/{7FC28940-9D31-11D0-9B27-00A0C91E9C7C}/InstanceData/ResetTable"
+)
+
+// 解压第1节时最多解压的数据量
+const maxCHMContentSize = 64 << 20
+
+func (c *chm) find(name string) *chmFile {
+	for i := range c.files {
+		if c.files[i].Name == name {
+			return &c.files[i]
+		}
+	}
+	return nil
+}
+
+// readFile returns the content of f, decompressing it if it is in the LZX section.
+func (c *chm) readFile(f chmFile) ([]byte, error) {
+	if f.Length > maxAPKIconSize {
+		return nil, errors.New("chm file too large")
+	}
+	switch f.Section {
+	case 0:
+		d := make([]byte, f.Length)
+		if _, err := c.r.ReadAt(d, c.content+int64(f.Offset)); err != nil {
+			return nil, err
+		}
+		return d, nil
+	case 1:
+		return c.readCompressed(f)
+	}
+	return nil, errors.New("unsupported chm section")
+}
+
+// readCompressed decompresses f from the MSCompressed section, starting at the last
+// reset point before it when the reset table gives its position.
+func (c *chm) readCompressed(f chmFile) ([]byte, error) {
+	le := binary.LittleEndian
+	ctl, content := c.find(chmControlData), c.find(chmContent)
+	if ctl == nil || content == nil || ctl.Section != 0 || content.Section != 0 || ctl.Length > 4096 {
+		return nil, errors.New("invalid chm compressed section")
+	}
+	d, err := c.readFile(*ctl)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) < 20 || string(d[4:8]) != "LZXC" {
+		return nil, errors.New("unsupported chm compression")
+	}
+	reset, window := uint64(le.Uint32(d[12:])), uint64(le.Uint32(d[16:]))
+	// 版本2的重置间隔和窗口大小以帧（32K）为单位
+	if le.Uint32(d[8:]) == 2 {
+		reset, window = reset*lzxFrameSize, window*lzxFrameSize
+	}
+	bits := uint(15)
+	for bits <= 21 && 1<<bits != window {
+		bits++
+	}
+	if bits > 21 || reset == 0 || reset%lzxFrameSize != 0 || reset > maxCHMContentSize {
+		return nil, errors.New("invalid chm lzx parameters")
+	}
+
+	start, in, inEnd := uint64(0), uint64(0), content.Length
+	if rt := c.find(chmResetTable); rt != nil && rt.Section == 0 {
+		if t, err := c.readFile(*rt); err == nil && len(t) >= 40 {
+			// 重置表中是每一帧在压缩数据中的偏移
+			entries, size, off := uint64(le.Uint32(t[4:])), uint64(le.Uint32(t[8:])), uint64(le.Uint32(t[12:]))
+			entry := func(i uint64) (uint64, bool) {
+				if i >= entries || off+(i+1)*size > uint64(len(t)) {
+					return 0, false
+				}
+				if size == 4 {
+					return uint64(le.Uint32(t[off+i*size:])), true
+				}
+				return le.Uint64(t[off+i*size:]), size == 8
+			}
+			frame := f.Offset / reset * (reset / lzxFrameSize)
+			if v, ok := entry(frame); ok && v <= inEnd {
+				start, in = frame*lzxFrameSize, v
+				if v, ok := entry((f.Offset + f.Length + lzxFrameSize - 1) / lzxFrameSize); ok && v >= in && v <= inEnd {
+					inEnd = v
+				}
+			}
+		}
+	}
+
+	n := f.Offset + f.Length - start
+	if n > maxCHMContentSize || in > inEnd {
+		return nil, errors.New("chm file too large")
+	}
+	// 压缩的数据最多比原始数据略大（未压缩块），不必读入整个Content
+	cd := make([]byte, min(inEnd-in, n+n>>3+lzxFrameSize))
+	if _, err := c.r.ReadAt(cd, c.content+int64(content.Offset+in)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	out, err := lzxDecompress(cd, bits, int(reset), int64(start), int(n))
+	if err != nil {
+		return nil, err
+	}
+	return out[f.Offset-start:], nil
+}
+
+// chmIcon returns the logo embedded in a .chm: an image whose name contains "logo" or
+// "icon" first, then any .ico, then the largest image.
+func chmIcon(r io.ReaderAt) ([]byte, error) {
+	c, err := openCHM(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *chmFile
+	bp := -1
+	for i, f := range c.files {
+		name := strings.ToLower(f.Name)
+		// ::DataSpace等是内部的元数据
+		if !strings.HasPrefix(name, "/") || f.Length == 0 || f.Section > 1 {
+			continue
+		}
+
+		prio := 0
+		switch path.Ext(name) {
+		case ".ico":
+			prio = 1
+		case ".png", ".bmp", ".gif", ".jpg", ".jpeg":
+		default:
+			continue
+		}
+		if strings.Contains(path.Base(name), "logo") || strings.Contains(path.Base(name), "icon") {
+			prio += 2
+		}
+
+		if prio > bp || (prio == bp && f.Length > best.Length) {
+			best, bp = &c.files[i], prio
+		}
+	}
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return c.readFile(*best)
+}
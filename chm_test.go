@@ -0,0 +1,404 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// lzxWriter writes an LZX bitstream: 16-bit little endian words filled from the high bit.
+type lzxWriter struct {
+	out   []byte
+	word  uint32
+	nbits uint
+}
+
+func (w *lzxWriter) bits(v uint32, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.word = w.word<<1 | v>>i&1
+		if w.nbits++; w.nbits == 16 {
+			w.out = binary.LittleEndian.AppendUint16(w.out, uint16(w.word))
+			w.word, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *lzxWriter) align() {
+	for w.nbits != 0 {
+		w.bits(0, 1)
+	}
+}
+
+// lzxCode is a canonical Huffman code given by its lengths.
+type lzxCode struct {
+	lens  []uint8
+	codes []uint32
+}
+
+func newLZXCode(lens []uint8) lzxCode {
+	c := lzxCode{lens: lens, codes: make([]uint32, len(lens))}
+	next := uint32(0)
+	for l := uint8(1); l <= lzxMaxBits; l++ {
+		for s, n := range lens {
+			if n == l {
+				c.codes[s] = next
+				next++
+			}
+		}
+		next <<= 1
+	}
+	return c
+}
+
+func (w *lzxWriter) sym(c lzxCode, s int) {
+	w.bits(c.codes[s], uint(c.lens[s]))
+}
+
+// lengths writes lens delta coded against prev, using all the run codes of the pretree.
+func (w *lzxWriter) lengths(prev, lens []uint8) {
+	pre := make([]uint8, lzxPretreeSymbols)
+	for i := range pre {
+		pre[i] = 4
+		if i >= 12 {
+			pre[i] = 5
+		}
+		w.bits(uint32(pre[i]), 4)
+	}
+	pt := newLZXCode(pre)
+
+	for x := 0; x < len(lens); {
+		run := 1
+		for x+run < len(lens) && lens[x+run] == lens[x] {
+			run++
+		}
+		switch {
+		case lens[x] == 0 && run >= 20:
+			run = min(run, 51)
+			w.sym(pt, 18)
+			w.bits(uint32(run-20), 5)
+		case lens[x] == 0 && run >= 4:
+			run = min(run, 19)
+			w.sym(pt, 17)
+			w.bits(uint32(run-4), 4)
+		case run >= 4:
+			run = min(run, 5)
+			w.sym(pt, 19)
+			w.bits(uint32(run-4), 1)
+			w.sym(pt, (int(prev[x])-int(lens[x])+17)%17)
+		default:
+			run = 1
+			w.sym(pt, (int(prev[x])-int(lens[x])+17)%17)
+		}
+		x += run
+	}
+	copy(prev, lens)
+}
+
+// lzxEncode compresses data with a 64K window, resetting every resetInterval bytes. Each
+// reset interval is cut into a verbatim block crossing a frame, an uncompressed block of
+// odd length and an aligned offset block. It returns the stream and the offset of every
+// frame in it.
+func lzxEncode(data []byte, resetInterval int) ([]byte, []int) {
+	const slots = 32
+	w := &lzxWriter{}
+	frames := []int{0}
+	nextFrame := lzxFrameSize
+	endFrames := func(p int) {
+		for p >= nextFrame {
+			w.align()
+			frames = append(frames, len(w.out))
+			nextFrame += lzxFrameSize
+		}
+	}
+
+	// 两套完整的主树，轮流使用
+	mainA, mainB := make([]uint8, lzxNumChars+slots*8), make([]uint8, lzxNumChars+slots*8)
+	for s := range mainA {
+		mainA[s] = 9
+		switch {
+		case s < 128:
+			mainB[s] = 10
+		case s < lzxNumChars+192:
+			mainB[s] = 9
+		default:
+			mainB[s] = 8
+		}
+	}
+	lengthLens := make([]uint8, lzxLengthSymbols)
+	for s := range lengthLens {
+		lengthLens[s] = 8
+		if s < 7 {
+			lengthLens[s] = 7
+		}
+	}
+	alignedLens := []uint8{3, 3, 3, 3, 3, 3, 3, 3}
+	lengthCode, alignedCode := newLZXCode(lengthLens), newLZXCode(alignedLens)
+
+	for rs := 0; rs < len(data); rs += resetInterval {
+		re := min(rs+resetInterval, len(data))
+		r := [3]int{1, 1, 1}
+		prevMain, prevLength := make([]uint8, len(mainA)), make([]uint8, lzxLengthSymbols)
+		last := map[string]int{}
+		w.bits(0, 1) // 不做E8转换
+
+		for i, bs := 0, rs; bs < re; i++ {
+			typ := []int{lzxBlockVerbatim, lzxBlockUncompressed, lzxBlockAligned}[i%3]
+			be := min(bs+[]int{40000, 1001, 1 << 20}[i%3], re)
+			w.bits(uint32(typ), 3)
+			w.bits(uint32(be-bs)>>8, 16)
+			w.bits(uint32(be-bs)&0xFF, 8)
+
+			if typ == lzxBlockUncompressed {
+				if w.nbits == 0 {
+					w.bits(0, 16)
+				}
+				w.align()
+				for _, v := range r {
+					w.out = binary.LittleEndian.AppendUint32(w.out, uint32(v))
+				}
+				for p := bs; p < be; p++ {
+					w.out = append(w.out, data[p])
+					endFrames(p + 1)
+				}
+				if (be-bs)&1 != 0 {
+					w.out = append(w.out, 0)
+				}
+				bs = be
+				continue
+			}
+
+			if typ == lzxBlockAligned {
+				for _, l := range alignedLens {
+					w.bits(uint32(l), 3)
+				}
+			}
+			lens := mainA
+			if i%2 != 0 {
+				lens = mainB
+			}
+			w.lengths(prevMain[:lzxNumChars], lens[:lzxNumChars])
+			w.lengths(prevMain[lzxNumChars:], lens[lzxNumChars:])
+			w.lengths(prevLength, lengthLens)
+			mainCode := newLZXCode(lens)
+
+			for p := bs; p < be; {
+				matchLen := func(off int) int {
+					n := 0
+					for p+n < be && n < 257 && data[p+n] == data[p+n-off] {
+						n++
+					}
+					return n
+				}
+				// 先试重复的偏移，再试上一次出现的位置
+				bestLen, bestOff, slot := 0, 0, 0
+				for j, off := range r {
+					if p-off >= rs {
+						if n := matchLen(off); n >= 2 && n > bestLen {
+							bestLen, bestOff, slot = n, off, j
+						}
+					}
+				}
+				if p+3 <= be {
+					if c, ok := last[string(data[p:p+3])]; ok && c >= rs {
+						if n := matchLen(p - c); n >= 3 && n > bestLen+1 {
+							bestLen, bestOff, slot = n, p-c, -1
+						}
+					}
+				}
+				for q := p; q < p+max(bestLen, 1) && q+3 <= len(data); q++ {
+					last[string(data[q:q+3])] = q
+				}
+
+				if bestLen == 0 {
+					w.sym(mainCode, int(data[p]))
+					p++
+					endFrames(p)
+					continue
+				}
+
+				fo := bestOff + 2
+				switch slot {
+				case 0:
+				case 1, 2:
+					r[0], r[slot] = r[slot], r[0]
+				default:
+					for slot = 3; lzxPositionBase[slot+1] <= uint32(fo); slot++ {
+					}
+					r[2], r[1], r[0] = r[1], r[0], bestOff
+				}
+				header := min(bestLen-lzxMinMatch, lzxPrimaryLengths)
+				w.sym(mainCode, lzxNumChars+slot<<3|header)
+				if header == lzxPrimaryLengths {
+					w.sym(lengthCode, bestLen-lzxMinMatch-lzxPrimaryLengths)
+				}
+				if slot >= 3 {
+					extra := uint(lzxExtraBits[slot])
+					v := uint32(fo) - lzxPositionBase[slot]
+					if typ == lzxBlockAligned && extra >= 3 {
+						w.bits(v>>3, extra-3)
+						w.sym(alignedCode, int(v&7))
+					} else {
+						w.bits(v, extra)
+					}
+				}
+				p += bestLen
+				endFrames(p)
+			}
+			bs = be
+		}
+	}
+	w.align()
+	return w.out, frames
+}
+
+// chmEntry is a file of a test chm: section 0 files are stored as is, section 1 files
+// are placed at offset in the compressed content.
+type chmEntry struct {
+	name    string
+	section uint64
+	offset  uint64
+	data    []byte
+}
+
+// buildCHM writes a version 3 chm with a single listing chunk.
+func buildCHM(entries []chmEntry) []byte {
+	le := binary.LittleEndian
+	encInt := func(b []byte, v uint64) []byte {
+		var g []byte
+		for g = []byte{byte(v & 0x7F)}; v > 0x7F; {
+			v >>= 7
+			g = append([]byte{byte(v&0x7F) | 0x80}, g...)
+		}
+		return append(b, g...)
+	}
+
+	var content, ents []byte
+	for _, e := range entries {
+		off := e.offset
+		if e.section == 0 {
+			off = uint64(len(content))
+			content = append(content, e.data...)
+		}
+		ents = encInt(ents, uint64(len(e.name)))
+		ents = append(ents, e.name...)
+		ents = encInt(ents, e.section)
+		ents = encInt(ents, off)
+		ents = encInt(ents, uint64(len(e.data)))
+	}
+
+	const chunkSize = 4096
+	chunk := append([]byte("PMGL"), le.AppendUint32(nil, uint32(chunkSize-20-len(ents)))...)
+	chunk = append(chunk, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	chunk = append(chunk, ents...)
+	chunk = append(chunk, make([]byte, chunkSize-len(chunk))...)
+
+	dir := []byte("ITSP")
+	for _, v := range []uint32{1, 0x54, 10, chunkSize, 2, 1, 0xFFFFFFFF, 0, 0, 0xFFFFFFFF, 1, 0x409} {
+		dir = le.AppendUint32(dir, v)
+	}
+	dir = append(dir, make([]byte, 0x54-len(dir))...)
+	dir = append(dir, chunk...)
+
+	hdr := []byte("ITSF")
+	for _, v := range []uint32{3, 0x60, 1, 0, 0x409} {
+		hdr = le.AppendUint32(hdr, v)
+	}
+	hdr = append(hdr, make([]byte, 32)...)
+	for _, v := range []uint64{0, 0, 0x60, uint64(len(dir)), uint64(0x60 + len(dir))} {
+		hdr = le.AppendUint64(hdr, v)
+	}
+	return append(append(hdr, dir...), content...)
+}
+
+// testCHMContent returns some compressible html around a PNG, and the offset of the PNG.
+func testCHMContent(t *testing.T) ([]byte, []byte, int) {
+	rnd := rand.New(rand.NewSource(1))
+	words := strings.Fields("the icon of this help file is stored in the compressed section with other pages")
+	text := func(n int) []byte {
+		var b []byte
+		for len(b) < n {
+			b = append(b, words[rnd.Intn(len(words))]...)
+			b = append(b, " \n"[rnd.Intn(2)])
+		}
+		return b[:n]
+	}
+	logo := testPNG(t, 64, 64)
+	content := append(text(70000), logo...)
+	return append(content, text(30000)...), logo, 70000
+}
+
+func TestLZXDecompress(t *testing.T) {
+	content, _, _ := testCHMContent(t)
+	stream, frames := lzxEncode(content, 2*lzxFrameSize)
+
+	out, err := lzxDecompress(stream, 16, 2*lzxFrameSize, 0, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Fatal("decompressed content differs")
+	}
+
+	// 从第二个重置点开始解压
+	out, err = lzxDecompress(stream[frames[2]:], 16, 2*lzxFrameSize, 2*lzxFrameSize, len(content)-2*lzxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content[2*lzxFrameSize:]) {
+		t.Fatal("content decompressed from a reset point differs")
+	}
+
+	if _, err := lzxDecompress(stream[:len(stream)/2], 16, 2*lzxFrameSize, 0, len(content)); err == nil {
+		t.Fatal("expected an error for a truncated stream")
+	}
+}
+
+func TestCHMCompressedIcon(t *testing.T) {
+	content, logo, off := testCHMContent(t)
+	stream, frames := lzxEncode(content, 2*lzxFrameSize)
+
+	le := binary.LittleEndian
+	ctl := le.AppendUint32(nil, 6)
+	ctl = append(ctl, "LZXC"...)
+	for _, v := range []uint32{2, 2, 2, 2, 0} {
+		ctl = le.AppendUint32(ctl, v)
+	}
+	rt := []byte{}
+	for _, v := range []uint32{2, uint32(len(frames)), 8, 0x28} {
+		rt = le.AppendUint32(rt, v)
+	}
+	for _, v := range []uint64{uint64(len(content)), uint64(len(stream)), lzxFrameSize} {
+		rt = le.AppendUint64(rt, v)
+	}
+	for _, f := range frames {
+		rt = le.AppendUint64(rt, uint64(f))
+	}
+
+	entries := []chmEntry{
+		{name: "/", section: 0},
+		{name: "/images/logo.png", section: 1, offset: uint64(off), data: logo},
+		{name: "/index.html", section: 1, data: content[:off]},
+		{name: chmContent, data: stream},
+		{name: chmControlData, data: ctl},
+		{name: chmResetTable, data: rt},
+	}
+	d := buildCHM(entries)
+	icon, err := chmIcon(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(icon, logo) {
+		t.Fatal("expected /images/logo.png")
+	}
+
+	// 没有重置表时从头解压
+	d = buildCHM(entries[:len(entries)-1])
+	if icon, err = chmIcon(bytes.NewReader(d)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(icon, logo) {
+		t.Fatal("expected /images/logo.png without a reset table")
+	}
+}
@@ -0,0 +1,82 @@
+//go:build windows
+
+package fico
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ExtIcon converts the icon registered for the file extension ext (e.g. ".txt") in the
+// DefaultIcon key of its ProgID. The index in the registry value replaces Config.Index.
+func ExtIcon(ext string, w io.Writer, cfg ...Config) error {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+
+	// 先看扩展名本身有没有DefaultIcon，再通过ProgID（CurVer指向的当前版本优先）查找
+	v, err := regString(syscall.HKEY_CLASSES_ROOT, ext+`\DefaultIcon`)
+	if err != nil {
+		progID, err := regString(syscall.HKEY_CLASSES_ROOT, ext)
+		if err != nil || progID == "" {
+			return ErrNoIcon
+		}
+		if cur, err := regString(syscall.HKEY_CLASSES_ROOT, progID+`\CurVer`); err == nil && cur != "" {
+			progID = cur
+		}
+		if v, err = regString(syscall.HKEY_CLASSES_ROOT, progID+`\DefaultIcon`); err != nil {
+			return ErrNoIcon
+		}
+	}
+
+	// 形如"C:\Windows\system32\imageres.dll",-102，"%1"表示用文件自身的图标，这里无法处理
+	file, idx := parseIconResource(v)
+	file = strings.Trim(file, `"`)
+	if file == "" || strings.Contains(file, "%1") {
+		return ErrNoIcon
+	}
+
+	c := Config{}
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	if idx != nil {
+		c.Index = idx
+	}
+	debugf([]Config{c}, "fico: %s default icon %q", ext, v)
+	return F2ICO(w, file, c)
+}
+
+// regString reads the default value of key\subkey, expanding environment variables.
+func regString(key syscall.Handle, subkey string) (string, error) {
+	p, err := syscall.UTF16PtrFromString(subkey)
+	if err != nil {
+		return "", err
+	}
+	var h syscall.Handle
+	if err = syscall.RegOpenKeyEx(key, p, 0, syscall.KEY_READ, &h); err != nil {
+		return "", err
+	}
+	defer syscall.RegCloseKey(h)
+
+	var typ, n uint32
+	if err = syscall.RegQueryValueEx(h, nil, nil, &typ, nil, &n); err != nil {
+		return "", err
+	}
+	if typ != syscall.REG_SZ && typ != syscall.REG_EXPAND_SZ {
+		return "", errors.New("registry value is not a string")
+	}
+	if n < 2 {
+		return "", nil
+	}
+	buf := make([]uint16, n/2+1)
+	if err = syscall.RegQueryValueEx(h, nil, nil, &typ, (*byte)(unsafe.Pointer(&buf[0])), &n); err != nil {
+		return "", err
+	}
+
+	// DefaultIcon中的%SystemRoot%等不一定是REG_EXPAND_SZ，都展开一遍
+	return expandEnv(syscall.UTF16ToString(buf)), nil
+}
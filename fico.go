@@ -1,105 +1,1670 @@
 package fico
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"debug/pe"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"image"
 	"image/color"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf16"
 
 	"gopkg.in/ini.v1"
 
-	_ "image/gif"
-	_ "image/jpeg"
-
 	"github.com/andrianbdn/iospng"
 	"github.com/appflight/apkparser"
 	_ "github.com/cbeer/jpeg2000"
 	"github.com/tmc/icns"
 	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 	_ "golang.org/x/image/tiff"
 )
 
 type Config struct {
-	Format string // png or ico(default)
-	Width  int    // 0 for all
-	Height int    // 0 for all
-	Index  *int   // 0 default, nil for all，enabled for PE only
+	Format        string      // png, jpeg, icns or ico(default)
+	Width         int         // 0 for all
+	Height        int         // 0 for all
+	Index         *int        // 0 default, nil for all，enabled for PE, ICNS and APNG（ICNS中为过滤后的表示序号，只输出单张，越界时返回错误；APNG中为动画帧序号）
+	Sharpen       float64     // 缩放后锐化（USM）的强度，0为关闭，0.5左右比较温和
+	MaxPixels     int         // 解码前检查的像素数上限，防止解压炸弹，0为不限制（目前用于apk和apng）
+	PreferLarger  bool        // 没有完全匹配的尺寸时，优先选择比目标大的图标缩小，而不是放大小的图标
+	SingleFrame   bool        // 只输出质量最高的一张图标（目前用于icns）
+	Deterministic bool        // 去掉PNG中的时间和文本等元数据，保证相同输入和配置的输出逐字节一致
+	DPI           int         // apk中选择最接近该DPI的图标（如160为mdpi，480为xxhdpi），0为选择最高DPI
+	MinSize       int         // 只输出边长不小于该值的图标，0为不限制
+	MaxSize       int         // 只输出边长不大于该值的图标，0为不限制
+	JPEGQuality   int         // jpeg格式的质量（1-100），0为默认值75
+	Background    color.Color // jpeg格式没有透明度，透明部分使用的底色，nil为白色
+	KeepICC       bool        // 保留源PNG中的ICC色彩配置（iCCP），缩放、重新编码的图标也会带上
+	Purpose       string      // apk自适应图标的图层：any(default)、maskable（前景叠加背景）、foreground、background、monochrome
+	Language      uint16      // PE中优先使用该语言（LCID，如2052为简体中文）的图标，依次回退到中性语言、英语（1033）、第一个
+	NoFallback    bool        // PE中没有图标时返回ErrNoIcon，而不是输出内置的GUI、CUI、DLL默认图标
+	KeepAllFrames bool        // 指定了宽高时ico仍保留所有原始帧（不缩放、不重新编码），最匹配的一帧放在最前面（设置了EntryOrder时按EntryOrder）
+	PNGMask       bool        // icns中PNG存储的图标也乘上同尺寸的8位掩码（s8mk、l8mk等）的透明度，默认只用PNG自身的透明度
+	POT           bool        // 输出的宽高向上取整到2的幂（用于纹理），图标居中，四周透明
+	EdgeExtend    bool        // 缩放后的留白用源图边缘模糊拉伸后填充，而不是透明（适合非正方形的照片）
+	LegacyBMP     bool        // ico中小于256的图标输出为32位DIB（带AND掩码）而不是PNG，兼容XP等旧系统
+	MaskThreshold uint8       // LegacyBMP的AND掩码中，alpha小于该值的像素视为透明，0为默认值128
+	SizeTolerance int         // 源图宽高与指定尺寸相差都不超过该值时不缩放，原样输出，0为必须一致
+	EntryOrder    EntryOrder  // 输出ico中目录项的顺序，旧版Windows按顺序取第一个匹配的图标，默认保持源顺序
+	DPIScale      float64     // Width、Height是逻辑尺寸时的显示缩放比例（如1.5为150%），按乘积选择和缩放，0为不换算
+	Shape         Shape       // 编码前把每一帧裁剪成该形状（圆角、圆形、超椭圆），边缘抗锯齿
+	CornerRadius  int         // ShapeRounded的圆角半径，按短边的百分比（1-50），0为默认值20
+	// PE中没有标准的图标资源时，从RCDATA等其他类型的资源中查找ico、png数据
+	ScanAllResources bool
+	// 容器格式（apk、ipa）中同时有内容缩略图（docProps、Thumbnails下的缩略图）时优先使用，默认使用应用图标
+	PreferThumbnail bool
+	// 没有透明通道的位图（gif、bmp等）中用作透明色的颜色键（如品红0xFF00FF），解码后完全一致的像素变为透明
+	TransparentColor color.Color
+	// 每一帧解码、缩放之后，编码之前的处理（如水印、角标），返回的图片尺寸可以不同
+	Transform func(img *image.RGBA, size image.Point) image.Image
+	// 输出转换过程中的调试信息，nil时使用SetLogger设置的全局日志
+	Logger Logger
+}
+
+// EntryOrder is the order of the entries in an output ico.
+type EntryOrder int
+
+const (
+	SourceOrder    EntryOrder = iota // 保持源文件中的顺序
+	SizeAscending                    // 从小到大
+	SizeDescending                   // 从大到小
+	BitDepthFirst                    // 色深高的在前，色深相同时从大到小
+)
+
+// Shape is the outline each frame is clipped to before encoding.
+type Shape int
+
+const (
+	ShapeNone     Shape = iota // 不裁剪
+	ShapeRounded               // 圆角矩形，半径见CornerRadius
+	ShapeCircle                // 圆形（非正方形时为椭圆）
+	ShapeSquircle              // 超椭圆（|x|^5+|y|^5=1），类似macOS Big Sur的图标外形
+)
+
+// ConfigFromMap builds a Config from string options, e.g. command line flags or query
+// parameters: "format", "width", "height", "index" ("all" for every icon) and "size" or
+// "sizes" as "32" or "32x48". Config holds a single size, so a list of sizes is rejected.
+func ConfigFromMap(m map[string]string) (Config, error) {
+	var cfg Config
+	atoi := func(k, v string) (int, error) {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, errors.New("invalid " + k + " " + strconv.Quote(v) + ": not an integer")
+		}
+		return n, nil
+	}
+	size := func(k, v string) (int, error) {
+		n, err := atoi(k, v)
+		if err == nil && n < 0 {
+			err = errors.New("invalid " + k + " " + strconv.Quote(v) + ": must not be negative")
+		}
+		return n, err
+	}
+
+	// 按键名排序处理，出错时报告的总是同一个键
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := m[k]
+		var err error
+		switch strings.ToLower(k) {
+		case "format":
+			switch f := strings.ToLower(strings.TrimSpace(v)); f {
+			case "", "ico", "png", "jpeg", "icns":
+				cfg.Format = f
+			case "jpg":
+				cfg.Format = "jpeg"
+			default:
+				return cfg, errors.New("unknown format " + strconv.Quote(v) + ": want ico, png, jpeg or icns")
+			}
+		case "width":
+			cfg.Width, err = size(k, v)
+		case "height":
+			cfg.Height, err = size(k, v)
+		case "size", "sizes":
+			if strings.Contains(v, ",") {
+				return cfg, errors.New("invalid " + k + " " + strconv.Quote(v) + ": only one size is supported")
+			}
+			w, h, ok := strings.Cut(strings.ToLower(v), "x")
+			if !ok {
+				h = w
+			}
+			if cfg.Width, err = size(k, w); err == nil {
+				cfg.Height, err = size(k, h)
+			}
+		case "index":
+			if strings.EqualFold(strings.TrimSpace(v), "all") {
+				cfg.Index = nil
+				continue
+			}
+			var idx int
+			if idx, err = atoi(k, v); err == nil {
+				cfg.Index = &idx
+			}
+		default:
+			return cfg, errors.New("unknown option " + strconv.Quote(k))
+		}
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// Logger receives trace messages about the decisions made during a conversion.
+type Logger interface {
+	Debugf(format string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+
+var logger Logger = nopLogger{}
+
+// SetLogger sets the package level logger used when Config.Logger is nil, nil to disable.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+func debugf(cfg []Config, format string, args ...any) {
+	if len(cfg) > 0 && cfg[0].Logger != nil {
+		cfg[0].Logger.Debugf(format, args...)
+		return
+	}
+	logger.Debugf(format, args...)
 }
 
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	ErrNoIcon            = errors.New("no icon found")
+	ErrNoOptionalHeader  = errors.New("pe file has no optional header")
+	ErrEmptyImage        = errors.New("image has zero width or height")
+)
+
 func F2ICO(w io.Writer, path string, cfg ...Config) error {
 	ext := strings.ToLower(filepath.Ext(path))
 	switch ext {
+	case ".exe", ".dll", ".mui", ".mun":
+		// 图标可能被重定向到同名的.mun、.mui文件中
+		return peICO(w, path, cfg...)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f2ICO(w, ext, f, cfg...)
+}
+
+// F2ICOFS is like F2ICO but reads name from fsys, e.g. an embed.FS or a zip archive.
+// The file is read into memory as most formats need random access.
+func F2ICOFS(w io.Writer, fsys fs.FS, name string, cfg ...Config) error {
+	d, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	return f2ICO(w, strings.ToLower(path.Ext(name)), bytes.NewReader(d), cfg...)
+}
+
+// F2ICOFromBytes converts data already in memory, detecting its format from the magic
+// number as no file name is available. Formats that cannot be told apart by content
+// (e.g. zip based ones) return ErrUnsupportedFormat.
+func F2ICOFromBytes(w io.Writer, data []byte, cfg ...Config) error {
+	return f2ICO(w, "", bytes.NewReader(data), cfg...)
+}
+
+// APK2ICO converts the launcher icon of the APK of size bytes read from r, e.g. an upload
+// held in memory, with the same icon and density selection as F2ICO on an .apk file.
+func APK2ICO(w io.Writer, r io.ReaderAt, size int64, cfg ...Config) error {
+	return f2ICO(w, ".apk", io.NewSectionReader(r, 0, size), cfg...)
+}
+
+// F2ICOFromArchive converts the file innerPath inside the tar (or gzipped tar) archive at
+// archivePath, by the extension of innerPath, without extracting the archive to disk.
+func F2ICOFromArchive(w io.Writer, archivePath, innerPath string, cfg ...Config) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 按文件头判断是否gzip压缩，不依赖.tgz、.tar.gz等扩展名
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	name := path.Clean(strings.TrimPrefix(innerPath, "/"))
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return &fs.PathError{Op: "open", Path: innerPath, Err: fs.ErrNotExist}
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Clean(strings.TrimPrefix(hdr.Name, "/")) != name {
+			continue
+		}
+
+		// 大部分格式需要随机访问，读到内存中
+		d, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		return f2ICO(w, strings.ToLower(path.Ext(name)), bytes.NewReader(d), cfg...)
+	}
+}
+
+// 需要随机访问的格式（PE、zip等）同时要用到ReaderAt
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// f2ICO converts the content of r by the format its extension ext stands for.
+func f2ICO(w io.Writer, ext string, r readSeekerAt, cfg ...Config) error {
+	cfg = physicalSize(cfg)
+	// 没有扩展名（如Makefile）时按文件头判断格式
+	if ext == "" {
+		if ext = sniffExt(r); ext == "" {
+			return ErrUnsupportedFormat
+		}
+	}
+	debugf(cfg, "fico: dispatch %q", ext)
+	switch ext {
 	// https://superuser.com/questions/1480268/icons-no-longer-in-imageres-dll-in-windows-10-1903-4kb-file
 	case ".exe", ".dll", ".mui", ".mun":
-		return PE2ICO(w, path, cfg...)
+		peFile, err := pe.NewFile(r)
+		if err != nil {
+			return err
+		}
+		return pe2ICO(w, peFile, false, cfg...)
+
+	case ".ico":
+		return ICO2ICO(w, r, cfg...)
+	case ".icns":
+		return ICNS2ICO(w, r, cfg...)
+	case ".png":
+		// 指定了序号时从APNG动画中选择一帧
+		if len(cfg) > 0 && cfg[0].Index != nil && *cfg[0].Index >= 0 {
+			d, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if frames, err := parseAPNG(d, cfg...); err == nil && *cfg[0].Index < len(frames) {
+				d = frames[*cfg[0].Index].Data
+			}
+			return IMG2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		return IMG2ICO(w, r, cfg...)
+	case ".bmp", ".gif", ".jpg", ".jpeg", ".tiff", ".tga":
+		return IMG2ICO(w, r, cfg...)
+
+	case ".apk":
+		if d := preferredThumbnail(r, cfg...); d != nil {
+			return IMG2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		zr, err := apkparser.OpenZipReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		d, err := apkIcon(zr, cfg...)
+		if err != nil {
+			return err
+		}
+
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".ipa":
+		if d := preferredThumbnail(r, cfg...); d != nil {
+			return IMG2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		zr, err := newZipReader(r)
+		if err != nil {
+			return err
+		}
+
+		iosIconFile := ipaIconFile(zr)
+		if iosIconFile == nil {
+			return ErrNoIcon
+		}
+
+		rc, err := iosIconFile.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		var buf bytes.Buffer
+		iospng.PngRevertOptimization(rc, &buf)
+
+		return IMG2ICO(w, bytes.NewReader(buf.Bytes()), cfg...)
+
+	case ".snap":
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		d, ext, err := snapIcon(r, size)
+		if err != nil {
+			return err
+		}
+		return f2ICO(w, ext, bytes.NewReader(d), cfg...)
+
+	case ".flatpak":
+		d, err := flatpakIcon(r)
+		if err != nil {
+			return err
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".themepack":
+		d, err := themepackIcon(r)
+		if err != nil {
+			return err
+		}
+		return ICO2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".vsix", ".nupkg", ".msix", ".appx":
+		zr, err := newZipReader(r)
+		if err != nil {
+			return err
+		}
+		d, err := packageIcon(zr)
+		if err != nil {
+			return err
+		}
+		// 图标可能是png、ico等，按文件头识别
+		return f2ICO(w, "", bytes.NewReader(d), cfg...)
+
+	case ".iso":
+		return isoICO(w, r, cfg...)
+
+	case ".wim":
+		return wimICO(w, r, cfg...)
+
+	case ".pkg":
+		d, err := pkgIcon(r)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(d, []byte("icns")) {
+			return ICNS2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".asar":
+		d, err := asarIcon(r)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err = parseICO(d); err == nil {
+			return ICO2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".rcc":
+		d, err := rccIcon(r)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err = parseICO(d); err == nil {
+			return ICO2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".chm":
+		d, err := chmIcon(r)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err = parseICO(d); err == nil {
+			return ICO2ICO(w, bytes.NewReader(d), cfg...)
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+
+	case ".svg", ".svgz":
+		// 矢量图直接按目标尺寸渲染，不经过缩放
+		var img *image.RGBA
+		var err error
+		if len(cfg) > 0 {
+			img, err = svgImage(r, cfg[0].Width, cfg[0].Height)
+		} else {
+			img, err = svgImage(r, 0, 0)
+		}
+		if err != nil {
+			return err
+		}
+		zoomed, err := zoomImg(img, cfg...)
+		if err != nil {
+			return err
+		}
+		return img2ICO(w, zoomed, nil, cfg...)
+
+	case ".car":
+		img, err := carIcon(r)
+		if err != nil {
+			return err
+		}
+		zoomed, err := zoomImg(img, cfg...)
+		if err != nil {
+			return err
+		}
+		return img2ICO(w, zoomed, nil, cfg...)
+
+	case ".odt", ".ods", ".odp", ".odg", ".docx", ".xlsx", ".pptx", ".docm", ".xlsm", ".pptm":
+		zr, err := newZipReader(r)
+		if err != nil {
+			return err
+		}
+
+		d, err := officeThumbnail(zr)
+		if err != nil {
+			return err
+		}
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+	}
+
+	return errors.New("conversion failed")
+}
+
+// sniffExt guesses the extension of a file without one from its magic number, "" if unknown.
+// Zip based formats are ambiguous by content and not guessed.
+func sniffExt(r io.ReaderAt) string {
+	b := make([]byte, 16)
+	n, _ := r.ReadAt(b, 0)
+	b = b[:n]
+
+	switch {
+	case bytes.HasPrefix(b, []byte("MZ")):
+		return ".exe"
+	case bytes.HasPrefix(b, []byte{0, 0, 1, 0}):
+		return ".ico"
+	case bytes.HasPrefix(b, []byte("icns")):
+		return ".icns"
+	case isPNG(b):
+		return ".png"
+	case isJPEG(b):
+		return ".jpg"
+	case bytes.HasPrefix(b, []byte("GIF8")):
+		return ".gif"
+	case bytes.HasPrefix(b, []byte("BM")):
+		return ".bmp"
+	case bytes.HasPrefix(b, []byte("II*\x00")), bytes.HasPrefix(b, []byte("MM\x00*")):
+		return ".tiff"
+	case bytes.HasPrefix(b, []byte("xar!")):
+		return ".pkg"
+	case bytes.HasPrefix(b, []byte("hsqs")):
+		return ".snap"
+	case bytes.HasPrefix(b, []byte("ITSF")):
+		return ".chm"
+	case bytes.HasPrefix(b, []byte("qres")):
+		return ".rcc"
+	case bytes.HasPrefix(b, []byte("MSWIM\x00\x00\x00")):
+		return ".wim"
+	}
+	return ""
+}
+
+func newZipReader(r readSeekerAt) (*zip.Reader, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(r, size)
+}
+
+// apk中单个图标文件解压后的大小上限
+const maxAPKIconSize = 32 << 20
+
+// apkIcon resolves the launcher icon declared in the manifest of an APK and returns its
+// undecoded data. As APKs are often untrusted, the entry is read with a size cap and its
+// dimensions are checked against Config.MaxPixels before anything decodes it fully.
+// With Config.Purpose set, a layer of the adaptive icon is returned instead.
+func apkIcon(zr *apkparser.ZipReader, cfg ...Config) ([]byte, error) {
+	purpose := ""
+	if len(cfg) > 0 {
+		purpose = cfg[0].Purpose
+	}
+	if purpose == "" || purpose == "any" {
+		f, err := apkIconFile(zr, cfg...)
+		if err != nil {
+			return nil, err
+		}
+		return apkReadIcon(f, cfg...)
+	}
+
+	switch purpose {
+	case "maskable", "foreground", "background", "monochrome":
+	default:
+		return nil, errors.New("unsupported icon purpose: " + purpose)
+	}
+
+	x, iconPath, err := apkManifestIcon(zr)
+	if err != nil {
+		return nil, err
+	}
+	ai, err := apkAdaptiveIcon(zr, x, iconPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var layer string
+	switch purpose {
+	case "foreground":
+		layer = ai.Foreground.Drawable
+	case "background":
+		layer = ai.Background.Drawable
+	case "monochrome":
+		layer = ai.Monochrome.Drawable
+	default:
+		return apkMaskableIcon(zr, ai, cfg...)
+	}
+
+	f := apkDensityFile(zr, layer, cfg...)
+	if f == nil {
+		return nil, ErrNoIcon
+	}
+	return apkReadIcon(f, cfg...)
+}
+
+func apkReadIcon(f *apkparser.ZipReaderFile, cfg ...Config) ([]byte, error) {
+	if err := f.Open(); err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, err := io.ReadAll(io.LimitReader(f, maxAPKIconSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxAPKIconSize {
+		return nil, errors.New("icon entry too large in apk")
+	}
+
+	if len(cfg) > 0 && cfg[0].MaxPixels > 0 {
+		img, _, err := image.DecodeConfig(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		if img.Width*img.Height > cfg[0].MaxPixels {
+			return nil, errors.New("icon too large in apk")
+		}
 	}
+	return d, nil
+}
+
+// apkXML decodes the binary xml files of an APK, resolving resource references.
+type apkXML struct {
+	p   *apkparser.ApkParser
+	enc *xml.Encoder
+	buf bytes.Buffer
+}
+
+func (x *apkXML) parse(name string) ([]byte, error) {
+	// 解析器绑定了encoder，复用它并清空输出
+	x.buf.Reset()
+	if err := x.p.ParseXml(name); err != nil {
+		return nil, err
+	}
+	x.enc.Flush()
+	return x.buf.Bytes(), nil
+}
+
+// apkManifestIcon returns the xml decoder of the APK and the icon path declared in its manifest.
+func apkManifestIcon(zr *apkparser.ZipReader) (*apkXML, string, error) {
+	x := &apkXML{}
+	x.enc = xml.NewEncoder(&x.buf)
+	p, err := apkparser.NewParser(zr, x.enc)
+	if err != nil {
+		return nil, "", err
+	}
+	x.p = p
+
+	d, err := x.parse("AndroidManifest.xml")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var manifest apkparser.Manifest
+	xml.Unmarshal(d, &manifest)
+	iconPath, _ := manifest.App.Icon.String()
+	return x, iconPath, nil
+}
+
+// apkIconFile resolves the launcher icon declared in the manifest to its zip entry.
+// The same icon usually exists once per screen density, e.g. res/mipmap-mdpi/ic_launcher.png
+// and res/mipmap-xxhdpi/ic_launcher.png; the one closest to Config.DPI is picked, or the
+// densest one when no DPI is given.
+func apkIconFile(zr *apkparser.ZipReader, cfg ...Config) (*apkparser.ZipReaderFile, error) {
+	_, iconPath, err := apkManifestIcon(zr)
+	if err != nil {
+		return nil, err
+	}
+	f := apkDensityFile(zr, iconPath, cfg...)
+	if f == nil {
+		debugf(cfg, "fico: apk icon %q not found, scanning launcher bitmaps", iconPath)
+		if f = apkLauncherFile(zr, cfg...); f == nil {
+			return nil, ErrNoIcon
+		}
+	}
+	return f, nil
+}
+
+// 按名字找启动图标时的优先级，完整的图标优先于自适应图标的单个图层
+var apkLauncherNames = []string{"ic_launcher", "ic_launcher_round", "app_icon", "icon"}
+
+// apkLauncherFile looks for a launcher bitmap by its conventional name when the manifest
+// icon can't be resolved. The best density wins; on a tie the name earlier in
+// apkLauncherNames wins, so ic_launcher beats ic_launcher_foreground.
+func apkLauncherFile(zr *apkparser.ZipReader, cfg ...Config) *apkparser.ZipReaderFile {
+	dpi := 0
+	if len(cfg) > 0 {
+		dpi = cfg[0].DPI
+	}
+
+	var best *apkparser.ZipReaderFile
+	bw, bp := math.MinInt32, 0
+	for _, fn := range zr.FilesOrdered {
+		d, n := path.Split(fn.Name)
+		ext := strings.ToLower(path.Ext(n))
+		if (ext != ".png" && ext != ".webp") ||
+			(!strings.HasPrefix(d, "res/mipmap") && !strings.HasPrefix(d, "res/drawable")) {
+			continue
+		}
+
+		// 不在列表中的ic_launcher_*（如foreground、background）排在最后
+		stem, prio := strings.TrimSuffix(n, path.Ext(n)), -1
+		for i, name := range apkLauncherNames {
+			if stem == name {
+				prio = len(apkLauncherNames) - i
+				break
+			}
+		}
+		if prio < 0 {
+			if !strings.HasPrefix(stem, "ic_launcher") {
+				continue
+			}
+			prio = 0
+		}
+
+		if w := apkDensityWeight(d, dpi); w > bw || (w == bw && prio > bp) {
+			best, bw, bp = fn, w, prio
+		}
+	}
+	return best
+}
+
+// apkDensityFile returns the bitmap of resource name in the density closest to Config.DPI,
+// or the entry of name itself if no bitmap sibling exists, nil if name is not in the APK.
+func apkDensityFile(zr *apkparser.ZipReader, name string, cfg ...Config) *apkparser.ZipReaderFile {
+	f := zr.File[name]
+	if f == nil {
+		return nil
+	}
+
+	dpi := 0
+	if len(cfg) > 0 {
+		dpi = cfg[0].DPI
+	}
+
+	// 在同类型的其他密度目录中找同名的位图图标
+	dir, base := path.Split(name)
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	typ := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(dir, "res/"), "/"), "-", 2)[0]
+	best, bw := f, apkDensityWeight(dir, dpi)
+	if path.Ext(base) == ".xml" {
+		bw = math.MinInt32
+	}
+	for _, fn := range zr.FilesOrdered {
+		d, n := path.Split(fn.Name)
+		if d == dir || path.Ext(n) == ".xml" || strings.TrimSuffix(n, path.Ext(n)) != stem ||
+			!strings.HasPrefix(d, "res/"+typ+"-") {
+			continue
+		}
+		if w := apkDensityWeight(d, dpi); w > bw {
+			best, bw = fn, w
+		}
+	}
+	return best
+}
+
+type apkLayer struct {
+	Drawable string `xml:"http://schemas.android.com/apk/res/android drawable,attr"`
+}
+
+// https://developer.android.com/develop/ui/views/launch/icon_design_adaptive
+type apkAdaptive struct {
+	Background apkLayer `xml:"background"`
+	Foreground apkLayer `xml:"foreground"`
+	Monochrome apkLayer `xml:"monochrome"`
+}
+
+// apkAdaptiveIcon parses the adaptive-icon xml of the launcher icon. The manifest icon is
+// usually resolved to a bitmap fallback, so the xml is looked up by the same name in the
+// other qualifier directories of the resource type, e.g. res/mipmap-anydpi-v26/.
+func apkAdaptiveIcon(zr *apkparser.ZipReader, x *apkXML, iconPath string) (*apkAdaptive, error) {
+	dir, base := path.Split(iconPath)
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	typ := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(dir, "res/"), "/"), "-", 2)[0]
+
+	for _, fn := range zr.FilesOrdered {
+		d, n := path.Split(fn.Name)
+		if n != stem+".xml" || (d != "res/"+typ+"/" && !strings.HasPrefix(d, "res/"+typ+"-")) {
+			continue
+		}
+
+		data, err := x.parse(fn.Name)
+		if err != nil {
+			continue
+		}
+		var ai apkAdaptive
+		if xml.Unmarshal(data, &ai) != nil || ai.Foreground.Drawable == "" {
+			continue
+		}
+		return &ai, nil
+	}
+	return nil, ErrNoIcon
+}
+
+// apkMaskableIcon draws the foreground layer over the background layer, the full-bleed
+// square that launchers mask into their own shape. A color background is filled in.
+func apkMaskableIcon(zr *apkparser.ZipReader, ai *apkAdaptive, cfg ...Config) ([]byte, error) {
+	decode := func(name string) (image.Image, error) {
+		f := apkDensityFile(zr, name, cfg...)
+		if f == nil {
+			return nil, ErrNoIcon
+		}
+		d, err := apkReadIcon(f, cfg...)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(d))
+		return img, err
+	}
+
+	fg, err := decode(ai.Foreground.Drawable)
+	if err != nil {
+		return nil, err
+	}
+	rect := image.Rect(0, 0, fg.Bounds().Dx(), fg.Bounds().Dy())
+	dst := image.NewRGBA(rect)
+
+	if c, ok := parseAndroidColor(ai.Background.Drawable); ok {
+		draw.Draw(dst, rect, image.NewUniform(c), image.Point{}, draw.Src)
+	} else if bg, err := decode(ai.Background.Drawable); err == nil {
+		draw.CatmullRom.Scale(dst, rect, bg, bg.Bounds(), draw.Src, nil)
+	}
+	draw.Draw(dst, rect, fg, fg.Bounds().Min, draw.Over)
+
+	return encodePNG(dst)
+}
+
+// parseAndroidColor parses a resolved color value, #aarrggbb or #rrggbb.
+func parseAndroidColor(v string) (color.Color, bool) {
+	if !strings.HasPrefix(v, "#") {
+		return nil, false
+	}
+	n, err := strconv.ParseUint(v[1:], 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	switch len(v) - 1 {
+	case 6:
+		n |= 0xFF000000
+	case 8:
+	default:
+		return nil, false
+	}
+	return color.NRGBA{R: uint8(n >> 16), G: uint8(n >> 8), B: uint8(n), A: uint8(n >> 24)}, true
+}
+
+// 资源目录中的密度限定符
+var apkDensities = map[string]int{
+	"ldpi":    120,
+	"mdpi":    160,
+	"tvdpi":   213,
+	"hdpi":    240,
+	"xhdpi":   320,
+	"xxhdpi":  480,
+	"xxxhdpi": 640,
+}
+
+// apkDensityWeight rates a resource directory such as res/mipmap-xhdpi-v4/ for the wanted
+// dpi, higher is better. Without a dpi the densest directory wins; otherwise the one closest
+// to dpi, the denser one on a tie as downscaling looks better than upscaling.
+func apkDensityWeight(dir string, dpi int) int {
+	density := 160 // 没有限定符时为mdpi
+	for _, q := range strings.Split(strings.TrimSuffix(dir, "/"), "-")[1:] {
+		if d, ok := apkDensities[q]; ok {
+			density = d
+		} else if q == "nodpi" || q == "anydpi" {
+			// 不区分密度的资源（通常是xml矢量图），不参与比较
+			return -1 << 20
+		}
+	}
+
+	if dpi <= 0 {
+		return density
+	}
+	return -abs(density-dpi)<<10 + density
+}
+
+func ipaIconFile(r *zip.Reader) (iosIconFile *zip.File) {
+	for _, f := range r.File {
+		switch {
+		case strings.Contains(f.Name, "AppIcon"):
+			iosIconFile = f
+		}
+	}
+	return
+}
+
+// snapIcon returns the icon found in the squashfs image of a snap, looking at the snap's
+// own gui/icon files and the hicolor theme directories, along with its extension. An SVG
+// is preferred as it renders at any size, otherwise the largest PNG is returned.
+func snapIcon(r io.ReaderAt, size int64) ([]byte, string, error) {
+	sfs, err := openSquashfs(r, size)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var best, svg []byte
+	var bw, bh int
+	err = sfs.walk(func(name string, ino *squashfsInode) error {
+		ext := strings.ToLower(path.Ext(name))
+		if ext != ".png" && ext != ".svg" && ext != ".svgz" {
+			return nil
+		}
+		if !strings.HasPrefix(name, "meta/gui/") && !strings.HasPrefix(name, "snap/gui/") &&
+			name != "meta/icon.png" && name != "meta/icon.svg" && !strings.Contains(name, "icons/hicolor/") {
+			return nil
+		}
+		if ext != ".png" && svg != nil {
+			return nil
+		}
+
+		d, err := sfs.readFile(ino)
+		if err != nil {
+			return err
+		}
+		if ext != ".png" {
+			svg = d
+			return nil
+		}
+		img, err := png.DecodeConfig(bytes.NewReader(d))
+		if err != nil {
+			return nil
+		}
+		if img.Width*img.Height > bw*bh {
+			best, bw, bh = d, img.Width, img.Height
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if svg != nil {
+		return svg, ".svg", nil
+	}
+	if best == nil {
+		return nil, "", ErrNoIcon
+	}
+	return best, ".png", nil
+}
+
+// 文档缩略图解压后的大小上限
+const maxThumbnailSize = 16 << 20
+
+// officeThumbnail returns the thumbnail stored in an OpenDocument (Thumbnails/thumbnail.png)
+// or Office Open XML (docProps/thumbnail.jpeg) file. Metafile thumbnails (wmf, emf) are
+// not decodable and count as no thumbnail.
+func officeThumbnail(r *zip.Reader) ([]byte, error) {
+	for _, f := range r.File {
+		switch strings.ToLower(f.Name) {
+		case "thumbnails/thumbnail.png", "docprops/thumbnail.png",
+			"docprops/thumbnail.jpeg", "docprops/thumbnail.jpg":
+		default:
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		d, err := io.ReadAll(io.LimitReader(rc, maxThumbnailSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(d) > maxThumbnailSize {
+			return nil, errors.New("thumbnail too large in document")
+		}
+		return d, nil
+	}
+	return nil, ErrNoIcon
+}
+
+// preferredThumbnail returns the content thumbnail of a zip based container when
+// Config.PreferThumbnail is set and one exists, nil otherwise so that the caller goes on
+// with the app icon.
+func preferredThumbnail(r readSeekerAt, cfg ...Config) []byte {
+	if len(cfg) == 0 || !cfg[0].PreferThumbnail {
+		return nil
+	}
+	zr, err := newZipReader(r)
+	if err != nil {
+		return nil
+	}
+	d, err := officeThumbnail(zr)
+	if err != nil {
+		debugf(cfg, "fico: no thumbnail in container, using the app icon: %v", err)
+		return nil
+	}
+	return d
+}
+
+// flatpakIcon returns the largest icon of a single-file flatpak bundle. The bundle is a
+// GVariant whose leading metadata dictionary carries the icon-64/icon-128 PNGs verbatim,
+// so we look for the PNGs embedded in the head of the file.
+func flatpakIcon(r io.Reader) ([]byte, error) {
+	// 元数据在文件头部，不需要读取整个文件
+	d, err := io.ReadAll(io.LimitReader(r, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	best := largestPNG(d)
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return best, nil
+}
+
+// largestPNG scans d for embedded PNG streams and returns the one with the most pixels.
+func largestPNG(d []byte) []byte {
+	var best []byte
+	var bw, bh int
+	for {
+		i := bytes.Index(d, []byte("\211PNG\r\n\032\n"))
+		if i < 0 {
+			break
+		}
+		d = d[i:]
+
+		// 按块长度找到IEND，确定PNG的结束位置
+		end := 8
+		for end+12 <= len(d) {
+			l := int(binary.BigEndian.Uint32(d[end:]))
+			if l < 0 || end+12+l > len(d) {
+				break
+			}
+			typ := string(d[end+4 : end+8])
+			end += 12 + l
+			if typ == "IEND" {
+				img, err := png.DecodeConfig(bytes.NewReader(d[:end]))
+				if err == nil && img.Width*img.Height > bw*bh {
+					best, bw, bh = d[:end], img.Width, img.Height
+				}
+				break
+			}
+		}
+		d = d[8:]
+	}
+	return best
+}
+
+// DataURI converts the icon of path like F2ICO does and returns it as a base64 data URI,
+// e.g. for inline favicons. The MIME type follows the bytes actually produced.
+func DataURI(path string, cfg ...Config) (string, error) {
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, cfg...); err != nil {
+		return "", err
+	}
+
+	mime := "image/x-icon"
+	switch d := buf.Bytes(); {
+	case isPNG(d):
+		mime = "image/png"
+	case isJPEG(d):
+		mime = "image/jpeg"
+	case bytes.HasPrefix(d, []byte("icns")):
+		mime = "image/icns"
+	}
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// EstimateSize returns the exact number of bytes F2ICO would write for path,
+// e.g. to set Content-Length before streaming. The output is counted, not buffered.
+func EstimateSize(path string, cfg ...Config) (int64, error) {
+	var cw countWriter
+	if err := F2ICO(&cw, path, cfg...); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// F2ICOTee converts path once and writes the output to every writer of ws, e.g. a cache
+// file and a response. It returns the number of bytes written to each writer; a failing
+// writer stops the conversion like with io.MultiWriter.
+func F2ICOTee(ws []io.Writer, path string, cfg ...Config) (int64, error) {
+	var cw countWriter
+	err := F2ICO(io.MultiWriter(append(ws[:len(ws):len(ws)], &cw)...), path, cfg...)
+	return cw.n, err
+}
+
+// ManifestFrame describes one frame of a converted icon in the JSON written by
+// F2ICOWithManifest.
+type ManifestFrame struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	BitCount int    `json:"bitCount"`
+	Encoding string `json:"encoding"` // png、jpeg或dib
+	Offset   int    `json:"offset"`   // 图像数据在输出中的偏移量
+	Length   int    `json:"length"`
+}
+
+// F2ICOWithManifest is like F2ICO and also writes to manifestW a JSON object describing
+// the output, e.g. for asset pipelines indexing the icons they generate: its format, size
+// and the frames (ManifestFrame) it holds. Nothing is written if the conversion fails.
+func F2ICOWithManifest(w, manifestW io.Writer, path string, cfg ...Config) error {
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, cfg...); err != nil {
+		return err
+	}
+	out := buf.Bytes()
+
+	var m struct {
+		Format string          `json:"format"`
+		Size   int             `json:"size"`
+		Frames []ManifestFrame `json:"frames"`
+	}
+	m.Size = len(out)
+	m.Frames = []ManifestFrame{}
+	frame := func(d []byte, off, w, h, bc int) {
+		enc := "dib"
+		if isPNG(d) {
+			enc = "png"
+		} else if isJPEG(d) {
+			enc = "jpeg"
+		}
+		m.Frames = append(m.Frames, ManifestFrame{Width: w, Height: h, BitCount: bc, Encoding: enc, Offset: off, Length: len(d)})
+	}
+
+	switch {
+	case bytes.HasPrefix(out, []byte("icns")):
+		m.Format = "icns"
+		// 元素依次是4字节类型、4字节长度（含头部）和数据
+		for p := 8; p+8 <= len(out); {
+			l := int(binary.BigEndian.Uint32(out[p+4:]))
+			if l < 8 || p+l > len(out) {
+				break
+			}
+			if d := out[p+8 : p+l]; isPNG(d) {
+				if img, err := png.DecodeConfig(bytes.NewReader(d)); err == nil {
+					frame(d, p+8, img.Width, img.Height, 32)
+				}
+			}
+			p += l
+		}
+	case isPNG(out) || isJPEG(out):
+		img, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			return err
+		}
+		m.Format = format
+		bc := 32
+		if isJPEG(out) {
+			bc = 24
+		}
+		frame(out, 0, img.Width, img.Height, bc)
+	default:
+		id, entries, d, err := parseICO(out)
+		if err != nil {
+			return err
+		}
+		m.Format = "ico"
+		if id.Type == 2 {
+			m.Format = "cur"
+		}
+		for i, f := range entries2Frames(entries, d, 0, 0) {
+			frame(d[i], int(entries[i].Offset), f.Width, f.Height, f.BitCount)
+		}
+	}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(out); err != nil {
+		return err
+	}
+	_, err = manifestW.Write(j)
+	return err
+}
+
+// DominantColor returns the most common color of the icon of path, ignoring (semi)transparent
+// pixels, e.g. to tint a background. Without Format set, the best frame is used as png output.
+func DominantColor(path string, cfg ...Config) (color.Color, error) {
+	img, err := bestFrame(path, cfg...)
+	if err != nil {
+		return nil, err
+	}
+	return dominantColor(img)
+}
+
+// bestFrame converts the icon of path to a single png (or jpeg) frame and decodes it.
+// Without Format set, the best frame is used.
+func bestFrame(path string, cfg ...Config) (image.Image, error) {
+	c := Config{Format: "png"}
+	if len(cfg) > 0 {
+		c = cfg[0]
+		if c.Format != "png" && c.Format != "jpeg" {
+			c.Format = "png"
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, c); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(&buf)
+	return img, err
+}
+
+// BestFrameNRGBA returns the best frame of the icon of path with straight (non-premultiplied)
+// alpha, the convention of PNG and of every image data fico writes.
+//
+// Internally frames are decoded to whatever image/png and the DIB, icns and other decoders
+// produce (*image.NRGBA for PNG with alpha and icns bitmaps, *image.RGBA for DIBs), then
+// scaled and processed as premultiplied *image.RGBA, and converted back to straight alpha
+// when encoded.
+func BestFrameNRGBA(path string, cfg ...Config) (*image.NRGBA, error) {
+	img, err := bestFrame(path, cfg...)
+	if err != nil {
+		return nil, err
+	}
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba, nil
+	}
+	nrgba := image.NewNRGBA(img.Bounds())
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return nrgba, nil
+}
+
+// BestFrameRGBA is like BestFrameNRGBA but returns the frame with premultiplied alpha, as
+// expected by Cairo, Skia and most GUI toolkits.
+func BestFrameRGBA(path string, cfg ...Config) (*image.RGBA, error) {
+	img, err := bestFrame(path, cfg...)
+	if err != nil {
+		return nil, err
+	}
+	return toRGBA(img), nil
+}
+
+// dominantColor buckets pixels by the high 4 bits of each channel and averages the pixels
+// of the most populated bucket, so near-identical shades count as one color.
+func dominantColor(img image.Image) (color.Color, error) {
+	type bucket struct {
+		n, r, g, b int
+	}
+	var buckets [1 << 12]bucket
+	best := -1
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			// 半透明的边缘和阴影不算
+			if c.A < 0x80 {
+				continue
+			}
+			i := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			b := &buckets[i]
+			b.n++
+			b.r += int(c.R)
+			b.g += int(c.G)
+			b.b += int(c.B)
+			if best < 0 || b.n > buckets[best].n {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return nil, ErrNoIcon
+	}
+
+	b := buckets[best]
+	return color.NRGBA{R: uint8(b.r / b.n), G: uint8(b.g / b.n), B: uint8(b.b / b.n), A: 0xFF}, nil
+}
+
+// PerceptualHash returns the difference hash (dHash) of the icon of path, so that icons
+// looking alike have hashes a few bits apart, e.g. bits.OnesCount64(a^b) <= 10. Like
+// DominantColor, the best frame is used unless Config says otherwise.
+func PerceptualHash(path string, cfg ...Config) (uint64, error) {
+	img, err := bestFrame(path, cfg...)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+// dHash shrinks img to 9x8 gray pixels and sets one bit per pair of horizontal neighbors
+// whose left pixel is brighter.
+func dHash(img image.Image) uint64 {
+	// 透明部分按白底处理，只比较图形本身
+	small := image.NewRGBA(image.Rect(0, 0, 9, 8))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var gray [8][9]uint8
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			gray[y][x] = color.GrayModel.Convert(small.RGBAAt(x, y)).(color.Gray).Y
+		}
+	}
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// WriteFaviconSet writes one square PNG per size into dir, named favicon-<size>.png,
+// scaled from the image read from r. It returns the file names in the order of sizes.
+func WriteFaviconSet(dir string, r io.Reader, sizes []int) ([]string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, size := range sizes {
+		if size <= 0 {
+			return names, errors.New("invalid favicon size")
+		}
+
+		d, err := encodePNG(Scale(img, size, size))
+		if err != nil {
+			return names, err
+		}
+		name := faviconName(size)
+		if err = os.WriteFile(filepath.Join(dir, name), d, 0666); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// PWASizes are the icon sizes web app manifests commonly ask for.
+var PWASizes = []int{72, 96, 128, 144, 152, 192, 384, 512}
+
+// PWAIcons writes one PNG per size of PWASizes into dir, named like WriteFaviconSet does,
+// and returns the file names. WriteWebManifest(dir, PWASizes) writes the matching manifest.
+func PWAIcons(dir string, r io.Reader) ([]string, error) {
+	return WriteFaviconSet(dir, r, PWASizes)
+}
+
+// WriteWebManifest writes a site.webmanifest into dir whose icons array lists the
+// PNGs written by WriteFaviconSet for the same sizes.
+func WriteWebManifest(dir string, sizes []int) error {
+	type manifestIcon struct {
+		Src   string `json:"src"`
+		Sizes string `json:"sizes"`
+		Type  string `json:"type"`
+	}
+
+	var m struct {
+		Icons []manifestIcon `json:"icons"`
+	}
+	for _, size := range sizes {
+		m.Icons = append(m.Icons, manifestIcon{
+			Src:   faviconName(size),
+			Sizes: strconv.Itoa(size) + "x" + strconv.Itoa(size),
+			Type:  "image/png",
+		})
+	}
+
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "site.webmanifest"), d, 0666)
+}
+
+func faviconName(size int) string {
+	return "favicon-" + strconv.Itoa(size) + ".png"
+}
+
+// 索引图的默认图标边长、每行的格子数、格子的间距和最小宽度（放得下12个字符的文件名）
+const (
+	sheetTileSize   = 64
+	sheetColumns    = 8
+	sheetPadding    = 8
+	sheetLabelWidth = 84
+)
+
+// ContactSheet writes a PNG index of the files in dir: the best icon of each file, scaled
+// to a tile of cfg Width (64 by default), in a grid with the file names under them, sorted
+// by name. Files that cannot be converted get a crossed-out placeholder tile.
+func ContactSheet(w io.Writer, dir string, cfg ...Config) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return ErrNoIcon
+	}
+
+	c := Config{}
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	tile := c.Width
+	if tile <= 0 {
+		tile = sheetTileSize
+	}
+	c.Format, c.Width, c.Height = "png", tile, tile
+
+	face := basicfont.Face7x13
+	lineH := face.Metrics().Height.Ceil()
+	cellW, cellH := max(tile, sheetLabelWidth)+sheetPadding, tile+lineH+sheetPadding
+	cols := min(len(names), sheetColumns)
+	rows := (len(names) + cols - 1) / cols
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cellW+sheetPadding, rows*cellH+sheetPadding))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+
+	placeholder := color.RGBA{0xE0, 0xE0, 0xE0, 0xFF}
+	cross := color.RGBA{0xC0, 0x40, 0x40, 0xFF}
+	for i, name := range names {
+		x := sheetPadding + i%cols*cellW + (cellW-sheetPadding-tile)/2
+		y := sheetPadding + i/cols*cellH
+		r := image.Rect(x, y, x+tile, y+tile)
+
+		img, err := bestFrame(filepath.Join(dir, name), c)
+		if err == nil {
+			draw.Draw(sheet, r, Scale(img, tile, tile), image.Point{}, draw.Over)
+		} else {
+			// 转换失败的文件画一个带叉的灰色格子
+			debugf(cfg, "fico: contact sheet placeholder for %q: %v", name, err)
+			draw.Draw(sheet, r, image.NewUniform(placeholder), image.Point{}, draw.Src)
+			for j := 0; j < tile; j++ {
+				sheet.Set(x+j, y+j, cross)
+				sheet.Set(x+tile-1-j, y+j, cross)
+			}
+		}
+
+		// 文件名太长时截断，居中写在图标下面
+		d := &font.Drawer{Dst: sheet, Src: image.Black, Face: face}
+		label, maxW := name, fixed.I(cellW-sheetPadding)
+		if d.MeasureString(label) > maxW {
+			r := []rune(name)
+			for len(r) > 0 && d.MeasureString(string(r)+"..") > maxW {
+				r = r[:len(r)-1]
+			}
+			label = string(r) + ".."
+		}
+		lx := sheetPadding + i%cols*cellW + (cellW-sheetPadding-d.MeasureString(label).Ceil())/2
+		d.Dot = fixed.P(lx, y+tile+face.Metrics().Ascent.Ceil())
+		d.DrawString(label)
+	}
+
+	d, err := encodePNG(sheet)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(d)
+	return err
+}
+
+// SuggestName returns a file name for the output of F2ICO on path with cfg, made of the base
+// name, the edge of the largest output frame and the format, e.g. "app-256.png". The file is
+// converted to know the actual output size.
+func SuggestName(path string, cfg ...Config) (string, error) {
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, cfg...); err != nil {
+		return "", err
+	}
+
+	format := "ico"
+	if len(cfg) > 0 && cfg[0].Format != "" {
+		format = cfg[0].Format
+	}
+
+	size := 0
+	switch format {
+	case "png", "jpeg":
+		img, _, err := image.DecodeConfig(&buf)
+		if err != nil {
+			return "", err
+		}
+		size = max(img.Width, img.Height)
+	default:
+		var entries []ICONDIRENTRY
+		var d [][]byte
+		var err error
+		if format == "icns" {
+			entries, d, _, err = parseICNS(&buf)
+		} else {
+			_, entries, d, err = parseICO(buf.Bytes())
+		}
+		if err != nil {
+			return "", err
+		}
+		for i, e := range entries {
+			w, h := entrySize(e, d[i])
+			// 目录中的宽高只有一个字节，PNG以实际数据为准
+			if img, err := png.DecodeConfig(bytes.NewReader(d[i])); err == nil {
+				w, h = img.Width, img.Height
+			}
+			size = max(size, w, h)
+		}
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return base + "-" + strconv.Itoa(size) + "." + format, nil
+}
+
+// HasIcon reports whether the file really carries an icon, without converting it.
+// Unlike PE2ICO it never falls back to the default icons, so an executable
+// without icon resources reports false.
+func HasIcon(path string) (bool, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".exe", ".dll", ".mui", ".mun":
+		ok, err := peHasIcon(path)
+		if ok || err != nil {
+			return ok, err
+		}
+		// 图标被重定向到.mun、.mui文件中时也算有图标
+		if !peRedirected(path) {
+			return false, nil
+		}
+		for _, p := range peCompanions(path) {
+			if ok, _ = peHasIcon(p); ok {
+				return true, nil
+			}
+		}
+		return false, nil
 
-	switch ext {
-	case ".ico", ".icns", ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".tiff":
+	case ".ico", ".cur", ".ani", ".icns", ".gif":
+		frames, err := Parse(path)
+		if err != nil {
+			return false, err
+		}
+		return len(frames) > 0, nil
+
+	case ".bmp", ".jpg", ".jpeg", ".png", ".tiff", ".tga":
 		f, err := os.Open(path)
 		if err != nil {
-			return err
+			return false, err
 		}
 		defer f.Close()
 
-		switch ext {
-		case ".ico": // FIXME：如果只需要其中的一种尺寸
-			_, err = io.Copy(w, f)
-			return err
-		case ".icns":
-			return ICNS2ICO(w, f, cfg...)
-		case ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".tiff":
-			return IMG2ICO(w, f, cfg...)
-		}
+		_, _, err = image.DecodeConfig(f)
+		return err == nil, nil
 
 	case ".apk":
-		appInfo, err := apkparser.ParseApk(path)
+		zr, err := apkparser.OpenZip(path)
 		if err != nil {
-			return err
+			return false, err
 		}
+		defer zr.Close()
 
-		return img2ICO(w, appInfo.Icon, cfg...)
+		_, err = apkIconFile(zr)
+		if err == ErrNoIcon {
+			return false, nil
+		}
+		return err == nil, err
 
 	case ".ipa":
 		r, err := zip.OpenReader(path)
 		if err != nil {
-			return err
+			return false, err
 		}
 		defer r.Close()
 
-		var iosIconFile *zip.File
-		for _, f := range r.File {
-			switch {
-			case strings.Contains(f.Name, "AppIcon"):
-				iosIconFile = f
-			}
-		}
+		return ipaIconFile(&r.Reader) != nil, nil
+	}
 
-		rc, err := iosIconFile.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
+	// 其他容器格式只能尝试提取
+	err := F2ICO(io.Discard, path, Config{Format: "png"})
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNoIcon:
+		return false, nil
+	}
+	return false, err
+}
 
-		var buf bytes.Buffer
-		iospng.PngRevertOptimization(rc, &buf)
+func peHasIcon(path string) (bool, error) {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer peFile.Close()
 
-		return IMG2ICO(w, bytes.NewReader(buf.Bytes()), cfg...)
+	resTable, addr, err := resourceData(peFile)
+	if err != nil || resTable == nil {
+		return false, err
 	}
+	// 图标组和图标数据都要有，否则PE2ICO也会退回默认图标
+	var hasGroup, hasIcon bool
+	for _, r := range parseDir(resTable, 0, "", addr, peFile.Sections, false) {
+		hasGroup = hasGroup || strings.HasPrefix(r.Name, RT_GROUP_ICON)
+		hasIcon = hasIcon || strings.HasPrefix(r.Name, RT_ICON)
+	}
+	return hasGroup && hasIcon, nil
+}
 
-	return errors.New("conversion failed")
+// PEIconLanguages lists the languages (LCIDs, 0 for neutral) each icon group of a PE file
+// is available in, by group ID in ascending order, to choose Config.Language from. Groups
+// with a string name (e.g. MAINICON) have no ID and are left out.
+func PEIconLanguages(path string) (map[uint16][]uint16, error) {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+
+	resTable, addr, err := resourceData(peFile)
+	if err != nil {
+		return nil, err
+	}
+	langs := make(map[uint16][]uint16)
+	if resTable == nil {
+		return langs, nil
+	}
+	for _, r := range parseDir(resTable, 0, "", addr, peFile.Sections, false) {
+		n := strings.Split(r.Name, "/")
+		if len(n) < 3 || !strings.HasPrefix(r.Name, RT_GROUP_ICON) {
+			continue
+		}
+		id, err := strconv.ParseUint(n[1], 10, 16)
+		if err != nil {
+			continue
+		}
+		l, err := strconv.ParseUint(n[2], 10, 16)
+		if err != nil {
+			continue
+		}
+		if !slices.Contains(langs[uint16(id)], uint16(l)) {
+			langs[uint16(id)] = append(langs[uint16(id)], uint16(l))
+		}
+	}
+	for _, l := range langs {
+		slices.Sort(l)
+	}
+	return langs, nil
 }
 
 type Info struct {
@@ -113,7 +1678,7 @@ func GetInfo(path string) (info Info, err error) {
 
 	var f *ini.File
 	switch ext {
-	case ".inf", ".ini", ".desktop":
+	case ".inf", ".ini", ".desktop", ".theme", ".url":
 		f, err = ini.Load(path)
 		if err != nil {
 			return info, err
@@ -125,8 +1690,16 @@ func GetInfo(path string) (info Info, err error) {
 		*.app/Contents/Resources/AppIcon.icns
 		 */
 		info.IconFile = filepath.Join(path, "Contents/Resources/AppIcon.icns")
+		// 用Asset Catalog编译的程序只有Assets.car
+		if _, err := os.Stat(info.IconFile); err != nil {
+			car := filepath.Join(path, "Contents/Resources/Assets.car")
+			if _, err := os.Stat(car); err == nil {
+				info.IconFile = car
+			}
+		}
 		return
-	case ".exe", ".dll", ".mui", ".mun", ".ico", ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".tiff", ".icns", ".dmg", ".ipa", ".apk":
+	case ".exe", ".dll", ".mui", ".mun", ".ico", ".bmp", ".gif", ".jpg", ".jpeg", ".png", ".tiff", ".tga", ".icns", ".dmg", ".ipa", ".apk", ".snap", ".flatpak", ".themepack", ".iso", ".car", ".chm", ".asar", ".pkg", ".rcc", ".wim", ".svg", ".svgz", ".vsix", ".nupkg", ".msix", ".appx",
+		".odt", ".ods", ".odp", ".odg", ".docx", ".xlsx", ".pptx", ".docm", ".xlsm", ".pptm":
 		// 尝试把iconfile设置为自己
 		info.IconFile = path
 		return
@@ -171,7 +1744,7 @@ func GetInfo(path string) (info Info, err error) {
 			return info, err
 		}
 
-		info.IconFile = section.Key("IconFile").MustString(section.Key("DefaultIcon").String())
+		info.IconFile, info.IconIndex = autorunIcon(section)
 	case ".ini":
 		/*
 			在 Windows 操作系统中，desktop.ini 文件用于自定义文件夹的外观和行为。您可以在文件夹中创建 desktop.ini 文件，并在其中指定如何显示该文件夹的图标。
@@ -199,16 +1772,7 @@ func GetInfo(path string) (info Info, err error) {
 				info.IconIndex = &idx
 			}
 		} else {
-			iconResource := section.Key("IconResource").String()
-			s := strings.Split(iconResource, ",")
-			if len(s) >= 1 {
-				info.IconFile = s[0]
-				if len(s) >= 2 {
-					if idx, err := strconv.Atoi(s[1]); err == nil {
-						info.IconIndex = &idx
-					}
-				}
-			}
+			info.IconFile, info.IconIndex = parseIconResource(section.Key("IconResource").String())
 		}
 	case ".desktop":
 		/*
@@ -233,24 +1797,313 @@ func GetInfo(path string) (info Info, err error) {
 
 		info.IconFile = section.Key("Icon").String()
 		info.FilePath = section.Key("Exec").String()
+	case ".theme":
+		/*
+			Windows主题文件中，桌面图标定义在对应CLSID的DefaultIcon节中：
+
+			[CLSID\{20D04FE0-3AEA-1069-A2D8-08002B30309D}\DefaultIcon]
+			DefaultValue=%SystemRoot%\System32\imageres.dll,-109
+		*/
+		info.IconFile, info.IconIndex = themeIcon(f)
+	case ".url":
+		/*
+			Internet快捷方式是ini格式的，图标和desktop.ini一样用IconFile和IconIndex指定：
+
+			[InternetShortcut]
+			URL=https://example.com/
+			IconFile=C:\Windows\System32\shell32.dll
+			IconIndex=13
+		*/
+		section, err := f.GetSection("InternetShortcut")
+		if err != nil {
+			return info, err
+		}
+
+		info.IconFile = section.Key("IconFile").String()
+		if idx, err := section.Key("IconIndex").Int(); err == nil && info.IconFile != "" {
+			info.IconIndex = &idx
+		}
+		info.FilePath = section.Key("URL").String()
+	}
+	return
+}
+
+// FolderIcon converts the custom icon of a folder, the one its desktop.ini points to with
+// IconFile/IconIndex or IconResource. Relative paths are resolved against the folder and
+// %NAME% environment variables are expanded. ErrNoIcon is returned for a plain folder.
+func FolderIcon(w io.Writer, folderPath string, cfg ...Config) error {
+	entries, err := os.ReadDir(folderPath)
+	if err != nil {
+		return err
+	}
+	// Windows不区分大小写，常见Desktop.ini、DESKTOP.INI等写法
+	var iniPath string
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(e.Name(), "desktop.ini") {
+			iniPath = filepath.Join(folderPath, e.Name())
+			break
+		}
+	}
+	if iniPath == "" {
+		return ErrNoIcon
+	}
+
+	info, err := GetInfo(iniPath)
+	if err != nil {
+		return err
+	}
+	if info.IconFile == "" {
+		return ErrNoIcon
+	}
+	file := filepath.FromSlash(strings.ReplaceAll(expandEnv(info.IconFile), `\`, "/"))
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(folderPath, file)
+	}
+	debugf(cfg, "fico: folder icon %q index %v", file, info.IconIndex)
+
+	// desktop.ini中指定的序号在没有另外指定时生效
+	c := Config{}
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	if c.Index == nil {
+		c.Index = info.IconIndex
+	}
+	return F2ICO(w, file, c)
+}
+
+// autorunIcon returns the icon referenced by the [AutoRun] section of an autorun.inf,
+// e.g. "Icon=setup.exe,0".
+func autorunIcon(section *ini.Section) (string, *int) {
+	for _, k := range []string{"IconFile", "Icon", "DefaultIcon"} {
+		if v := section.Key(k).String(); v != "" {
+			return parseIconResource(v)
+		}
+	}
+	return "", nil
+}
+
+// expandEnv replaces %NAME% with the environment variable NAME, leaving unknown ones as is.
+func expandEnv(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '%')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i+1:], '%')
+		if j < 0 {
+			break
+		}
+		if v, ok := os.LookupEnv(s[i+1 : i+1+j]); ok {
+			b.WriteString(s[:i])
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[:i+j+2])
+		}
+		s = s[i+j+2:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// isoICO converts the icon an ISO image shows for itself, which is the one its root
+// autorun.inf points to.
+func isoICO(w io.Writer, r io.ReaderAt, cfg ...Config) error {
+	iso, err := openISO(r)
+	if err != nil {
+		return err
+	}
+
+	inf, err := iso.open("autorun.inf")
+	if err != nil {
+		return ErrNoIcon
+	}
+	d, err := io.ReadAll(io.LimitReader(inf, 1<<20))
+	if err != nil {
+		return err
+	}
+	// 节和键名不区分大小写，常见"[autorun]"、"Icon="等写法
+	f, err := ini.LoadSources(ini.LoadOptions{Insensitive: true}, d)
+	if err != nil {
+		return err
+	}
+	section, err := f.GetSection("AutoRun")
+	if err != nil {
+		return ErrNoIcon
+	}
+	file, idx := autorunIcon(section)
+	if file == "" {
+		return ErrNoIcon
+	}
+
+	icon, err := iso.open(file)
+	if err != nil {
+		return ErrNoIcon
+	}
+
+	// inf中指定的序号在没有另外指定时生效
+	c := Config{}
+	if len(cfg) > 0 {
+		c = cfg[0]
+	}
+	if c.Index == nil {
+		c.Index = idx
+	}
+	return f2ICO(w, strings.ToLower(path.Ext(strings.ReplaceAll(file, `\`, "/"))), icon, c)
+}
+
+// 主题中定义桌面图标的CLSID：计算机、用户文件、网络、回收站
+var themeIconCLSIDs = []string{
+	"{20D04FE0-3AEA-1069-A2D8-08002B30309D}",
+	"{59031A47-3F72-44A7-89C5-5595FE6B30EE}",
+	"{F02C1A0D-BE21-4350-88B0-7367FC96EF3C}",
+	"{645FF040-5081-101B-9F08-00AA002F954E}",
+}
+
+// themeIcon returns the first desktop icon referenced by a .theme file.
+func themeIcon(f *ini.File) (string, *int) {
+	for _, clsid := range themeIconCLSIDs {
+		section, err := f.GetSection(`CLSID\` + clsid + `\DefaultIcon`)
+		if err != nil {
+			continue
+		}
+		for _, k := range []string{"DefaultValue", "full"} {
+			if v := section.Key(k).String(); v != "" {
+				return parseIconResource(v)
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseIconResource splits an icon reference like "imageres.dll,-109" into file and index.
+func parseIconResource(v string) (file string, idx *int) {
+	s := strings.Split(v, ",")
+	file = strings.TrimSpace(s[0])
+	if len(s) >= 2 {
+		if i, err := strconv.Atoi(strings.TrimSpace(s[1])); err == nil {
+			idx = &i
+		}
 	}
 	return
 }
 
+// themepackIcon extracts an icon bundled in a .themepack (a CAB archive). The icon
+// referenced by the contained .theme is preferred, otherwise the first .ico is used.
+func themepackIcon(r io.ReaderAt) ([]byte, error) {
+	c, err := openCAB(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cf := range c.files {
+		if !strings.EqualFold(filepath.Ext(cf.Name), ".theme") {
+			continue
+		}
+		d, err := c.readFile(cf.Name)
+		if err != nil {
+			return nil, err
+		}
+		t, err := ini.Load(d)
+		if err != nil {
+			continue
+		}
+		file, _ := themeIcon(t)
+		// 引用的可能是系统文件，只取包内的同名文件
+		file = file[strings.LastIndexAny(file, `\/`)+1:]
+		if file != "" && strings.EqualFold(filepath.Ext(file), ".ico") {
+			for _, icf := range c.files {
+				if strings.EqualFold(filepath.Base(icf.Name), file) {
+					return c.readFile(icf.Name)
+				}
+			}
+		}
+	}
+
+	for _, cf := range c.files {
+		if strings.EqualFold(filepath.Ext(cf.Name), ".ico") {
+			return c.readFile(cf.Name)
+		}
+	}
+	return nil, ErrNoIcon
+}
+
 func IMG2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
+	cfg = physicalSize(cfg)
+	var icc []byte
+	if len(cfg) > 0 && cfg[0].KeepICC {
+		d, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		icc = pngChunk(d, "iCCP")
+		r = bytes.NewReader(d)
+	}
+
 	img, _, err := image.Decode(r)
 	if err != nil {
 		return err
 	}
+	// 先去掉颜色键再缩放，否则边缘会混入颜色键
+	if len(cfg) > 0 && cfg[0].TransparentColor != nil {
+		img = colorKey(img, cfg[0].TransparentColor)
+	}
+
+	zoomed, err := zoomImg(img, cfg...)
+	if err != nil {
+		return err
+	}
+	return img2ICO(w, zoomed, icc, cfg...)
+}
 
-	return img2ICO(w, zoomImg(img, cfg...), cfg...)
+// colorKey makes the opaque pixels of img that are exactly the color key fully transparent.
+func colorKey(img image.Image, key color.Color) *image.RGBA {
+	k := color.NRGBAModel.Convert(key).(color.NRGBA)
+	rgba := toRGBA(img)
+	for i := 0; i+4 <= len(rgba.Pix); i += 4 {
+		p := rgba.Pix[i : i+4 : i+4]
+		if p[3] == 0xFF && p[0] == k.R && p[1] == k.G && p[2] == k.B {
+			p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+		}
+	}
+	return rgba
 }
 
-func img2ICO(w io.Writer, img image.Image, cfg ...Config) (err error) {
-	var buf bytes.Buffer
-	png.Encode(&buf, img)
+// img2ICO encodes img in the requested format, adding the icc chunk to PNG data if not nil.
+func img2ICO(w io.Writer, img image.Image, icc []byte, cfg ...Config) (err error) {
+	img = transform(img, cfg...)
+
+	if len(cfg) > 0 && cfg[0].Format == "jpeg" {
+		return encodeJPEG(w, img, cfg[0])
+	}
+
+	// 编码结果写出后就不再使用，缓冲直接放回池中
+	buf := pngBufPool.Get().(*bytes.Buffer)
+	defer pngBufPool.Put(buf)
+	buf.Reset()
+	if err = pngEncoder.Encode(buf, img); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if icc != nil {
+		data = addPNGChunk(data, icc)
+	}
+
+	if len(cfg) > 0 && cfg[0].Format == "icns" {
+		return writeICNS(w, []ICONDIRENTRY{{IconCommon: IconCommon{
+			Width:  dirSize(img.Bounds().Dx()),
+			Height: dirSize(img.Bounds().Dy()),
+		}}}, [][]byte{data})
+	}
 
 	if len(cfg) <= 0 || cfg[0].Format != "png" {
+		if len(cfg) > 0 && cfg[0].LegacyBMP {
+			if data, err = encodeFrame(img, cfg...); err != nil {
+				return err
+			}
+		}
+
 		err = binary.Write(w, binary.LittleEndian, &ICONDIR{Type: 1, Count: 1})
 		if err != nil {
 			return err
@@ -258,11 +2111,11 @@ func img2ICO(w io.Writer, img image.Image, cfg ...Config) (err error) {
 
 		err = binary.Write(w, binary.LittleEndian, &ICONDIRENTRY{
 			IconCommon: IconCommon{
-				Width:      uint8(img.Bounds().Dx()),
-				Height:     uint8(img.Bounds().Dy()),
+				Width:      dirSize(img.Bounds().Dx()),
+				Height:     dirSize(img.Bounds().Dy()),
 				Planes:     1,
 				BitCount:   32,
-				BytesInRes: uint32(buf.Len()),
+				BytesInRes: uint32(len(data)),
 			},
 			Offset: 0x16,
 		})
@@ -271,10 +2124,162 @@ func img2ICO(w io.Writer, img image.Image, cfg ...Config) (err error) {
 		}
 	}
 
-	_, err = w.Write(buf.Bytes())
+	_, err = w.Write(data)
 	return err
 }
 
+// ICOWriter builds an icon from frames added one at a time. The frames are kept in memory
+// as PNG and written on Close, through the same path as the other conversions, so cfg
+// applies as usual (size selection, format, etc.).
+type ICOWriter struct {
+	w       io.Writer
+	cfg     []Config
+	entries []ICONDIRENTRY
+	d       [][]byte
+	closed  bool
+}
+
+// NewICOWriter returns an ICOWriter that writes to w on Close.
+func NewICOWriter(w io.Writer, cfg ...Config) *ICOWriter {
+	return &ICOWriter{w: w, cfg: physicalSize(cfg)}
+}
+
+// AddFrame appends img as a 32-bit PNG frame.
+func (iw *ICOWriter) AddFrame(img image.Image) error {
+	if iw.closed {
+		return errors.New("ico writer closed")
+	}
+
+	d, err := encodeFrame(img, iw.cfg...)
+	if err != nil {
+		return err
+	}
+
+	iw.entries = append(iw.entries, ICONDIRENTRY{IconCommon: IconCommon{
+		Width:      dirSize(img.Bounds().Dx()),
+		Height:     dirSize(img.Bounds().Dy()),
+		Planes:     1,
+		BitCount:   32,
+		BytesInRes: uint32(len(d)),
+	}})
+	iw.d = append(iw.d, d)
+	return nil
+}
+
+// Close writes the icon with all added frames. It does not close the underlying writer.
+func (iw *ICOWriter) Close() error {
+	if iw.closed {
+		return errors.New("ico writer closed")
+	}
+	iw.closed = true
+
+	if len(iw.entries) <= 0 {
+		return ErrNoIcon
+	}
+	id := ICONDIR{Type: 1, Count: uint16(len(iw.entries))}
+	return writeICO(iw.w, id, relocate(iw.entries, iw.d), iw.d, iw.cfg...)
+}
+
+// SpriteExtract crops rects out of the sprite sheet read from r and writes them as the
+// frames of one icon, in the given order.
+func SpriteExtract(w io.Writer, r io.Reader, rects []image.Rectangle, cfg ...Config) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	iw := NewICOWriter(w, cfg...)
+	for _, rect := range rects {
+		// 坐标超出图片范围的部分裁掉，完全在范围外的视为错误
+		rect = rect.Intersect(src.Bounds())
+		if rect.Empty() {
+			return errors.New("sprite rectangle outside of the image")
+		}
+		frame := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		draw.Draw(frame, frame.Bounds(), src, rect.Min, draw.Src)
+		if err = iw.AddFrame(frame); err != nil {
+			return err
+		}
+	}
+	return iw.Close()
+}
+
+// WindowsShell writes an icon with exactly the 48x48 (large icons) and 256x256 (extra large)
+// frames the Windows shell uses most, scaled from the image read from r.
+func WindowsShell(w io.Writer, r io.Reader) error {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	iw := NewICOWriter(w)
+	for _, size := range []int{48, 256} {
+		if err = iw.AddFrame(Scale(img, size, size)); err != nil {
+			return err
+		}
+	}
+	return iw.Close()
+}
+
+// ICO2ICO re-emits an ICO file, honoring the requested size and format
+// (e.g. the best frame as PNG) instead of copying it verbatim.
+func ICO2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
+	cfg = physicalSize(cfg)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	id, entries, d, err := parseICO(data)
+	if err != nil {
+		return err
+	}
+
+	// 重新计算偏移量，去掉原文件中的空隙
+	offset := binary.Size(id) + len(entries)*binary.Size(ICONDIRENTRY{})
+	for i := range entries {
+		entries[i].Offset = uint32(offset)
+		offset += len(d[i])
+	}
+
+	return writeICO(w, id, entries, d, cfg...)
+}
+
+// SplitICO splits an ICO (or CUR) file into standalone single-entry files keyed by size,
+// copying each image verbatim: PNG stays PNG and DIB stays DIB. When several entries share
+// a size, the one with the most bits per pixel is kept.
+func SplitICO(r io.Reader) (map[image.Point][]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	id, entries, d, err := parseICO(data)
+	if err != nil {
+		return nil, err
+	}
+
+	best := make(map[image.Point]int)
+	for i, e := range entries {
+		ws, hs := entrySize(e, d[i])
+		p := image.Pt(ws, hs)
+		if j, ok := best[p]; !ok || e.BitCount > entries[j].BitCount {
+			best[p] = i
+		}
+	}
+
+	ret := make(map[image.Point][]byte, len(best))
+	for p, i := range best {
+		var buf bytes.Buffer
+		dir := ICONDIR{Type: id.Type, Count: 1}
+		if err = WriteRaw(&buf, dir, relocate([]ICONDIRENTRY{entries[i]}, d[i:i+1]), d[i:i+1]); err != nil {
+			return nil, err
+		}
+		ret[p] = buf.Bytes()
+	}
+	return ret, nil
+}
+
 // https://github.com/nyteshade/ByteRunLengthCoder/blob/main/ByteRunLengthCoder.swift
 func icnsBRLDecode(d []byte) (ret []byte) {
 	for i := 0; i < len(d); {
@@ -300,34 +2305,228 @@ func icnsBRLDecode(d []byte) (ret []byte) {
 			i += 2
 		}
 	}
-	return
+	return
+}
+
+func isPNG(d []byte) bool {
+	return len(d) > 8 && string(d[:8]) == "\211PNG\r\n\032\n"
+}
+
+// pngChunk returns the first chunk of type typ in PNG data d, including its length and CRC.
+func pngChunk(d []byte, typ string) []byte {
+	if !isPNG(d) {
+		return nil
+	}
+
+	for i := 8; i+8 <= len(d); {
+		n := int(binary.BigEndian.Uint32(d[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(d) || end < i {
+			return nil
+		}
+		if string(d[i+4:i+8]) == typ {
+			return d[i:end]
+		}
+		i = end
+	}
+	return nil
+}
+
+// addPNGChunk inserts chunk right after the IHDR chunk of PNG data d, where iCCP must be.
+func addPNGChunk(d, chunk []byte) []byte {
+	// 签名8字节，IHDR数据13字节
+	const ihdrEnd = 8 + 12 + 13
+	if !isPNG(d) || len(d) < ihdrEnd {
+		return d
+	}
+
+	out := make([]byte, 0, len(d)+len(chunk))
+	out = append(out, d[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, d[ihdrEnd:]...)
+}
+
+// stripPNGMeta drops the chunks of a PNG that carry timestamps or free text
+// (tIME, tEXt, zTXt, iTXt), leaving any other data untouched.
+func stripPNGMeta(d []byte) []byte {
+	if !isPNG(d) {
+		return d
+	}
+
+	out := append([]byte(nil), d[:8]...)
+	for i := 8; i+8 <= len(d); {
+		n := int(binary.BigEndian.Uint32(d[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(d) || end < i {
+			// 数据损坏时原样返回
+			return d
+		}
+		switch string(d[i+4 : i+8]) {
+		case "tIME", "tEXt", "zTXt", "iTXt":
+		default:
+			out = append(out, d[i:end]...)
+		}
+		i = end
+	}
+	return out
 }
 
-func isPNG(d []byte) bool {
-	return len(d) > 8 && string(d[:8]) == "\211PNG\r\n\032\n"
+// icns中非PNG图标的边长，由OSType决定
+var icnsSizes = map[string]int{
+	// 24-bit RGB
+	"is32": 16,
+	"il32": 32,
+	"ih32": 48,
+	"it32": 128,
+	"icp4": 16,
+	"icp5": 32,
+	"icp6": 64,
+	// ARGB
+	"ic04": 16,
+	"ic05": 32,
+	"icsb": 18,
+}
+
+// icnsRGBDecode returns the three colour planes of a 24-bit icns image.
+//
+// The encoding is told apart by the data itself rather than by the icnV chunk, which only
+// records the version of Icon Composer that wrote the file and says nothing about it:
+// data of exactly 3*size*size bytes is stored raw, everything else is RLE compressed, and
+// it32 data normally starts with a 4-byte header (four zero-bytes on every icns shipped
+// with macOS 10.15 and 11, usage unknown) that is only dropped when the rest decodes to
+// the right length.
+func icnsRGBDecode(typ string, d []byte) []byte {
+	size := icnsSizes[typ]
+	want := 3 * size * size
+	if len(d) == want {
+		return d
+	}
+
+	var rgb []byte
+	if typ == "it32" && len(d) >= 4 {
+		rgb = icnsBRLDecode(d[4:])
+	}
+	if len(rgb) != want {
+		rgb = icnsBRLDecode(d)
+	}
+
+	// 损坏的数据补齐或截断，保证三个通道的偏移正确
+	if len(rgb) < want {
+		rgb = append(rgb, make([]byte, want-len(rgb))...)
+	}
+	return rgb[:want]
+}
+
+// 少数ico文件中的图标用JPEG存储
+func isJPEG(d []byte) bool {
+	return len(d) > 3 && d[0] == 0xFF && d[1] == 0xD8 && d[2] == 0xFF
 }
 
 func isARGB(d []byte) bool {
 	return len(d) > 4 && string(d[:4]) == "ARGB"
 }
 
+// checkICNS validates the container and element lengths of icns data before handing it to
+// icns.Parse, which trusts them for allocation. Data after the declared length is dropped.
+func checkICNS(d []byte) ([]byte, error) {
+	if len(d) < 8 || string(d[:4]) != "icns" {
+		return nil, errors.New("invalid icns header")
+	}
+	n := binary.BigEndian.Uint32(d[4:])
+	if n < 8 {
+		return nil, errors.New("invalid icns length")
+	}
+	if uint64(n) > uint64(len(d)) {
+		return nil, errors.New("icns file truncated")
+	}
+	// 结尾多余的数据（如填充）忽略掉
+	d = d[:n]
+
+	for p := 8; p < len(d); {
+		if len(d)-p < 8 {
+			return nil, errors.New("invalid icns element")
+		}
+		l := binary.BigEndian.Uint32(d[p+4:])
+		if l < 8 || uint64(l) > uint64(len(d)-p) {
+			return nil, errors.New("invalid icns element")
+		}
+		p += int(l)
+	}
+	return d, nil
+}
+
+// ICNS2ICO converts an icns file to ico, one frame per image representation.
+//
+// Unlike the other formats, a Config.Index of 0 or more (&0 included) selects a single
+// representation, counted after the unused OSTypes and masks are filtered out, and yields
+// a single-frame ico; an Index past the last one is an error. nil converts them all.
 // https://en.wikipedia.org/wiki/Apple_Icon_Image_format
 func ICNS2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
-	iconSet, err := icns.Parse(r)
+	cfg = physicalSize(cfg)
+	entries, d, primary, err := parseICNS(r, cfg...)
 	if err != nil {
 		return err
 	}
 
-	// 掩码映射
+	// 如果指定了序号，只输出对应的单张图标
+	if len(cfg) > 0 && cfg[0].Index != nil && *cfg[0].Index >= 0 {
+		i := *cfg[0].Index
+		if i >= len(entries) {
+			return errors.New("icns index " + strconv.Itoa(i) + " out of range")
+		}
+		entry := entries[i]
+		entry.Offset = uint32(6 + 16)
+		return writeICO(w, ICONDIR{Type: 1, Count: 1}, []ICONDIRENTRY{entry}, [][]byte{d[i]}, cfg...)
+	}
+
+	// 只输出info中标记的主图标，没有标记时输出质量最高的一张
+	if len(cfg) > 0 && cfg[0].SingleFrame && len(entries) > 0 {
+		i := primary
+		if i < 0 {
+			i = bestEntry(entries, d)
+		}
+		entry := entries[i]
+		entry.Offset = uint32(6 + 16)
+		return writeICO(w, ICONDIR{Type: 1, Count: 1}, []ICONDIRENTRY{entry}, [][]byte{d[i]}, cfg...)
+	}
+
+	return writeICO(w, ICONDIR{Type: 1, Count: uint16(len(entries))}, entries, d, cfg...)
+}
+
+// parseICNS decodes every image representation of an icns file into PNG data,
+// returning them with matching ICO directory entries and the index of the entry the
+// "info" plist marks as primary, -1 if none.
+func parseICNS(r io.Reader, cfg ...Config) ([]ICONDIRENTRY, [][]byte, int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	if data, err = checkICNS(data); err != nil {
+		return nil, nil, -1, err
+	}
+
+	iconSet, err := icns.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	// 掩码映射，masks按像素数索引，用于PNG图标
 	maskMap := make(map[int]*icns.Icon)
+	masks := make(map[int][]byte)
 	var newSet icns.IconSet
+	var hint any
 	// 过滤掉无用的OSType
 	for _, icon := range iconSet {
 		switch string(icon.Type[:]) {
-		case "TOC ", "icnV", "name", "info", "sbtp", "slct", "\xFD\xD9\x2F\xA8":
+		case "info":
+			hint = icnsPrimaryHint(icon.Data)
+			debugf(cfg, "fico: icns info primary hint %v", hint)
+		case "TOC ", "icnV", "name", "sbtp", "slct", "\xFD\xD9\x2F\xA8":
+			debugf(cfg, "fico: icns skip OSType %q", icon.Type[:])
 			continue
 		case "s8mk", "l8mk", "h8mk", "t8mk":
 			maskMap[len(newSet)-1] = icon
+			masks[len(icon.Data)] = icon.Data
 		default:
 			newSet = append(newSet, icon)
 		}
@@ -337,34 +2536,37 @@ func ICNS2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
 	var entries []ICONDIRENTRY
 	offset := 6 + len(newSet)*16
 	for i, icon := range newSet {
-		// it32 data always starts with a header of four zero-bytes
-		// (tested all icns files in macOS 10.15.7 and macOS 11).
-		// Usage unknown, the four zero-bytes can be any value and are quietly ignored.
-		if string(icon.Type[:]) == "it32" && len(icon.Data) >= 4 {
-			icon.Data = icon.Data[4:]
-		}
-
 		var w, h, s int
 
 		if isPNG(icon.Data) {
-			d = append(d, icon.Data)
 			img, err := png.DecodeConfig(bytes.NewReader(icon.Data))
 			if err != nil {
-				return err
+				return nil, nil, -1, err
+			}
+			if mask := masks[img.Width*img.Height]; len(cfg) > 0 && cfg[0].PNGMask && mask != nil {
+				debugf(cfg, "fico: icns apply mask to %q", icon.Type[:])
+				if icon.Data, err = applyMask(icon.Data, mask); err != nil {
+					return nil, nil, -1, err
+				}
 			}
+			d = append(d, icon.Data)
 			w, h, s = img.Width, img.Height, len(icon.Data)
 		} else {
 			decoded, hasA := false, 1
-			var rgba *image.RGBA
+			var img image.Image
 			switch string(icon.Type[:]) {
-			// 24-bit RGB
-			case "is32", "il32", "ih32", "it32", "icp4", "icp5":
-				if maskData, ok := maskMap[i]; ok {
+			// 24-bit RGB，icp4、icp5、icp6也可能是ARGB
+			case "is32", "il32", "ih32", "it32", "icp4", "icp5", "icp6":
+				if isARGB(icon.Data) {
+					break
+				}
+				rgb := icnsRGBDecode(string(icon.Type[:]), icon.Data)
+				if maskData, ok := maskMap[i]; ok && len(maskData.Data) == len(rgb)/3 {
 					// 构造成ARGB格式
 					newData := append([]byte("ARGB"), maskData.Data...)
-					icon.Data = append(newData, icnsBRLDecode(icon.Data)...)
+					icon.Data = append(newData, rgb...)
 				} else {
-					icon.Data = append([]byte("ARGB"), icnsBRLDecode(icon.Data)...)
+					icon.Data = append([]byte("ARGB"), rgb...)
 					// 说明有没有透明度数据
 					hasA = 0
 				}
@@ -378,11 +2580,21 @@ func ICNS2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
 				} else {
 					icon.Data = icnsBRLDecode(icon.Data[4:])
 				}
-				pixles := len(icon.Data) / 4
-				w := int(math.Sqrt(float64(pixles)))
+				// 边长由OSType决定，未知的类型才按数据长度推算（没有掩码时只有RGB三个通道）
+				w := icnsSizes[string(icon.Type[:])]
+				if w <= 0 {
+					w = int(math.Sqrt(float64(len(icon.Data) / (3 + hasA))))
+				}
 				h = w
+				pixles := w * h
+				// 损坏的数据补齐，避免越界
+				if n := pixles * (3 + hasA); len(icon.Data) < n {
+					icon.Data = append(icon.Data, make([]byte, n-len(icon.Data))...)
+				}
 
-				rgba = image.NewRGBA(image.Rect(0, 0, w, h))
+				// 掩码（或ARGB的A通道）是覆盖率，RGB没有预乘，按非预乘的NRGBA原样保存，
+				// 存进预乘的RGBA会在编码PNG时被反预乘，半透明的边缘颜色失真
+				nrgba := image.NewNRGBA(image.Rect(0, 0, w, h))
 				for y := 0; y < h; y++ {
 					for x := 0; x < w; x++ {
 						no := (y*w + x)
@@ -394,30 +2606,34 @@ func ICNS2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
 						} else {
 							alpha = 0xFF
 						}
-						rgba.Set(x, y, color.RGBA{icon.Data[no+hasA*pixles], icon.Data[no+(1+hasA)*pixles], icon.Data[no+(2+hasA)*pixles], alpha})
+						nrgba.SetNRGBA(x, y, color.NRGBA{icon.Data[no+hasA*pixles], icon.Data[no+(1+hasA)*pixles], icon.Data[no+(2+hasA)*pixles], alpha})
 					}
 				}
+				img = nrgba
 			} else {
-				img, _, err := image.Decode(bytes.NewReader(icon.Data))
+				src, _, err := image.Decode(bytes.NewReader(icon.Data))
 				if err != nil {
-					return err
+					return nil, nil, -1, err
 				}
 
-				rgba = image.NewRGBA(img.Bounds())
-				draw.Draw(rgba, rgba.Bounds(), img, image.Point{0, 0}, draw.Src)
+				rgba := image.NewRGBA(src.Bounds())
+				draw.Draw(rgba, rgba.Bounds(), src, image.Point{0, 0}, draw.Src)
+				img = rgba
 			}
 
-			var buf bytes.Buffer
-			png.Encode(&buf, rgba)
-			d = append(d, buf.Bytes())
+			data, err := encodePNG(img)
+			if err != nil {
+				return nil, nil, -1, err
+			}
+			d = append(d, data)
 
-			w, h, s = rgba.Bounds().Dx(), rgba.Bounds().Dy(), buf.Len()
+			w, h, s = img.Bounds().Dx(), img.Bounds().Dy(), len(data)
 		}
 
 		entries = append(entries, ICONDIRENTRY{
 			IconCommon: IconCommon{
-				Width:      uint8(w),
-				Height:     uint8(h),
+				Width:      dirSize(w),
+				Height:     dirSize(h),
 				Planes:     1,
 				BitCount:   32,
 				BytesInRes: uint32(s),
@@ -428,13 +2644,178 @@ func ICNS2ICO(w io.Writer, r io.Reader, cfg ...Config) error {
 		offset += s
 	}
 
-	return writeICO(w, ICONDIR{Type: 1, Count: uint16(len(iconSet))}, entries, d, cfg...)
+	primary := -1
+	for i, icon := range newSet {
+		switch v := hint.(type) {
+		case string:
+			if string(icon.Type[:]) == v {
+				primary = i
+			}
+		case int64:
+			if w, _ := entrySize(entries[i], d[i]); int64(w) == v && (primary < 0 || entries[i].BitCount > entries[primary].BitCount) {
+				primary = i
+			}
+		}
+	}
+	return entries, d, primary, nil
+}
+
+// applyMask multiplies the alpha of the PNG data d by an 8-bit mask of one byte per
+// pixel, returning the re-encoded PNG.
+func applyMask(d, mask []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	// 在非预乘的NRGBA上修改透明度，颜色保持不变
+	nrgba := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	for i := range mask {
+		a := &nrgba.Pix[i*4+3]
+		*a = uint8(int(*a) * int(mask[i]) / 0xFF)
+	}
+	return encodePNG(nrgba)
+}
+
+// icnsPrimaryHint returns the representation the "info" plist marks as primary, either
+// an OSType string or a size in pixels, nil if it has no such key. Apple documents no such
+// key, so a few likely names are accepted.
+func icnsPrimaryHint(d []byte) any {
+	dict, err := parseBPlistDict(d)
+	if err != nil {
+		return nil
+	}
+	for _, k := range []string{"primary", "PrimaryRepresentation", "preferred"} {
+		switch v := dict[k].(type) {
+		case string, int64:
+			return v
+		}
+	}
+	return nil
+}
+
+// 用PNG存储的icns类型及其尺寸，按尺寸升序
+var icnsPNGTypes = []struct {
+	Type string
+	Size int
+}{
+	{"icp4", 16},
+	{"icp5", 32},
+	{"icp6", 64},
+	{"ic07", 128},
+	{"ic08", 256},
+	{"ic09", 512},
+	{"ic10", 1024},
+}
+
+// writeICNS packs the frames into an icns file using the PNG based OSTypes.
+//
+// icns only has slots for 16, 32, 64, 128, 256, 512 and 1024 pixels, so frames of other
+// sizes (e.g. 24 or 48 from an ICO) are not dropped but scaled into a free slot: exact
+// sizes are placed first, then every remaining frame takes the closest slot still free,
+// the larger one on a tie, e.g. 24→32 and 48→64, 48→32 when 64 is taken, or 48→128 when
+// both are. Frames of a size already placed (the same size at a lower bit count) are
+// not repeated. An ICO with more distinct sizes than there are slots is an error rather
+// than losing frames; MinSize and MaxSize can narrow it down.
+func writeICNS(w io.Writer, entries []ICONDIRENTRY, d [][]byte) error {
+	slots := make([][]byte, len(icnsPNGTypes))
+	// 已经放入的尺寸
+	placed := make(map[int]bool)
+	var pending []int
+
+	// 同样尺寸的优先使用色深最高的
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return entries[order[a]].BitCount > entries[order[b]].BitCount
+	})
+
+	for _, i := range order {
+		ws, hs := entrySize(entries[i], d[i])
+		exact := false
+		for t, it := range icnsPNGTypes {
+			if it.Size == ws && ws == hs && slots[t] == nil {
+				slots[t] = d[i]
+				placed[ws] = true
+				exact = true
+				break
+			}
+		}
+		if !exact {
+			pending = append(pending, i)
+		}
+	}
+
+	for _, i := range pending {
+		ws, hs := entrySize(entries[i], d[i])
+		size := max(ws, hs)
+		if ws == hs && placed[size] {
+			continue
+		}
+
+		t := -1
+		for j, it := range icnsPNGTypes {
+			if slots[j] == nil && (t < 0 || abs(it.Size-size) <= abs(icnsPNGTypes[t].Size-size)) {
+				t = j
+			}
+		}
+		if t < 0 {
+			return errors.New("too many icon sizes for icns: no slot left for " + strconv.Itoa(ws) + "x" + strconv.Itoa(hs))
+		}
+		if ws == hs {
+			placed[size] = true
+		}
+
+		img, err := decodeEntry(d[i])
+		if err != nil {
+			return err
+		}
+		zoomed, err := zoomImg(img, Config{Width: icnsPNGTypes[t].Size, Height: icnsPNGTypes[t].Size})
+		if err != nil {
+			return err
+		}
+		if slots[t], err = encodePNG(zoomed); err != nil {
+			return err
+		}
+	}
+
+	var body bytes.Buffer
+	for t, data := range slots {
+		if data == nil {
+			continue
+		}
+		// icns中只能存放PNG数据
+		if !isPNG(data) {
+			img, err := decodeEntry(data)
+			if err != nil {
+				return err
+			}
+			if data, err = encodePNG(img); err != nil {
+				return err
+			}
+		}
+		body.WriteString(icnsPNGTypes[t].Type)
+		binary.Write(&body, binary.BigEndian, uint32(8+len(data)))
+		body.Write(data)
+	}
+
+	if _, err := io.WriteString(w, "icns"); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(8+body.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
 }
 
 const (
 	SECTION_RESOURCES = ".rsrc"
 	RT_ICON           = "3/"
 	RT_GROUP_ICON     = "14/"
+	RT_VERSION        = "16/"
 )
 
 // resource holds the full name and data of a data entry in a resource directory structure.
@@ -446,11 +2827,69 @@ type resource struct {
 	Data []byte
 }
 
+// resourceData locates the resource directory through the RESOURCE entry of the optional
+// header's data directory rather than by section name, so that resources living in a section
+// not named ".rsrc" (or in a section shared with other data) are still found. It returns the
+// bytes starting at the root directory together with the RVA of that root, or nil if the file
+// has no resources.
+func resourceData(peFile *pe.File) ([]byte, uint32, error) {
+	var dd pe.DataDirectory
+	switch oh := peFile.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_RESOURCE {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]
+		}
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_RESOURCE {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]
+		}
+	}
+
+	// 数据目录缺失时，退回到按名称查找
+	if dd.VirtualAddress == 0 {
+		rsrc := peFile.Section(SECTION_RESOURCES)
+		if rsrc == nil {
+			return nil, 0, nil
+		}
+		d, err := rsrc.Data()
+		if err != nil {
+			return nil, 0, err
+		}
+		return d, rsrc.VirtualAddress, nil
+	}
+
+	for _, s := range peFile.Sections {
+		size := s.VirtualSize
+		if size < s.Size {
+			size = s.Size
+		}
+		if dd.VirtualAddress < s.VirtualAddress || dd.VirtualAddress >= s.VirtualAddress+size {
+			continue
+		}
+
+		d, err := s.Data()
+		if err != nil {
+			return nil, 0, err
+		}
+		start := dd.VirtualAddress - s.VirtualAddress
+		if int(start) >= len(d) {
+			return nil, 0, nil
+		}
+		return d[start:], dd.VirtualAddress, nil
+	}
+	return nil, 0, nil
+}
+
 // Recursively parses a IMAGE_RESOURCE_DIRECTORY in slice b starting at position p
 // building on path prefix. virtual is needed to calculate the position of the data
-// in the resource
-func parseDir(b []byte, p int, prefix string, addr uint32) []*resource {
-	if prefix != "" && !strings.HasPrefix(prefix, RT_ICON) && !strings.HasPrefix(prefix, RT_GROUP_ICON) {
+// in the resource. Data entries pointing outside of b are read from the section holding
+// their RVA, or skipped. Only icon resources are returned unless all is set.
+func parseDir(b []byte, p int, prefix string, addr uint32, sections []*pe.Section, all bool) []*resource {
+	if !all && prefix != "" && !strings.HasPrefix(prefix, RT_ICON) && !strings.HasPrefix(prefix, RT_GROUP_ICON) {
+		return nil
+	}
+	// 资源目录只有类型、名称、语言三层，防止循环引用
+	if strings.Count(prefix, "/") >= 3 || p < 0 || p+16 > len(b) {
 		return nil
 	}
 
@@ -463,13 +2902,22 @@ func parseDir(b []byte, p int, prefix string, addr uint32) []*resource {
 	// Iterate over all entries in the current directory record
 	for i := 0; i < n; i++ {
 		o := 8*i + p + 16
+		if o+8 > len(b) {
+			break
+		}
 		name := int(le.Uint32(b[o : o+4]))
 		offsetToData := int(le.Uint32(b[o+4 : o+8]))
 		path := prefix
 		if name&0x80000000 > 0 { // Named entry if the high bit is set in the name
 			dirStr := name & 0x7FFFFFFF
+			if dirStr+2 > len(b) {
+				continue
+			}
 			length := int(le.Uint16(b[dirStr : dirStr+2]))
-			var resID []uint16
+			if dirStr+2+length<<1 > len(b) {
+				continue
+			}
+			resID := make([]uint16, length)
 			binary.Read(bytes.NewReader(b[dirStr+2:dirStr+2+length<<1]), le, resID)
 			path += string(utf16.Decode(resID))
 		} else { // ID entry
@@ -480,18 +2928,34 @@ func parseDir(b []byte, p int, prefix string, addr uint32) []*resource {
 			subdir := offsetToData & 0x7FFFFFFF
 
 			// Recursively get the res from the sub dirs
-			l := parseDir(b, subdir, path+"/", addr)
+			l := parseDir(b, subdir, path+"/", addr, sections, all)
 			res = append(res, l...)
 			continue
 		}
 
 		// Leaf, ptr to the data entry. Read IMAGE_RESOURCE_DATA_ENTRY
-		offset := int(le.Uint32(b[offsetToData : offsetToData+4]))
+		if offsetToData+8 > len(b) {
+			continue
+		}
+		rva := le.Uint32(b[offsetToData : offsetToData+4])
 		length := int(le.Uint32(b[offsetToData+4 : offsetToData+8]))
 
 		// The offset in IMAGE_RESOURCE_DATA_ENTRY is relative to the virual address.
 		// Calculate the address in the file
-		offset -= int(addr)
+		offset := int(rva) - int(addr)
+
+		// 有的链接器、加壳工具把数据放在资源节之外的节中，按RVA到对应的节中读取
+		if length > 0 && (offset < 0 || offset+length > len(b)) {
+			if d := sectionData(sections, rva, uint32(length)); d != nil {
+				res = append(res, &resource{Name: path, Data: d})
+			}
+			continue
+		}
+
+		// 长度为0或者超出了资源节的数据无法使用，跳过
+		if length <= 0 || offset < 0 || offset+length > len(b) {
+			continue
+		}
 
 		// Add resource to the list
 		res = append(res, &resource{Name: path, Data: b[offset : offset+length]})
@@ -499,6 +2963,22 @@ func parseDir(b []byte, p int, prefix string, addr uint32) []*resource {
 	return res
 }
 
+// sectionData reads size bytes at rva from the section of the file holding them. Only the
+// raw data in the file is used, the image base and relocations play no part in RVAs.
+func sectionData(sections []*pe.Section, rva, size uint32) []byte {
+	for _, s := range sections {
+		if rva < s.VirtualAddress || rva-s.VirtualAddress >= s.Size || size > s.Size-(rva-s.VirtualAddress) {
+			continue
+		}
+		d := make([]byte, size)
+		if _, err := s.ReadAt(d, int64(rva-s.VirtualAddress)); err != nil {
+			return nil
+		}
+		return d
+	}
+	return nil
+}
+
 // https://www.cnblogs.com/cswuyg/p/3603707.html
 // https://www.cnblogs.com/cswuyg/p/3619687.html
 // https://en.wikipedia.org/wiki/ICO_(file_format)#Header
@@ -534,6 +3014,7 @@ type ICONDIRENTRY struct {
 }
 
 func defaultICO(w io.Writer, peFile *pe.File, cfg ...Config) error {
+	debugf(cfg, "fico: pe has no usable icon, fallback to default icon")
 	n := ""
 	if peFile.FileHeader.Characteristics&pe.IMAGE_FILE_DLL != 0 {
 		n = "assets/DLL.ico"
@@ -570,50 +3051,327 @@ func defaultICO(w io.Writer, peFile *pe.File, cfg ...Config) error {
 		d = append(d, iconData[entries[i].Offset:])
 	}
 
-	return writeICO(w, gid.ICONDIR, entries, d, cfg...)
+	return writeICO(w, gid.ICONDIR, entries, d, cfg...)
+}
+
+/*
+在 Windows 中，当匹配一个 EXE 文件的图标时，通常会选择其中的一个资源，
+这个资源通常是包含在 PE 文件中的一组图标资源中的一个。
+选择的资源不一定是具有最小 ID 的资源，而是根据一些规则进行选择。
+Choosing an Icon: https://learn.microsoft.com/en-us/previous-versions/ms997538(v=msdn.10)?redirectedfrom=MSDN#choosing-an-icon
+*/
+func PE2ICO(w io.Writer, path string, cfg ...Config) error {
+	return peICO(w, path, cfg...)
+}
+
+// peICO converts the icon of the PE file at path. Since Windows 10 1903 the icons of
+// system files such as imageres.dll live in a resource-only companion, so when the file
+// has none and looks like such a stub (see peRedirected) the companions from peCompanions
+// are tried before the default icon. Every attempt is converted into a buffer first, so w
+// only receives the output of the one that succeeds.
+func peICO(w io.Writer, path string, cfg ...Config) error {
+	strict := Config{}
+	if len(cfg) > 0 {
+		strict = cfg[0]
+	}
+	fallback := !strict.NoFallback
+	strict.NoFallback = true
+
+	var buf bytes.Buffer
+	err := peFileICO(&buf, path, strict)
+	if err == nil {
+		_, err = buf.WriteTo(w)
+		return err
+	}
+	if err != ErrNoIcon {
+		return err
+	}
+	if peRedirected(path) {
+		for _, p := range peCompanions(path) {
+			buf.Reset()
+			if peFileICO(&buf, p, strict) == nil {
+				debugf(cfg, "fico: icon of %s redirected to %s", path, p)
+				_, err = buf.WriteTo(w)
+				return err
+			}
+		}
+	}
+
+	if !fallback {
+		return ErrNoIcon
+	}
+	return peFileICO(w, path, cfg...)
+}
+
+func peFileICO(w io.Writer, path string, cfg ...Config) error {
+	// 解析PE文件
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return err
+	}
+	defer peFile.Close()
+
+	return pe2ICO(w, peFile, false, cfg...)
+}
+
+// peCompanions returns the files the resources of the PE file at path may be redirected to
+// or from: for System32\imageres.dll, SystemResources\imageres.dll.mun and the language
+// folders' imageres.dll.mui; for a .mun or .mui, the file it belongs to.
+func peCompanions(path string) []string {
+	dir, base := filepath.Split(path)
+	var ret []string
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".mun":
+		name := base[:len(base)-4]
+		ret = append(ret, filepath.Join(dir, "..", "System32", name), filepath.Join(dir, name))
+	case ".mui":
+		name := base[:len(base)-4]
+		ret = append(ret, filepath.Join(dir, "..", name))
+	default:
+		ret = append(ret, filepath.Join(dir, "..", "SystemResources", base+".mun"), filepath.Join(dir, base+".mun"))
+		// 语言文件夹（如en-US、zh-CN）中的.mui
+		if mui, err := filepath.Glob(filepath.Join(dir, "*", base+".mui")); err == nil {
+			ret = append(ret, mui...)
+		}
+	}
+	return ret
+}
+
+// peRedirected reports whether the PE file at path looks like one whose resources were
+// moved to a companion file: it carries an MUI resource (the configuration tying it to
+// its .mui or .mun files), or it is resource-only, with no code section.
+func peRedirected(path string) bool {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return false
+	}
+	defer peFile.Close()
+
+	code := false
+	for _, s := range peFile.Sections {
+		code = code || s.Characteristics&pe.IMAGE_SCN_CNT_CODE != 0
+	}
+	if !code {
+		return true
+	}
+
+	resTable, addr, err := resourceData(peFile)
+	if err != nil || resTable == nil {
+		return false
+	}
+	for _, r := range parseDir(resTable, 0, "", addr, peFile.Sections, true) {
+		if strings.HasPrefix(r.Name, "MUI/") {
+			return true
+		}
+	}
+	return false
+}
+
+// PE2ICORaw writes the icon group of a PE file as an ico rebuilt from RT_GROUP_ICON and
+// RT_ICON, with the image data copied verbatim. Only Index, Language and Logger of cfg are
+// used: nothing is scaled, filtered or re-encoded, and ErrNoIcon is returned instead of
+// the default icon if the file has none.
+func PE2ICORaw(w io.Writer, path string, cfg ...Config) error {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return err
+	}
+	defer peFile.Close()
+
+	var rc []Config
+	if len(cfg) > 0 {
+		rc = []Config{{Index: cfg[0].Index, Language: cfg[0].Language, Logger: cfg[0].Logger}}
+	}
+	return pe2ICO(w, peFile, true, rc...)
+}
+
+// PEProductName returns the ProductName of the version information (VS_VERSION_INFO) of a PE
+// file, or its FileDescription if it has no product name, e.g. to name the extracted icon.
+func PEProductName(path string) (string, error) {
+	peFile, err := pe.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer peFile.Close()
+
+	if peFile.OptionalHeader == nil {
+		return "", ErrNoOptionalHeader
+	}
+	resTable, addr, err := resourceData(peFile)
+	if err != nil {
+		return "", err
+	}
+
+	var desc string
+	for _, r := range parseDir(resTable, 0, "", addr, peFile.Sections, true) {
+		if !strings.HasPrefix(r.Name, RT_VERSION) {
+			continue
+		}
+		strs := versionStrings(r.Data)
+		if strs["ProductName"] != "" {
+			return strs["ProductName"], nil
+		}
+		if desc == "" {
+			desc = strs["FileDescription"]
+		}
+	}
+	if desc == "" {
+		return "", errors.New("no product name in version info")
+	}
+	return desc, nil
+}
+
+// versionBlock splits a block of the version information into its key, value and children.
+// https://learn.microsoft.com/en-us/windows/win32/menurc/vs-versioninfo
+func versionBlock(b []byte) (key string, value, children []byte, ok bool) {
+	le := binary.LittleEndian
+	if len(b) < 6 {
+		return
+	}
+	l, vl, typ := int(le.Uint16(b)), int(le.Uint16(b[2:])), le.Uint16(b[4:])
+	if l < 6 || l > len(b) {
+		return
+	}
+	b = b[:l]
+
+	// 以0结尾的UTF-16键名，之后按4字节对齐
+	p := 6
+	var k []uint16
+	for ; p+2 <= len(b); p += 2 {
+		c := le.Uint16(b[p:])
+		if c == 0 {
+			break
+		}
+		k = append(k, c)
+	}
+	p = (p + 2 + 3) &^ 3
+
+	// 文本类型的值长度以字符计
+	if typ == 1 {
+		vl *= 2
+	}
+	if p+vl > len(b) {
+		vl = max(len(b)-p, 0)
+	}
+	if p > len(b) {
+		p = len(b)
+	}
+	value = b[p : p+vl]
+	p = min((p+vl+3)&^3, len(b))
+	return string(utf16.Decode(k)), value, b[p:], true
+}
+
+// versionStrings returns the strings of every StringTable in a VS_VERSION_INFO resource,
+// the first table winning when several languages define the same name.
+func versionStrings(d []byte) map[string]string {
+	strs := make(map[string]string)
+	// 依次处理b中的每个子块
+	eachBlock := func(b []byte, fn func(key string, value, children []byte)) {
+		for len(b) >= 6 {
+			l := int(binary.LittleEndian.Uint16(b))
+			key, value, children, ok := versionBlock(b)
+			if !ok || l < 6 {
+				return
+			}
+			fn(key, value, children)
+			b = b[min((l+3)&^3, len(b)):]
+		}
+	}
+
+	key, _, children, ok := versionBlock(d)
+	if !ok || key != "VS_VERSION_INFO" {
+		return strs
+	}
+	eachBlock(children, func(key string, _, tables []byte) {
+		if key != "StringFileInfo" {
+			return
+		}
+		eachBlock(tables, func(_ string, _, entries []byte) {
+			eachBlock(entries, func(name string, value, _ []byte) {
+				u := make([]uint16, len(value)/2)
+				for i := range u {
+					u[i] = binary.LittleEndian.Uint16(value[i*2:])
+				}
+				v := strings.TrimRight(string(utf16.Decode(u)), "\x00")
+				if _, ok := strs[name]; !ok && v != "" {
+					strs[name] = v
+				}
+			})
+		})
+	})
+	return strs
 }
 
-/*
-在 Windows 中，当匹配一个 EXE 文件的图标时，通常会选择其中的一个资源，
-这个资源通常是包含在 PE 文件中的一组图标资源中的一个。
-选择的资源不一定是具有最小 ID 的资源，而是根据一些规则进行选择。
-Choosing an Icon: https://learn.microsoft.com/en-us/previous-versions/ms997538(v=msdn.10)?redirectedfrom=MSDN#choosing-an-icon
-*/
-func PE2ICO(w io.Writer, path string, cfg ...Config) error {
-	// 解析PE文件
-	peFile, err := pe.Open(path)
-	if err != nil {
-		return err
+// pe2ICO converts the icon group of peFile, raw means the data is copied without any processing.
+func pe2ICO(w io.Writer, peFile *pe.File, raw bool, cfg ...Config) error {
+	cfg = physicalSize(cfg)
+	// 目标文件（.obj）等没有可选头，不是可执行的映像，资源也没有重定位
+	if peFile.OptionalHeader == nil {
+		return ErrNoOptionalHeader
 	}
 
-	rsrc := peFile.Section(SECTION_RESOURCES)
-	if rsrc == nil {
+	// 原样导出或设置了NoFallback时不使用默认图标
+	noICO := func() error {
+		if raw || (len(cfg) > 0 && cfg[0].NoFallback) {
+			return ErrNoIcon
+		}
 		return defaultICO(w, peFile, cfg...)
 	}
 
 	// 解析资源表
-	resTable, err := rsrc.Data()
+	resTable, addr, err := resourceData(peFile)
 	if err != nil {
 		return err
 	}
+	if resTable == nil {
+		return noICO()
+	}
 
-	resources := parseDir(resTable, 0, "", rsrc.SectionHeader.VirtualAddress)
-	idmap := make(map[uint16]*resource)
+	resources := parseDir(resTable, 0, "", addr, peFile.Sections, len(cfg) > 0 && cfg[0].ScanAllResources)
+	lang := uint16(0)
+	if len(cfg) > 0 {
+		lang = cfg[0].Language
+	}
+
+	// 同一个图标或图标组可能有多种语言的版本
+	idmap := make(map[uint16]*langResources)
+	grpmap := make(map[string]*langResources)
 	gid := GRPICONDIR{}
-	var grpIcons []*resource
+	var grpNames []string
 	for _, r := range resources {
+		n := strings.Split(r.Name, "/")
+		if len(n) < 3 {
+			continue
+		}
+		l, _ := strconv.ParseUint(n[2], 10, 16)
 		if strings.HasPrefix(r.Name, RT_GROUP_ICON) {
-			grpIcons = append(grpIcons, r)
+			if grpmap[n[1]] == nil {
+				grpmap[n[1]] = &langResources{}
+				grpNames = append(grpNames, n[1])
+			}
+			grpmap[n[1]].add(uint16(l), r)
 		} else if strings.HasPrefix(r.Name, RT_ICON) {
-			n := strings.Split(r.Name, "/")
 			id, _ := strconv.ParseUint(n[1], 10, 64)
-			idmap[uint16(id)] = r
+			if idmap[uint16(id)] == nil {
+				idmap[uint16(id)] = &langResources{}
+			}
+			idmap[uint16(id)].add(uint16(l), r)
 		}
 	}
+	var grpIcons []*resource
+	for _, name := range grpNames {
+		grpIcons = append(grpIcons, grpmap[name].pick(lang))
+	}
 
 	// 如果没有图标
 	if len(grpIcons) <= 0 {
-		return defaultICO(w, peFile, cfg...)
+		if len(cfg) > 0 && cfg[0].ScanAllResources && !raw {
+			if err := embeddedICO(w, resources, cfg...); err != ErrNoIcon {
+				return err
+			}
+			debugf(cfg, "fico: no icon in other resources")
+		}
+		return noICO()
 	}
 
 	// 获取指定的图标
@@ -622,9 +3380,13 @@ func PE2ICO(w io.Writer, path string, cfg ...Config) error {
 		if cfg[0].Index != nil && *cfg[0].Index < 0 {
 			// 如果是负数，那么尝试id
 			if r, ok := idmap[uint16(-*cfg[0].Index)]; ok {
-				return res2ICO(w, r.Data, cfg...)
+				data := r.pick(lang).Data
+				if raw {
+					return WriteRaw(w, ICONDIR{Type: 1, Count: 1}, relocate([]ICONDIRENTRY{rawEntry(data)}, [][]byte{data}), [][]byte{data})
+				}
+				return res2ICO(w, data, cfg...)
 			}
-			return defaultICO(w, peFile, cfg...)
+			return noICO()
 		}
 		if cfg[0].Index == nil || int(*cfg[0].Index) >= len(grpIcons) {
 			grpData = grpIcons[0].Data
@@ -644,28 +3406,117 @@ func PE2ICO(w io.Writer, path string, cfg ...Config) error {
 
 	// 如果没有图标
 	if gid.Count <= 0 {
-		return defaultICO(w, peFile, cfg...)
+		return noICO()
 	}
 
-	entries := make([]ICONDIRENTRY, gid.Count)
+	var entries []ICONDIRENTRY
 	var d [][]byte
-	offset := binary.Size(gid.ICONDIR) + len(entries)*binary.Size(entries[0])
-	for i := uint16(0); i < gid.Count; i++ {
-		if r, ok := idmap[gid.Entries[i].ID]; ok {
-			entries[i].IconCommon = gid.Entries[i].IconCommon
-			entries[i].Offset = uint32(offset)
-
-			offset += len(r.Data)
+	// 同一个图标在组中列出多次时，各目录项的数据是同一个切片，写出时只保存一份（见writeShared）
+	for _, e := range gid.Entries {
+		if lr, ok := idmap[e.ID]; ok {
+			r := lr.pick(lang)
+			entry := ICONDIRENTRY{IconCommon: e.IconCommon}
+			// 目录中的大小和实际数据不一致时以实际数据为准
+			entry.BytesInRes = uint32(len(r.Data))
+			entries = append(entries, entry)
 			d = append(d, r.Data)
 		}
 	}
 
-	return writeICO(w, gid.ICONDIR, entries, d, cfg...)
+	// 被跳过的图标不写入目录
+	if len(entries) <= 0 {
+		return noICO()
+	}
+	gid.Count = uint16(len(entries))
+
+	if raw {
+		return writeShared(w, gid.ICONDIR, entries, d)
+	}
+	return writeICO(w, gid.ICONDIR, relocate(entries, d), d, cfg...)
+}
+
+// rawEntry builds the directory entry of a single RT_ICON with no group entry to copy from.
+func rawEntry(d []byte) ICONDIRENTRY {
+	w, h := entrySize(ICONDIRENTRY{}, d)
+	bc := uint16(32)
+	if !isPNG(d) && !isJPEG(d) && len(d) >= 12 {
+		_, _, b := dibInfo(d)
+		bc = uint16(b)
+	}
+	return ICONDIRENTRY{IconCommon: IconCommon{
+		Width:      dirSize(w),
+		Height:     dirSize(h),
+		Planes:     1,
+		BitCount:   bc,
+		BytesInRes: uint32(len(d)),
+	}}
+}
+
+// dirSize returns a width or height as stored in an ico directory entry, where 256 and
+// larger are recorded as 0.
+func dirSize(n int) uint8 {
+	if n >= 256 {
+		return 0
+	}
+	return uint8(n)
+}
+
+// langResources holds the language versions of one resource.
+type langResources struct {
+	first  *resource
+	byLang map[uint16]*resource
+}
+
+func (l *langResources) add(lang uint16, r *resource) {
+	if l.first == nil {
+		l.first, l.byLang = r, make(map[uint16]*resource)
+	}
+	if _, ok := l.byLang[lang]; !ok {
+		l.byLang[lang] = r
+	}
+}
+
+// pick returns the version in lang, falling back to the neutral language (0), then to
+// English (1033), then to the first version in the file.
+func (l *langResources) pick(lang uint16) *resource {
+	for _, k := range []uint16{lang, 0, 1033} {
+		if r, ok := l.byLang[k]; ok {
+			return r
+		}
+	}
+	return l.first
+}
+
+// embeddedICO converts an icon stored outside of RT_GROUP_ICON/RT_ICON, e.g. in RCDATA
+// or a custom resource type, recognized by its content: the first valid ICO, or else
+// the largest PNG.
+func embeddedICO(w io.Writer, resources []*resource, cfg ...Config) error {
+	var best []byte
+	var bw, bh int
+	for _, r := range resources {
+		if strings.HasPrefix(r.Name, RT_ICON) || strings.HasPrefix(r.Name, RT_GROUP_ICON) {
+			continue
+		}
+		if _, _, _, err := parseICO(r.Data); err == nil {
+			return ICO2ICO(w, bytes.NewReader(r.Data), cfg...)
+		}
+		if isPNG(r.Data) {
+			img, err := png.DecodeConfig(bytes.NewReader(r.Data))
+			if err == nil && img.Width*img.Height > bw*bh {
+				best, bw, bh = r.Data, img.Width, img.Height
+			}
+		}
+	}
+	if best == nil {
+		return ErrNoIcon
+	}
+	return IMG2ICO(w, bytes.NewReader(best), cfg...)
 }
 
 // check 1bit FLAG of x,y coordinator
 func f(d []byte, x, y, w, h int) byte {
-	index := (w >> 3 * ((h - 1) - y)) + (x >> 3)
+	// 每行按4字节对齐
+	index := ((w+31)>>5<<2)*((h-1)-y) + (x >> 3)
 
 	if index < 0 || index >= len(d) {
 		return 0
@@ -692,7 +3543,11 @@ func getMaskBit(d []byte, x, y, w, h int) uint32 {
 }
 
 // https://stackoverflow.com/questions/16330403/get-hbitmaps-for-all-sizes-and-depths-of-a-file-type-icon-c
-func res2BMP32(d []byte) *image.RGBA {
+func res2BMP32(d []byte) (*image.RGBA, error) {
+	d, err := normalizeDIB(d)
+	if err != nil {
+		return nil, err
+	}
 	var bmpHdr struct {
 		Size            uint32 // The size of the header (in bytes)
 		Width           int32  // The bitmap's width (in pixels)
@@ -708,6 +3563,15 @@ func res2BMP32(d []byte) *image.RGBA {
 	}
 	binary.Read(bytes.NewReader(d), binary.LittleEndian, &bmpHdr)
 	w, h, colors := int(bmpHdr.Width), int(bmpHdr.Height), int(bmpHdr.ColorsUsed)
+	// 高度为负数时行是从上往下存储的，下面按从下往上解码，最后再上下翻转
+	topDown := h < 0
+	h = abs(h)
+	if w <= 0 || h <= 0 {
+		return nil, errors.New("invalid icon bitmap size")
+	}
+	if len(d)-40 < dibDataSize(int(bmpHdr.BitCount), w, h, colors) {
+		return nil, errors.New("truncated icon bitmap")
+	}
 	var bmp *image.RGBA
 	if h >= w<<1 {
 		bmp = image.NewRGBA(image.Rect(0, 0, w, h>>1))
@@ -725,7 +3589,7 @@ func res2BMP32(d []byte) *image.RGBA {
 			h >>= 1
 		}
 		pixel := 0
-		for yy := h - 1; yy > 0; yy-- {
+		for yy := h - 1; yy >= 0; yy-- {
 			for xx := 0; xx < w; xx++ {
 				mask := getMaskBit(bitmask, xx, yy, w, h)
 				bmp.Set(xx, yy, color.RGBA{
@@ -743,7 +3607,7 @@ func res2BMP32(d []byte) *image.RGBA {
 			h >>= 1
 		}
 		pixel := 0
-		for yy := h - 1; yy > 0; yy-- {
+		for yy := h - 1; yy >= 0; yy-- {
 			for xx := 0; xx < w; xx++ {
 				mask := getMaskBit(bitmask, xx, yy, w, h)
 				bmp.Set(xx, yy, color.RGBA{
@@ -761,7 +3625,7 @@ func res2BMP32(d []byte) *image.RGBA {
 			h >>= 1
 		}
 		pixel := 0
-		for yy := h - 1; yy > 0; yy-- {
+		for yy := h - 1; yy >= 0; yy-- {
 			for xx := 0; xx < w; xx++ {
 				bmp.Set(xx, yy, convert16BitToARGB(
 					binary.LittleEndian.Uint16(d[pixel<<1:]),
@@ -773,77 +3637,624 @@ func res2BMP32(d []byte) *image.RGBA {
 		if colors > 256 || colors <= 0 {
 			colors = 256
 		}
+		// 每行按4字节对齐
+		stride := (w*8 + 31) >> 5 << 2
 		if h == w<<1 {
-			bitmask = d[(colors<<2)+(w*w):]
 			h >>= 1
+			bitmask = d[(colors<<2)+stride*h:]
 		}
 		pal := make([]color.RGBA, colors)
 		for i := 0; i < colors; i++ {
 			pal[i] = color.RGBA{d[i<<2+2], d[i<<2+1], d[i<<2], 0xFF} // RGBQUAD BGR
 		}
-		pixel := 0
-		for yy := h - 1; yy > 0; yy-- {
+		for yy := h - 1; yy >= 0; yy-- {
+			row := d[(colors<<2)+stride*(h-1-yy):]
 			for xx := 0; xx < w; xx++ {
 				if getMaskBit(bitmask, xx, yy, w, h) != 0 {
-					bmp.Set(xx, yy, pal[d[(colors<<2)+pixel]])
+					bmp.Set(xx, yy, pal[row[xx]])
 				}
-				pixel++
 			}
 		}
 	case 4:
 		if colors > 16 || colors <= 0 {
 			colors = 16
 		}
+		// 每行按4字节对齐，宽度不是8的倍数时行尾有填充
+		stride := (w*4 + 31) >> 5 << 2
 		if h == w<<1 {
-			bitmask = d[(colors<<2)+(w*w>>1):]
 			h >>= 1
+			bitmask = d[(colors<<2)+stride*h:]
 		}
 		pal := make([]color.RGBA, colors)
 		for i := 0; i < colors; i++ {
 			pal[i] = color.RGBA{d[i<<2+2], d[i<<2+1], d[i<<2], 0xFF} // RGBQUAD BGR
 		}
-		pixel := 0
-		for yy := h - 1; yy > 0; yy-- {
+		for yy := h - 1; yy >= 0; yy-- {
+			row := d[(colors<<2)+stride*(h-1-yy):]
 			for xx := 0; xx < w; xx++ {
 				if getMaskBit(bitmask, xx, yy, w, h) != 0 {
-					if pixel&1 > 0 {
-						bmp.Set(xx, yy, pal[d[(colors<<2)+(pixel>>1)]>>4])
+					// 高4位是左边的像素
+					if xx&1 > 0 {
+						bmp.Set(xx, yy, pal[row[xx>>1]&0x0F])
 					} else {
-						bmp.Set(xx, yy, pal[d[(colors<<2)+(pixel>>1)]&0x0F])
+						bmp.Set(xx, yy, pal[row[xx>>1]>>4])
 					}
 				}
-				pixel++
 			}
 		}
 	case 1:
 		if colors > 2 {
 			colors = 2
 		}
-		if colors <= 0 {
-			colors = 2
+		if colors <= 0 {
+			colors = 2
+		}
+		pal := make([]color.RGBA, colors)
+		for i := 0; i < colors; i++ {
+			pal[i] = color.RGBA{d[i<<2+2], d[i<<2+1], d[i<<2], 0xFF} // RGBQUAD BGR
+		}
+		retColors := []color.RGBA{pal[0], {0x00, 0xFF, 0x00, 0xFF}, pal[1], {0x00, 0x00, 0xFF, 0xFF}}
+		// 与掩码一样每行按4字节对齐，AND掩码在XOR位图的h行之后
+		if h == w<<1 {
+			h >>= 1
+		}
+		xorBits, andBits := d[(colors<<2):], d[(colors<<2)+((w+31)>>5<<2)*h:]
+		for yy := h - 1; yy >= 0; yy-- {
+			for xx := 0; xx < w; xx++ {
+				bmp.Set(xx, yy, retColors[f(xorBits, xx, yy, w, h)<<1|f(andBits, xx, yy, w, h)])
+			}
+		}
+	}
+
+	if topDown {
+		flipRGBA(bmp)
+	}
+	return bmp, nil
+}
+
+// normalizeDIB rewrites the header of a DIB as the 40-byte BITMAPINFOHEADER res2BMP32 decodes.
+// The extended headers (V2 to V5) are cut down to it, and the OS/2 BITMAPCOREHEADER of old
+// icons, which has 16-bit sizes and 3-byte RGBTRIPLE palette entries, is converted.
+func normalizeDIB(d []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(d) < 12 {
+		return nil, errors.New("invalid icon bitmap header")
+	}
+	switch size := int(le.Uint32(d)); size {
+	case 12:
+		bitCount := le.Uint16(d[10:])
+		out := make([]byte, 40, 40+len(d))
+		le.PutUint32(out, 40)
+		le.PutUint32(out[4:], uint32(le.Uint16(d[4:])))
+		le.PutUint32(out[8:], uint32(le.Uint16(d[6:])))
+		le.PutUint16(out[12:], le.Uint16(d[8:]))
+		le.PutUint16(out[14:], bitCount)
+		d = d[12:]
+		// 调色板总是满的，每项3字节（BGR），补成4字节的RGBQUAD
+		if bitCount <= 8 {
+			n := 1 << bitCount
+			if len(d) < n*3 {
+				return nil, errors.New("truncated icon bitmap")
+			}
+			for i := 0; i < n; i++ {
+				out = append(out, d[i*3], d[i*3+1], d[i*3+2], 0)
+			}
+			d = d[n*3:]
+		}
+		return append(out, d...), nil
+	case 52, 56, 108, 124:
+		if len(d) < size {
+			return nil, errors.New("invalid icon bitmap header")
+		}
+		// 前40字节与BITMAPINFOHEADER相同，去掉扩展部分
+		out := make([]byte, 40, 40+len(d)-size)
+		copy(out, d)
+		le.PutUint32(out, 40)
+		return append(out, d[size:]...), nil
+	}
+	// 其他的都按BITMAPINFOHEADER处理
+	if len(d) < 40 {
+		return nil, errors.New("invalid icon bitmap header")
+	}
+	return d, nil
+}
+
+// dibInfo returns the width, the height, which includes the AND mask in icons, and the
+// bit count from the header of a DIB.
+func dibInfo(d []byte) (w, h, bitCount int) {
+	le := binary.LittleEndian
+	if len(d) < 12 {
+		return 0, 0, 0
+	}
+	if le.Uint32(d) == 12 {
+		return int(le.Uint16(d[4:])), int(le.Uint16(d[6:])), int(le.Uint16(d[10:]))
+	}
+	if len(d) >= 16 {
+		bitCount = int(le.Uint16(d[14:]))
+	}
+	return int(int32(le.Uint32(d[4:]))), int(int32(le.Uint32(d[8:]))), bitCount
+}
+
+// dibDataSize returns how many bytes after the header res2BMP32 reads for a bitmap of the
+// given depth, so that truncated resources are rejected before slicing into them.
+func dibDataSize(bitCount, w, h, colors int) int {
+	// 与res2BMP32中的规则一致：高度是宽度的两倍时后半部分是掩码
+	masked := h == w<<1
+	if bitCount == 32 {
+		masked = h >= w<<1
+	}
+	ph := h
+	if masked {
+		ph = h >> 1
+	}
+	switch bitCount {
+	case 32, 24, 16:
+		bpp := bitCount >> 3
+		n := w * ph * bpp
+		if masked {
+			// 掩码从w*w个像素之后开始
+			n = max(n, w*w*bpp)
+		}
+		return n
+	case 8, 4:
+		if colors > 1<<bitCount || colors <= 0 {
+			colors = 1 << bitCount
+		}
+		return colors<<2 + (w*bitCount+31)>>5<<2*ph
+	case 1:
+		if colors <= 0 || colors > 2 {
+			colors = 2
+		}
+		return colors<<2 + (w+31)>>5<<2*ph
+	}
+	return 0
+}
+
+// flipRGBA flips img upside down in place.
+func flipRGBA(img *image.RGBA) {
+	h := img.Bounds().Dy()
+	row := make([]byte, img.Bounds().Dx()*4)
+	for y := 0; y < h>>1; y++ {
+		a := img.Pix[y*img.Stride:][:len(row)]
+		b := img.Pix[(h-1-y)*img.Stride:][:len(row)]
+		copy(row, a)
+		copy(a, b)
+		copy(b, row)
+	}
+}
+
+// decodeEntry decodes the image data of an icon entry, which is PNG, JPEG or a DIB.
+func decodeEntry(d []byte) (image.Image, error) {
+	if isPNG(d) {
+		return png.Decode(bytes.NewReader(d))
+	}
+	if isJPEG(d) {
+		img, _, err := image.Decode(bytes.NewReader(d))
+		return img, err
+	}
+	if len(d) < 12 {
+		return nil, errors.New("invalid icon entry")
+	}
+	return res2BMP32(d)
+}
+
+func res2ICO(w io.Writer, d []byte, cfg ...Config) error {
+	if isPNG(d) || isJPEG(d) {
+		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+	}
+
+	bmp, err := res2BMP32(d)
+	if err != nil {
+		return err
+	}
+	zoomed, err := zoomImg(bmp, cfg...)
+	if err != nil {
+		return err
+	}
+	return img2ICO(w, zoomed, nil, cfg...)
+}
+
+// Frame is one image of an icon source as returned by Parse. Sources holding several
+// sizes yield one Frame per size; animated sources (GIF, ANI) tell their frames apart
+// by FrameIndex, all sizes of the same animation step sharing the same index.
+type Frame struct {
+	FrameIndex int           // 动画帧序号，静态格式为0
+	Width      int           // 实际宽度，以像素为单位
+	Height     int           // 实际高度，以像素为单位
+	BitCount   int           // 每个像素的位数
+	Delay      time.Duration // 动画帧的显示时长，静态格式为0
+	Data       []byte        // 图像数据（PNG、JPEG或DIB）
+}
+
+// Parse enumerates the frames of an icon or image file without converting it. For PE
+// files the frames are those of the icon group that PE2ICO would choose; entries of 256
+// and larger, stored as 0 in the group, report the size read from their PNG header.
+func Parse(path string) ([]Frame, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".ico", ".cur", ".ani", ".icns", ".gif", ".bmp", ".jpg", ".jpeg", ".png", ".tiff", ".tga":
+	case ".exe", ".dll", ".mui", ".mun":
+		// 原样导出图标组再解析目录，数据与资源中一致
+		var buf bytes.Buffer
+		if err := PE2ICORaw(&buf, path); err != nil {
+			return nil, err
+		}
+		_, entries, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		return entries2Frames(entries, d, 0, 0), nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ext {
+	case ".ico", ".cur":
+		_, entries, d, err := parseICO(data)
+		if err != nil {
+			return nil, err
+		}
+		return entries2Frames(entries, d, 0, 0), nil
+	case ".ani":
+		return parseANI(data)
+	case ".icns":
+		entries, d, _, err := parseICNS(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return entries2Frames(entries, d, 0, 0), nil
+	case ".gif":
+		return parseGIF(data)
+	case ".png":
+		if frames, err := parseAPNG(data); err != nil || frames != nil {
+			return frames, err
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !isPNG(data) {
+		if data, err = encodePNG(img); err != nil {
+			return nil, err
+		}
+	}
+	return []Frame{{
+		Width:    img.Bounds().Dx(),
+		Height:   img.Bounds().Dy(),
+		BitCount: 32,
+		Data:     data,
+	}}, nil
+}
+
+// parseICO reads the directory of an ICO (or CUR) file and slices out the image data of every entry.
+func parseICO(data []byte) (id ICONDIR, entries []ICONDIRENTRY, d [][]byte, err error) {
+	rd := bytes.NewReader(data)
+	if err = binary.Read(rd, binary.LittleEndian, &id); err != nil {
+		return
+	}
+	if id.Reserved != 0 || (id.Type != 1 && id.Type != 2) {
+		return id, nil, nil, errors.New("invalid icon header")
+	}
+
+	entries = make([]ICONDIRENTRY, id.Count)
+	for i := range entries {
+		if err = binary.Read(rd, binary.LittleEndian, &entries[i]); err != nil {
+			return id, nil, nil, err
+		}
+	}
+
+	for _, e := range entries {
+		if int64(e.Offset)+int64(e.BytesInRes) > int64(len(data)) {
+			return id, nil, nil, errors.New("icon entry out of range")
+		}
+		d = append(d, data[e.Offset:e.Offset+e.BytesInRes])
+	}
+	return
+}
+
+// VerifyICO checks that r is a well-formed ICO file and returns every problem found, nil if
+// there is none: the header, the directory, the placement of each image and whether each
+// image is a valid PNG or DIB of the size the directory says.
+func VerifyICO(r io.Reader) []error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	report := func(i int, msg string) {
+		if i >= 0 {
+			msg = "entry " + strconv.Itoa(i) + ": " + msg
+		}
+		errs = append(errs, errors.New(msg))
+	}
+
+	var id ICONDIR
+	if err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &id); err != nil {
+		return []error{errors.New("icon header too short")}
+	}
+	if id.Reserved != 0 {
+		report(-1, "reserved field is "+strconv.Itoa(int(id.Reserved))+", want 0")
+	}
+	if id.Type != 1 {
+		report(-1, "type is "+strconv.Itoa(int(id.Type))+", want 1")
+	}
+	if id.Count == 0 {
+		report(-1, "no entries")
+	}
+	dirEnd := 6 + int(id.Count)*16
+	if dirEnd > len(data) {
+		report(-1, "directory of "+strconv.Itoa(int(id.Count))+" entries exceeds file size")
+		return errs
+	}
+
+	entries := make([]ICONDIRENTRY, id.Count)
+	binary.Read(bytes.NewReader(data[6:dirEnd]), binary.LittleEndian, entries)
+
+	for i, e := range entries {
+		start, end := int64(e.Offset), int64(e.Offset)+int64(e.BytesInRes)
+		if e.BytesInRes == 0 {
+			report(i, "empty image")
+			continue
+		}
+		if start < int64(dirEnd) {
+			report(i, "image overlaps the directory")
+		}
+		if end > int64(len(data)) {
+			report(i, "image out of file range")
+			continue
+		}
+		for j, o := range entries[:i] {
+			// 多个目录项可以共用同一份数据
+			if o.Offset == e.Offset && o.BytesInRes == e.BytesInRes {
+				continue
+			}
+			if start < int64(o.Offset)+int64(o.BytesInRes) && int64(o.Offset) < end {
+				report(i, "image overlaps entry "+strconv.Itoa(j))
+			}
+		}
+
+		d := data[start:end]
+		var w, h int
+		if isPNG(d) {
+			img, err := png.DecodeConfig(bytes.NewReader(d))
+			if err != nil {
+				report(i, "invalid png: "+err.Error())
+				continue
+			}
+			w, h = img.Width, img.Height
+		} else if isJPEG(d) {
+			report(i, "jpeg image, only png and dib are standard")
+			continue
+		} else {
+			// BITMAPINFOHEADER及V4、V5等扩展头，或OS/2的BITMAPCOREHEADER
+			valid := false
+			if len(d) >= 12 {
+				switch size := int(binary.LittleEndian.Uint32(d)); size {
+				case 12, 40, 52, 56, 108, 124:
+					valid = len(d) >= size
+				}
+			}
+			if !valid {
+				report(i, "neither png nor dib")
+				continue
+			}
+			w, h, _ = dibInfo(d)
+			h = abs(h) >> 1
+			if w <= 0 || h <= 0 {
+				report(i, "invalid dib size")
+				continue
+			}
+		}
+
+		// 目录中0表示256
+		dw, dh := int(e.Width), int(e.Height)
+		if dw == 0 {
+			dw = 256
+		}
+		if dh == 0 {
+			dh = 256
+		}
+		if (w < 256 || dw != 256) && w != dw || (h < 256 || dh != 256) && h != dh {
+			report(i, "directory says "+strconv.Itoa(dw)+"x"+strconv.Itoa(dh)+", image is "+strconv.Itoa(w)+"x"+strconv.Itoa(h))
+		}
+	}
+	return errs
+}
+
+// entrySize returns the real dimensions of an entry, looking into the image data
+// when the directory reports 0 (256 or more pixels).
+func entrySize(e ICONDIRENTRY, d []byte) (int, int) {
+	if e.Width > 0 && e.Height > 0 {
+		return int(e.Width), int(e.Height)
+	}
+
+	if isPNG(d) {
+		img, err := png.DecodeConfig(bytes.NewReader(d))
+		if err == nil {
+			return img.Width, img.Height
+		}
+	} else if !isJPEG(d) && len(d) >= 12 {
+		// BITMAPINFOHEADER中的高度包含了掩码数据，是实际高度的2倍
+		w, h, _ := dibInfo(d)
+		if w > 0 && h != 0 {
+			return w, abs(h) >> 1
+		}
+	}
+
+	img, _, err := image.DecodeConfig(bytes.NewReader(d))
+	if err == nil {
+		return img.Width, img.Height
+	}
+	return 256, 256
+}
+
+func entries2Frames(entries []ICONDIRENTRY, d [][]byte, idx int, delay time.Duration) []Frame {
+	var frames []Frame
+	for i, e := range entries {
+		w, h := entrySize(e, d[i])
+		bc := int(e.BitCount)
+		if isPNG(d[i]) {
+			bc = 32
+		} else if isJPEG(d[i]) {
+			bc = 24
+		} else if bc <= 0 {
+			_, _, bc = dibInfo(d[i])
+		}
+		frames = append(frames, Frame{
+			FrameIndex: idx,
+			Width:      w,
+			Height:     h,
+			BitCount:   bc,
+			Delay:      delay,
+			Data:       d[i],
+		})
+	}
+	return frames
+}
+
+// https://en.wikipedia.org/wiki/ANI_(file_format)
+// RIFF('ACON' 'anih'(ANIHEADER) ['rate'(DWORD...)] ['seq '(DWORD...)] LIST('fram' 'icon'(ICO)...))
+func parseANI(data []byte) ([]Frame, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "ACON" {
+		return nil, errors.New("invalid ani header")
+	}
+
+	le := binary.LittleEndian
+
+	var icons [][]byte
+	var rate, seq []uint32
+	var dispRate uint32
+	var walk func(d []byte)
+	walk = func(d []byte) {
+		for len(d) >= 8 {
+			id, size := string(d[:4]), int(le.Uint32(d[4:8]))
+			if size < 0 || 8+size > len(d) {
+				size = len(d) - 8
+			}
+			chunk := d[8 : 8+size]
+			switch id {
+			case "anih":
+				if len(chunk) >= 32 {
+					dispRate = le.Uint32(chunk[28:32])
+				}
+			case "rate", "seq ":
+				var l []uint32
+				for i := 0; i+4 <= len(chunk); i += 4 {
+					l = append(l, le.Uint32(chunk[i:]))
+				}
+				if id == "rate" {
+					rate = l
+				} else {
+					seq = l
+				}
+			case "LIST":
+				if len(chunk) >= 4 && string(chunk[:4]) == "fram" {
+					walk(chunk[4:])
+				}
+			case "icon":
+				icons = append(icons, chunk)
+			}
+			// 块按2字节对齐
+			d = d[min(8+size+size&1, len(d)):]
+			if len(d) < 8 {
+				break
+			}
+		}
+	}
+	walk(data[12:])
+
+	if len(icons) <= 0 {
+		return nil, errors.New("no frames in ani")
+	}
+
+	// 没有seq时按顺序播放所有帧
+	if len(seq) <= 0 {
+		for i := range icons {
+			seq = append(seq, uint32(i))
 		}
-		pal := make([]color.RGBA, colors)
-		for i := 0; i < colors; i++ {
-			pal[i] = color.RGBA{d[i<<2+2], d[i<<2+1], d[i<<2], 0xFF} // RGBQUAD BGR
+	}
+
+	var frames []Frame
+	for step, n := range seq {
+		if int(n) >= len(icons) {
+			continue
 		}
-		retColors := []color.RGBA{pal[0], {0x00, 0xFF, 0x00, 0xFF}, pal[1], {0x00, 0x00, 0xFF, 0xFF}}
-		xorBits, andBits := d[(colors<<2):], d[(colors<<2)+(w*w>>3):]
-		for yy := h - 1; yy > 0; yy-- {
-			for xx := 0; xx < w; xx++ {
-				bmp.Set(xx, yy, retColors[f(xorBits, xx, yy, w, h)<<1|f(andBits, xx, yy, w, h)])
-			}
+		jiffies := dispRate
+		if step < len(rate) {
+			jiffies = rate[step]
 		}
-	}
 
-	return bmp
+		_, entries, d, err := parseICO(icons[n])
+		if err != nil {
+			return nil, err
+		}
+		// 1 jiffy = 1/60秒
+		frames = append(frames, entries2Frames(entries, d, step, time.Duration(jiffies)*time.Second/60)...)
+	}
+	return frames, nil
 }
 
-func res2ICO(w io.Writer, d []byte, cfg ...Config) error {
-	if isPNG(d) {
-		return IMG2ICO(w, bytes.NewReader(d), cfg...)
+// parseGIF composes every frame of a (possibly animated) GIF onto the logical screen
+// and encodes the results as PNG.
+func parseGIF(data []byte) ([]Frame, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
 
-	return img2ICO(w, zoomImg(res2BMP32(d), cfg...), cfg...)
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+
+	canvas := image.NewRGBA(bounds)
+	var frames []Frame
+	for i, p := range g.Image {
+		var prev *image.RGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			prev = image.NewRGBA(bounds)
+			copy(prev.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, p.Bounds(), p, p.Bounds().Min, draw.Over)
+
+		data, err := encodePNG(canvas)
+		if err != nil {
+			return nil, err
+		}
+
+		var delay time.Duration
+		if i < len(g.Delay) {
+			// 以1/100秒为单位
+			delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		frames = append(frames, Frame{
+			FrameIndex: i,
+			Width:      bounds.Dx(),
+			Height:     bounds.Dy(),
+			BitCount:   32,
+			Delay:      delay,
+			Data:       data,
+		})
+
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, p.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = prev
+			}
+		}
+	}
+	return frames, nil
 }
 
 func abs(x int) int {
@@ -854,111 +4265,719 @@ func abs(x int) int {
 }
 
 func writeICO(w io.Writer, id ICONDIR, entries []ICONDIRENTRY, d [][]byte, cfg ...Config) error {
+	// 只保留尺寸范围内的图标
+	if len(cfg) > 0 && (cfg[0].MinSize > 0 || cfg[0].MaxSize > 0) {
+		var ne []ICONDIRENTRY
+		var nd [][]byte
+		for i, e := range entries {
+			ws, hs := entrySize(e, d[i])
+			size := max(ws, hs)
+			if (cfg[0].MinSize > 0 && size < cfg[0].MinSize) || (cfg[0].MaxSize > 0 && size > cfg[0].MaxSize) {
+				continue
+			}
+			ne = append(ne, e)
+			nd = append(nd, d[i])
+		}
+		if len(ne) <= 0 {
+			return ErrNoIcon
+		}
+		entries, d = relocate(ne, nd), nd
+		id.Count = uint16(len(entries))
+	}
+
+	// 每一帧都要解码处理后重新编码成PNG（指定尺寸时在缩放后处理，png格式只处理输出的一帧）
+	if len(cfg) > 0 && hasTransform(cfg[0]) && (cfg[0].Width <= 0 || cfg[0].Height <= 0 || cfg[0].KeepAllFrames) && cfg[0].Format != "png" && cfg[0].Format != "jpeg" {
+		ne := make([]ICONDIRENTRY, len(entries))
+		nd := make([][]byte, len(d))
+		for i := range d {
+			img, err := decodeEntry(d[i])
+			if err != nil {
+				return err
+			}
+			img = transform(img, cfg...)
+
+			if nd[i], err = encodeFrame(img, cfg...); err != nil {
+				return err
+			}
+			if icc := pngChunk(d[i], "iCCP"); cfg[0].KeepICC && icc != nil && isPNG(nd[i]) {
+				nd[i] = addPNGChunk(nd[i], icc)
+			}
+			ne[i] = ICONDIRENTRY{IconCommon: IconCommon{
+				Width:      dirSize(img.Bounds().Dx()),
+				Height:     dirSize(img.Bounds().Dy()),
+				Planes:     1,
+				BitCount:   32,
+				BytesInRes: uint32(len(nd[i])),
+			}}
+		}
+		entries, d = relocate(ne, nd), nd
+	}
+
+	// 原样拷贝的PNG可能带有时间戳等元数据，需要去掉并重新计算偏移
+	if len(cfg) > 0 && cfg[0].Deterministic {
+		nd := make([][]byte, len(d))
+		ne := make([]ICONDIRENTRY, len(entries))
+		for i := range d {
+			nd[i] = stripPNGMeta(d[i])
+			ne[i] = entries[i]
+			ne[i].BytesInRes = uint32(len(nd[i]))
+		}
+		entries, d = relocate(ne, nd), nd
+	}
+
 	// 如果wh设置了，选择合适的单张图标
 	if len(cfg) > 0 && cfg[0].Width > 0 && cfg[0].Height > 0 {
 		var m, wdiff, hdiff, bm int
 		wdiff, hdiff = 0xFFFFF, 0xFFFFF
+		// 比目标大的图标中最接近的一个
+		l, ldiff := -1, 0xFFFFF
 		for i, e := range entries {
 			if e.BitCount >= uint16(bm) {
 				bm = int(e.BitCount)
-				var ws, hs int
-				if e.Width <= 0 || e.Height <= 0 { // 超过大小的一定是PNG的
-					img, _, _ := image.DecodeConfig(bytes.NewReader(d[i]))
-					ws, hs = img.Width, img.Height
-				} else {
-					ws, hs = int(e.Width), int(e.Height)
-				}
+				ws, hs := entrySize(e, d[i])
 				if abs(ws-cfg[0].Width) <= wdiff && abs(hs-cfg[0].Height) <= hdiff {
 					wdiff, hdiff = abs(ws-cfg[0].Width), abs(hs-cfg[0].Height)
 					m = i
 				}
+				if ws >= cfg[0].Width && hs >= cfg[0].Height && ws-cfg[0].Width+hs-cfg[0].Height <= ldiff {
+					ldiff = ws - cfg[0].Width + hs - cfg[0].Height
+					l = i
+				}
+			}
+		}
+
+		// 没有完全匹配的尺寸时，优先从大图缩小而不是放大小图
+		if cfg[0].PreferLarger && (wdiff > cfg[0].SizeTolerance || hdiff > cfg[0].SizeTolerance) && l >= 0 {
+			m = l
+		}
+		debugf(cfg, "fico: select frame %d/%d for %dx%d", m, len(entries), cfg[0].Width, cfg[0].Height)
+
+		// 保留所有帧，指定的尺寸只决定顺序
+		if cfg[0].KeepAllFrames && (cfg[0].Format == "" || cfg[0].Format == "ico") {
+			if cfg[0].EntryOrder != SourceOrder {
+				entries, d = sortEntries(entries, d, cfg[0].EntryOrder)
+			} else {
+				ne, nd := []ICONDIRENTRY{entries[m]}, [][]byte{d[m]}
+				for i := range entries {
+					if i != m {
+						ne, nd = append(ne, entries[i]), append(nd, d[i])
+					}
+				}
+				entries, d = relocate(ne, nd), nd
 			}
+			return writeShared(w, id, entries, d)
+		}
+
+		// 尺寸完全匹配（或相差在SizeTolerance以内）且输出ico时原样拷贝，保留原来的色深等信息，不重新编码成32位
+		if wdiff <= cfg[0].SizeTolerance && hdiff <= cfg[0].SizeTolerance && (cfg[0].Format == "" || cfg[0].Format == "ico") && !hasTransform(cfg[0]) {
+			entry := entries[m]
+			entry.Offset = uint32(6 + 16)
+			return writeICO(w, ICONDIR{Type: id.Type, Count: 1}, []ICONDIRENTRY{entry}, [][]byte{d[m]})
 		}
 
 		return res2ICO(w, d[m], cfg...)
 	}
 
-	// 没有设置，或者不是png格式
-	if len(cfg) <= 0 || cfg[0].Format != "png" {
-		err := binary.Write(w, binary.LittleEndian, id)
+	if len(cfg) > 0 && cfg[0].Format == "icns" {
+		return writeICNS(w, entries, d)
+	}
+
+	// 没有设置，或者不是png、jpeg格式
+	if len(cfg) <= 0 || (cfg[0].Format != "png" && cfg[0].Format != "jpeg") {
+		if len(cfg) > 0 && cfg[0].EntryOrder != SourceOrder {
+			entries, d = sortEntries(entries, d, cfg[0].EntryOrder)
+		}
+		return writeShared(w, id, entries, d)
+	}
+
+	// 如果是png、jpeg格式，且wh未设置那么选择色值最多里面像素最大的
+	m := bestEntry(entries, d)
+	debugf(cfg, "fico: select best frame %d/%d", m, len(entries))
+
+	if cfg[0].Format == "jpeg" {
+		img, err := decodeEntry(d[m])
+		if err != nil {
+			return err
+		}
+		return encodeJPEG(w, transform(img, cfg...), cfg[0])
+	}
+
+	// 位图和JPEG数据需要先转换成PNG
+	if !isPNG(d[m]) || hasTransform(cfg[0]) {
+		img, err := decodeEntry(d[m])
 		if err != nil {
 			return err
 		}
+		var icc []byte
+		if cfg[0].KeepICC {
+			icc = pngChunk(d[m], "iCCP")
+		}
+		return img2ICO(w, img, icc, cfg...)
+	}
 
-		for _, entry := range entries {
-			err = binary.Write(w, binary.LittleEndian, entry)
-			if err != nil {
-				return err
+	_, err := w.Write(d[m])
+	return err
+}
+
+// WriteRaw writes dir, entries and data back to back exactly as given, without any check or
+// selection: Reserved, Type, Count and the offsets are not fixed up, so nonstandard files can
+// be built on purpose, e.g. to test other parsers.
+func WriteRaw(w io.Writer, dir ICONDIR, entries []ICONDIRENTRY, data [][]byte) error {
+	err := binary.Write(w, binary.LittleEndian, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = binary.Write(w, binary.LittleEndian, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, d := range data {
+		_, err = w.Write(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeShared writes dir, entries and their data d like WriteRaw, with the offsets
+// recomputed so that entries whose data is the very same slice, e.g. an icon listed twice
+// in a PE group, point at a single copy of it.
+func writeShared(w io.Writer, dir ICONDIR, entries []ICONDIRENTRY, d [][]byte) error {
+	ne := make([]ICONDIRENTRY, len(entries))
+	var nd [][]byte
+	offset := 6 + len(entries)*16
+	for i := range entries {
+		ne[i] = entries[i]
+		j := 0
+		for j < i && !sameData(d[i], d[j]) {
+			j++
+		}
+		if j < i {
+			ne[i].Offset = ne[j].Offset
+			continue
+		}
+		ne[i].Offset = uint32(offset)
+		offset += len(d[i])
+		nd = append(nd, d[i])
+	}
+	return WriteRaw(w, dir, ne, nd)
+}
+
+// sameData reports whether a and b are the same bytes in memory, not just equal ones.
+func sameData(a, b []byte) bool {
+	return len(a) == len(b) && len(a) > 0 && &a[0] == &b[0]
+}
+
+// encodeJPEG flattens img onto Config.Background, as JPEG has no alpha, and encodes it
+// with Config.JPEGQuality.
+func encodeJPEG(w io.Writer, img image.Image, cfg Config) error {
+	bg := cfg.Background
+	if bg == nil {
+		bg = color.White
+	}
+	quality := cfg.JPEGQuality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: min(quality, 100)})
+}
+
+// transform runs Config.Transform on img, if any, then pads it to power-of-two sides if
+// Config.POT is set.
+func transform(img image.Image, cfg ...Config) image.Image {
+	if len(cfg) <= 0 || !hasTransform(cfg[0]) {
+		return img
+	}
+	if cfg[0].Transform != nil {
+		rgba := toRGBA(img)
+		img = cfg[0].Transform(rgba, rgba.Bounds().Size())
+	}
+	if cfg[0].Shape != ShapeNone {
+		img = clipShape(img, cfg[0].Shape, cfg[0].CornerRadius)
+	}
+	if cfg[0].POT {
+		img = padPOT(img)
+	}
+	return img
+}
+
+// clipShape returns a copy of img with everything outside shape made transparent. The
+// coverage of edge pixels is estimated with 4x4 samples so that the outline is smooth.
+func clipShape(img image.Image, shape Shape, radius int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	w, h := float64(b.Dx()), float64(b.Dy())
+
+	if radius <= 0 || radius > 50 {
+		radius = 20
+	}
+	// 圆角半径换算成以中心为原点、半宽半高为1的坐标
+	r := float64(radius) / 100 * min(w, h)
+	rx, ry := r/(w/2), r/(h/2)
+	inside := func(u, v float64) bool {
+		u, v = math.Abs(u), math.Abs(v)
+		switch shape {
+		case ShapeCircle:
+			return u*u+v*v <= 1
+		case ShapeSquircle:
+			return u*u*u*u*u+v*v*v*v*v <= 1
+		case ShapeRounded:
+			if u <= 1-rx || v <= 1-ry {
+				return u <= 1 && v <= 1
 			}
+			du, dv := (u-(1-rx))/rx, (v-(1-ry))/ry
+			return du*du+dv*dv <= 1
 		}
+		return true
+	}
 
-		for _, d := range d {
-			_, err = w.Write(d)
-			if err != nil {
-				return err
+	const n = 4
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := 0
+			for sy := 0; sy < n; sy++ {
+				for sx := 0; sx < n; sx++ {
+					u := (float64(x)+(float64(sx)+0.5)/n)/w*2 - 1
+					v := (float64(y)+(float64(sy)+0.5)/n)/h*2 - 1
+					if inside(u, v) {
+						c++
+					}
+				}
+			}
+			if c == n*n {
+				continue
+			}
+			// 预乘alpha的RGBA，四个通道按覆盖率同比缩小
+			p := dst.Pix[y*dst.Stride+x*4:][:4]
+			for i := range p {
+				p[i] = uint8(int(p[i]) * c / (n * n))
 			}
 		}
-		return nil
 	}
+	return dst
+}
+
+// physicalSize converts the logical Width and Height of cfg to pixels by DPIScale, e.g.
+// 32 at 1.5 to 48. DPIScale is cleared so that nested conversions don't scale again.
+func physicalSize(cfg []Config) []Config {
+	if len(cfg) <= 0 || cfg[0].DPIScale <= 0 {
+		return cfg
+	}
+	c := cfg[0]
+	c.Width = int(math.Round(float64(c.Width) * c.DPIScale))
+	c.Height = int(math.Round(float64(c.Height) * c.DPIScale))
+	c.DPIScale = 0
+	debugf(cfg, "fico: %dx%d logical at %g is %dx%d", cfg[0].Width, cfg[0].Height, cfg[0].DPIScale, c.Width, c.Height)
+	return []Config{c}
+}
+
+// hasTransform reports whether frames have to be decoded and processed by transform,
+// so they can't be copied as they are.
+func hasTransform(cfg Config) bool {
+	return cfg.Transform != nil || cfg.POT || cfg.LegacyBMP || cfg.Shape != ShapeNone
+}
+
+// encodeFrame encodes an ico frame as PNG, or as a 32-bit DIB with AND mask if
+// Config.LegacyBMP is set and both sides are smaller than 256.
+func encodeFrame(img image.Image, cfg ...Config) ([]byte, error) {
+	b := img.Bounds()
+	if len(cfg) > 0 && cfg[0].LegacyBMP && b.Dx() < 256 && b.Dy() < 256 {
+		threshold := cfg[0].MaskThreshold
+		if threshold == 0 {
+			threshold = 128
+		}
+		return encodeDIB(toRGBA(img), threshold), nil
+	}
+
+	return encodePNG(img)
+}
+
+// PNG编码的输出缓冲和编码器内部的缓冲（zlib等）都复用，减少高并发时的内存分配
+var (
+	pngBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	pngEncoder = png.Encoder{BufferPool: &pngEncoderPool{}}
+)
+
+type pngEncoderPool struct{ sync.Pool }
+
+func (p *pngEncoderPool) Get() *png.EncoderBuffer {
+	b, _ := p.Pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngEncoderPool) Put(b *png.EncoderBuffer) { p.Pool.Put(b) }
+
+// encodePNG encodes img as PNG using the pooled buffers. The returned slice is a copy the
+// caller owns.
+func encodePNG(img image.Image) ([]byte, error) {
+	buf := pngBufPool.Get().(*bytes.Buffer)
+	defer pngBufPool.Put(buf)
+	buf.Reset()
+	if err := pngEncoder.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// encodeDIB encodes img as the BITMAPINFOHEADER, bottom-up BGRA pixels and AND mask of an
+// ico entry.
+func encodeDIB(img *image.RGBA, threshold uint8) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	mask := andMask(img, threshold)
+
+	le := binary.LittleEndian
+	// BITMAPINFOHEADER，ico中的高度是颜色数据和AND掩码的总高度
+	b := make([]byte, 40, 40+w*h*4+len(mask))
+	le.PutUint32(b, 40)
+	le.PutUint32(b[4:], uint32(w))
+	le.PutUint32(b[8:], uint32(h*2))
+	le.PutUint16(b[12:], 1)
+	le.PutUint16(b[14:], 32)
+	le.PutUint32(b[20:], uint32(w*h*4+len(mask)))
+	min := img.Bounds().Min
+	for y := h - 1; y >= 0; y-- {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.RGBAAt(min.X+x, min.Y+y)).(color.NRGBA)
+			b = append(b, c.B, c.G, c.R, c.A)
+		}
+	}
+	return append(b, mask...)
+}
+
+// andMask builds the 1-bit AND mask of img, rows bottom-up and padded to 32 bits. Pixels
+// with alpha below threshold are transparent and have their bit set.
+func andMask(img *image.RGBA, threshold uint8) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	stride := (w + 31) / 32 * 4
+	mask := make([]byte, stride*h)
+	min := img.Bounds().Min
+	for y := 0; y < h; y++ {
+		row := mask[(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			if img.RGBAAt(min.X+x, min.Y+y).A < threshold {
+				row[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+	}
+	return mask
+}
+
+// padPOT centers img on a transparent canvas with both sides rounded up to a power of two.
+func padPOT(img image.Image) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	pw, ph := nextPOT(w), nextPOT(h)
+	if pw == w && ph == h {
+		return img
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, pw, ph))
+	x, y := (pw-w)>>1, (ph-h)>>1
+	draw.Draw(dst, image.Rect(x, y, x+w, y+h), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+func nextPOT(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// relocate sets the offsets of entries for their data d written one after another
+// behind the directory.
+func relocate(entries []ICONDIRENTRY, d [][]byte) []ICONDIRENTRY {
+	offset := 6 + len(entries)*16
+	for i := range entries {
+		entries[i].Offset = uint32(offset)
+		offset += len(d[i])
+	}
+	return entries
+}
+
+// sortEntries returns entries and their data reordered by order, with the offsets
+// recomputed. Entries that compare equal keep their relative order.
+func sortEntries(entries []ICONDIRENTRY, d [][]byte, order EntryOrder) ([]ICONDIRENTRY, [][]byte) {
+	idx := make([]int, len(entries))
+	area := make([]int, len(entries))
+	bc := make([]int, len(entries))
+	for i, e := range entries {
+		idx[i] = i
+		ws, hs := entrySize(e, d[i])
+		area[i] = ws * hs
+		// PNG图标目录中的色深可能是0
+		bc[i] = int(e.BitCount)
+		if bc[i] == 0 && (isPNG(d[i]) || isJPEG(d[i])) {
+			bc[i] = 32
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		i, j := idx[a], idx[b]
+		switch order {
+		case SizeAscending:
+			return area[i] < area[j]
+		case SizeDescending:
+			return area[i] > area[j]
+		case BitDepthFirst:
+			if bc[i] != bc[j] {
+				return bc[i] > bc[j]
+			}
+			return area[i] > area[j]
+		}
+		return false
+	})
+
+	ne := make([]ICONDIRENTRY, len(entries))
+	nd := make([][]byte, len(d))
+	for k, i := range idx {
+		ne[k], nd[k] = entries[i], d[i]
+	}
+	return relocate(ne, nd), nd
+}
 
-	// 如果是png格式，且wh未设置那么选择色值最多里面像素最大的
+// bestEntry returns the index of the largest frame among those with the highest bit count.
+func bestEntry(entries []ICONDIRENTRY, d [][]byte) int {
 	var m, wm, hm, bm int
 	for i, e := range entries {
 		if e.BitCount >= uint16(bm) {
 			bm = int(e.BitCount)
-			var ws, hs int
-			if e.Width <= 0 || e.Height <= 0 { // 超过大小的一定是PNG的
-				img, _, _ := image.DecodeConfig(bytes.NewReader(d[i]))
-				ws, hs = img.Width, img.Height
-			} else {
-				ws, hs = int(e.Width), int(e.Height)
-			}
+			ws, hs := entrySize(e, d[i])
 			if ws > wm && hs > hm {
 				wm, hm = ws, hs
 				m = i
 			}
 		}
 	}
+	return m
+}
 
-	_, err := w.Write(d[m])
-	return err
+// zoomImg scales srcImg to the size in cfg, if any. Some decoders return empty images for
+// malformed files, they are rejected with ErrEmptyImage.
+func zoomImg(srcImg image.Image, cfg ...Config) (*image.RGBA, error) {
+	if srcImg.Bounds().Dx() <= 0 || srcImg.Bounds().Dy() <= 0 {
+		return nil, ErrEmptyImage
+	}
+
+	// 未指定尺寸时不缩放
+	if len(cfg) <= 0 || cfg[0].Width <= 0 || cfg[0].Height <= 0 ||
+		cfg[0].Width == srcImg.Bounds().Dx() || cfg[0].Height == srcImg.Bounds().Dy() {
+		return toRGBA(srcImg), nil
+	}
+
+	// 差一两个像素的缩放看不出区别，反而会让图像变模糊
+	if tol := cfg[0].SizeTolerance; tol > 0 &&
+		abs(cfg[0].Width-srcImg.Bounds().Dx()) <= tol && abs(cfg[0].Height-srcImg.Bounds().Dy()) <= tol {
+		return toRGBA(srcImg), nil
+	}
+
+	return Scale(srcImg, cfg[0].Width, cfg[0].Height, func(o *scaleOptions) {
+		o.sharpen = cfg[0].Sharpen
+		o.edgeExtend = cfg[0].EdgeExtend
+	}), nil
 }
 
-func zoomImg(srcImg image.Image, cfg ...Config) *image.RGBA {
-	if len(cfg) > 0 && (cfg[0].Width == srcImg.Bounds().Dx() || cfg[0].Height == srcImg.Bounds().Dy()) {
-		switch srcImg := srcImg.(type) {
-		case (*image.RGBA):
-			return srcImg
-		default:
-			rgba := image.NewRGBA(srcImg.Bounds())
-			draw.Draw(rgba, rgba.Bounds(), srcImg, image.Point{0, 0}, draw.Src)
-			return rgba
-		}
+func toRGBA(srcImg image.Image) *image.RGBA {
+	switch srcImg := srcImg.(type) {
+	case (*image.RGBA):
+		return srcImg
+	default:
+		rgba := image.NewRGBA(srcImg.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), srcImg, srcImg.Bounds().Min, draw.Src)
+		return rgba
+	}
+}
+
+// ScaleOption customizes Scale.
+type ScaleOption func(*scaleOptions)
+
+type scaleOptions struct {
+	interp     draw.Interpolator
+	pad        color.Color
+	noUpscale  bool
+	sharpen    float64
+	edgeExtend bool
+}
+
+// WithInterpolator sets the resampling algorithm, draw.CatmullRom by default.
+func WithInterpolator(interp draw.Interpolator) ScaleOption {
+	return func(o *scaleOptions) {
+		o.interp = interp
+	}
+}
+
+// WithPadColor sets the color of the letterbox around the scaled image, transparent by default.
+func WithPadColor(c color.Color) ScaleOption {
+	return func(o *scaleOptions) {
+		o.pad = c
+	}
+}
+
+// NoUpscale keeps images smaller than the target at their size, centered on the canvas.
+func NoUpscale() ScaleOption {
+	return func(o *scaleOptions) {
+		o.noUpscale = true
+	}
+}
+
+// WithEdgeExtend fills the letterbox with a blurred, stretched copy of src instead of a color,
+// which suits non-square photos better than bars.
+func WithEdgeExtend() ScaleOption {
+	return func(o *scaleOptions) {
+		o.edgeExtend = true
+	}
+}
+
+// Scale resizes src to fit a w x h canvas keeping its aspect ratio, centered and letterboxed.
+// If w or h is not positive, src is returned unscaled.
+func Scale(src image.Image, w, h int, opts ...ScaleOption) *image.RGBA {
+	o := scaleOptions{interp: draw.CatmullRom}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if w <= 0 || h <= 0 {
+		return toRGBA(src)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if o.pad != nil {
+		draw.Draw(img, img.Bounds(), image.NewUniform(o.pad), image.Point{}, draw.Src)
 	}
 
-	// 计算目标图片的纵横比
-	srcRatio := float64(srcImg.Bounds().Dx()) / float64(srcImg.Bounds().Dy())
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= 0 || sh <= 0 {
+		return img
+	}
 
 	// 计算缩放后的宽度和高度
 	var width, height int
-	if srcRatio > float64(cfg[0].Width)/float64(cfg[0].Height) {
-		width = cfg[0].Width
-		height = int(float64(width) / srcRatio)
+	if o.noUpscale && sw <= w && sh <= h {
+		width, height = sw, sh
+	} else if sw*h > sh*w {
+		width = w
+		height = max(sh*w/sw, 1)
 	} else {
-		height = cfg[0].Height
-		width = int(float64(height) * srcRatio)
+		height = h
+		width = max(sw*h/sh, 1)
 	}
 
 	// 计算目标图片的起始位置
-	x := (cfg[0].Width - width) >> 1
-	y := (cfg[0].Height - height) >> 1
+	x := (w - width) >> 1
+	y := (h - height) >> 1
+
+	op := draw.Src
+	if o.edgeExtend && (width < w || height < h) {
+		edgeExtend(img, src)
+		op = draw.Over
+	}
 
-	// 使用nearest-neighbor算法缩放图像
 	resizedImg := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.CatmullRom.Scale(resizedImg, resizedImg.Bounds(), srcImg, srcImg.Bounds(), draw.Over, nil)
+	o.interp.Scale(resizedImg, resizedImg.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	if o.sharpen > 0 {
+		sharpen(resizedImg, o.sharpen)
+	}
 
 	// 将缩放后的图像绘制到目标图片上
-	img := image.NewRGBA(image.Rect(0, 0, cfg[0].Width, cfg[0].Height))
-	draw.Draw(img, image.Rect(x, y, x+width, y+height), resizedImg, image.Point{0, 0}, draw.Src)
+	draw.Draw(img, image.Rect(x, y, x+width, y+height), resizedImg, image.Point{0, 0}, op)
 	return img
 }
+
+// edgeExtend covers img with the center of src cropped to the aspect of img, blurred by
+// shrinking it to a tiny image and stretching it back.
+func edgeExtend(img *image.RGBA, src image.Image) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	// 按目标的宽高比裁剪源图的中间部分
+	crop := b
+	if sw*h > sh*w {
+		cw := max(sh*w/h, 1)
+		crop.Min.X += (sw - cw) >> 1
+		crop.Max.X = crop.Min.X + cw
+	} else {
+		ch := max(sw*h/w, 1)
+		crop.Min.Y += (sh - ch) >> 1
+		crop.Max.Y = crop.Min.Y + ch
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, max(w/16, 1), max(h/16, 1)))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), src, crop, draw.Src, nil)
+	draw.BiLinear.Scale(img, img.Bounds(), small, small.Bounds(), draw.Src, nil)
+}
+
+// 高斯模糊的卷积核（sigma=1）
+var gaussKernel = []float64{0.06136, 0.24477, 0.38774, 0.24477, 0.06136}
+
+// blurRGBA applies a separable gaussian blur to the premultiplied pixels of img.
+func blurRGBA(img *image.RGBA) []float64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	r := len(gaussKernel) >> 1
+
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v >= max {
+			return max - 1
+		}
+		return v
+	}
+
+	// 先横向再纵向
+	tmp := make([]float64, w*h*4)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for k, kv := range gaussKernel {
+				o := img.PixOffset(b.Min.X+clamp(x+k-r, w), b.Min.Y+y)
+				for c := 0; c < 4; c++ {
+					tmp[(y*w+x)*4+c] += kv * float64(img.Pix[o+c])
+				}
+			}
+		}
+	}
+
+	out := make([]float64, w*h*4)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for k, kv := range gaussKernel {
+				o := (clamp(y+k-r, h)*w + x) * 4
+				for c := 0; c < 4; c++ {
+					out[(y*w+x)*4+c] += kv * tmp[o+c]
+				}
+			}
+		}
+	}
+	return out
+}
+
+// sharpen applies an unsharp mask in place: v + amount*(v - blur(v)).
+func sharpen(img *image.RGBA, amount float64) {
+	blurred := blurRGBA(img)
+	b := img.Bounds()
+	w := b.Dx()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < w; x++ {
+			o := img.PixOffset(b.Min.X+x, b.Min.Y+y)
+			a := img.Pix[o+3]
+			// 只处理颜色通道，预乘的颜色值不能超过透明度
+			for c := 0; c < 3; c++ {
+				v := float64(img.Pix[o+c])
+				v += amount * (v - blurred[(y*w+x)*4+c])
+				img.Pix[o+c] = uint8(math.Max(0, math.Min(float64(a), math.Round(v))))
+			}
+		}
+	}
+}
@@ -0,0 +1,1202 @@
+package fico
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/appflight/apkparser"
+	"golang.org/x/image/bmp"
+)
+
+// testImage returns a w×h gradient with a transparent top-left pixel.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / max(w-1, 1)), uint8(y * 255 / max(h-1, 1)), 0x80, 0xFF})
+		}
+	}
+	img.Set(0, 0, color.RGBA{})
+	return img
+}
+
+func testPNG(t testing.TB, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testICO builds an ico with one PNG frame per size.
+func testICO(t testing.TB, sizes ...int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	iw := NewICOWriter(&buf)
+	for _, s := range sizes {
+		if err := iw.AddFrame(testImage(s, s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// parseICOFrames returns the frames of an ico, with the sizes read from the images.
+func parseICOFrames(d []byte) ([]Frame, error) {
+	_, entries, data, err := parseICO(d)
+	if err != nil {
+		return nil, err
+	}
+	return entries2Frames(entries, data, 0, 0), nil
+}
+
+// riffChunk encodes a RIFF chunk, padded to an even length.
+func riffChunk(id string, data []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestParseANIOddTrailingChunk(t *testing.T) {
+	// 最后一个块的长度是奇数，且没有填充字节
+	if _, err := parseANI([]byte("RIFF\x00\x00\x00\x00ACONicon\x01\x00\x00\x00X")); err == nil {
+		t.Fatal("expected an error for an ani without valid frames")
+	}
+
+	ico := testICO(t, 16)
+	anih := make([]byte, 36)
+	binary.LittleEndian.PutUint32(anih[28:], 6)
+	body := append([]byte("ACON"), riffChunk("anih", anih)...)
+	body = append(body, riffChunk("LIST", append([]byte("fram"), riffChunk("icon", ico)...))...)
+	body = append(body, "junk\x03\x00\x00\x00ab"...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+
+	frames, err := parseANI(append(data, body...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Width != 16 || frames[0].Delay.Milliseconds() != 100 {
+		t.Fatalf("unexpected frames %+v", frames)
+	}
+}
+
+// testDIB builds an icon DIB: a BITMAPINFOHEADER with the doubled height of icons, the
+// palette, the color bits and the AND mask, rows bottom-up as stored.
+func testDIB(bitCount, w, h int, palette, xor, and []byte) []byte {
+	le := binary.LittleEndian
+	d := le.AppendUint32(nil, 40)
+	d = le.AppendUint32(d, uint32(w))
+	d = le.AppendUint32(d, uint32(h*2))
+	d = le.AppendUint16(d, 1)
+	d = le.AppendUint16(d, uint16(bitCount))
+	d = append(d, make([]byte, 16)...)
+	d = le.AppendUint32(d, uint32(len(palette)/4))
+	d = le.AppendUint32(d, 0)
+	d = append(d, palette...)
+	d = append(d, xor...)
+	return append(d, and...)
+}
+
+func TestRes2BMP32MonochromeMaskStride(t *testing.T) {
+	// 宽20，每行4字节；AND掩码只有右半边置位
+	const w, h = 20, 20
+	stride := (w + 31) >> 5 << 2
+	xor := make([]byte, stride*h)
+	and := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			and[y*stride+x>>3] |= 0x80 >> (x & 7)
+		}
+	}
+	pal := []byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0}
+
+	img, err := res2BMP32(testDIB(1, w, h, pal, xor, and))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != w || img.Bounds().Dy() != h {
+		t.Fatalf("got bounds %v", img.Bounds())
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// XOR为0时，AND置位的像素用屏幕色（绿色）表示
+			want := color.RGBA{0, 0, 0, 0xFF}
+			if x >= w/2 {
+				want = color.RGBA{0, 0xFF, 0, 0xFF}
+			}
+			if c := img.RGBAAt(x, y); c != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, c, want)
+			}
+		}
+	}
+}
+
+func TestRes2BMP32PaddedRows(t *testing.T) {
+	// 宽20不是8的倍数，4位和8位的行尾都有填充
+	const w, h = 20, 20
+	pal := make([]byte, 16*4)
+	for i := 0; i < 16; i++ {
+		pal[i*4+2] = uint8(i * 16) // R
+	}
+	for _, bc := range []int{4, 8} {
+		stride := (w*bc + 31) >> 5 << 2
+		xor := make([]byte, stride*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				// 颜色序号是列号除以2，每行相同
+				i := uint8(x / 2)
+				if bc == 8 {
+					xor[y*stride+x] = i
+				} else if x&1 == 0 {
+					xor[y*stride+x>>1] |= i << 4
+				} else {
+					xor[y*stride+x>>1] |= i
+				}
+			}
+		}
+		and := make([]byte, (w+31)>>5<<2*h)
+
+		img, err := res2BMP32(testDIB(bc, w, h, pal, xor, and))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if c := img.RGBAAt(x, y); c.R != uint8(x/2*16) || c.A != 0xFF {
+					t.Fatalf("%dbpp: pixel (%d, %d) = %v", bc, x, y, c)
+				}
+			}
+		}
+	}
+}
+
+func TestTransformLargeFrameDirSize(t *testing.T) {
+	// 变换后边长超过255的帧在目录中记为0
+	grow := func(img *image.RGBA, size image.Point) image.Image {
+		return image.NewRGBA(image.Rect(0, 0, 300, 300))
+	}
+	cfg := Config{Transform: grow}
+
+	var out bytes.Buffer
+	if err := ICO2ICO(&out, bytes.NewReader(testICO(t, 16, 32)), cfg); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := IMG2ICO(&buf, bytes.NewReader(testPNG(t, 16, 16)), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range [][]byte{out.Bytes(), buf.Bytes()} {
+		_, entries, _, err := parseICO(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Width != 0 || e.Height != 0 {
+				t.Fatalf("entry size %dx%d, want 0x0", e.Width, e.Height)
+			}
+		}
+		if errs := VerifyICO(bytes.NewReader(d)); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+	}
+}
+
+type icnsElem struct {
+	typ  string
+	data []byte
+}
+
+// testICNS packs elems into an icns file.
+func testICNS(elems ...icnsElem) []byte {
+	be := binary.BigEndian
+	var body []byte
+	for _, e := range elems {
+		body = append(body, e.typ...)
+		body = be.AppendUint32(body, uint32(8+len(e.data)))
+		body = append(body, e.data...)
+	}
+	return append(be.AppendUint32([]byte("icns"), uint32(8+len(body))), body...)
+}
+
+func TestICNS2ICOIndex(t *testing.T) {
+	d := testICNS(
+		icnsElem{"icp4", testPNG(t, 16, 16)},
+		icnsElem{"ic07", testPNG(t, 128, 128)},
+		icnsElem{"ic08", testPNG(t, 256, 256)},
+	)
+	idx := func(i int) *int { return &i }
+
+	var all bytes.Buffer
+	if err := ICNS2ICO(&all, bytes.NewReader(d)); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(all.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	for i, want := range []int{16, 128, 256} {
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(d), Config{Index: idx(i)}); err != nil {
+			t.Fatal(err)
+		}
+		frames, err := parseICOFrames(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || frames[0].Width != want {
+			t.Fatalf("index %d: got %+v, want one %dpx frame", i, frames, want)
+		}
+	}
+
+	if err := ICNS2ICO(io.Discard, bytes.NewReader(d), Config{Index: idx(3)}); err == nil {
+		t.Fatal("expected an error for an index out of range")
+	}
+}
+
+func TestICNSHeaderLength(t *testing.T) {
+	d := testICNS(icnsElem{"ic07", testPNG(t, 128, 128)})
+
+	// 下载不完整：头部的长度比实际数据长
+	if err := ICNS2ICO(io.Discard, bytes.NewReader(d[:len(d)-10])); err == nil {
+		t.Fatal("expected an error for a truncated icns")
+	}
+
+	// 结尾有多余的数据：按头部的长度忽略掉
+	padded := append(append([]byte(nil), d...), bytes.Repeat([]byte{0xAB}, 37)...)
+	var buf bytes.Buffer
+	if err := ICNS2ICO(&buf, bytes.NewReader(padded)); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Width != 128 {
+		t.Fatalf("got %+v, want one 128px frame", frames)
+	}
+}
+
+func TestICOICNSRoundTrip(t *testing.T) {
+	// 24、48没有对应的icns尺寸，要放到最近的空位，不能丢掉
+	ico := testICO(t, 16, 24, 32, 48, 256)
+	var icnsBuf bytes.Buffer
+	if err := ICO2ICO(&icnsBuf, bytes.NewReader(ico), Config{Format: "icns"}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ICNS2ICO(&out, bytes.NewReader(icnsBuf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, f := range frames {
+		sizes = append(sizes, f.Width)
+	}
+	sort.Ints(sizes)
+	if want := []int{16, 32, 64, 128, 256}; !slices.Equal(sizes, want) {
+		t.Fatalf("got sizes %v, want %v", sizes, want)
+	}
+
+	// 尺寸比icns的空位多时返回错误
+	ico = testICO(t, 16, 20, 24, 32, 40, 48, 64, 256)
+	if err := ICO2ICO(io.Discard, bytes.NewReader(ico), Config{Format: "icns"}); err == nil {
+		t.Fatal("expected an error for more sizes than icns slots")
+	}
+}
+
+func TestICOToPNG(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.ico")
+	if err := os.WriteFile(path, testICO(t, 16, 32, 48), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, Config{Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatalf("output is not a png: %v", err)
+	}
+	if img.Bounds().Dx() != 48 {
+		t.Fatalf("got %v, want the 48px frame", img.Bounds())
+	}
+}
+
+func TestSharpen(t *testing.T) {
+	// 线性渐变的内部锐化后不变，台阶两侧的对比度增强
+	const w, h = 32, 8
+	ramp, step := image.NewRGBA(image.Rect(0, 0, w, h)), image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 8)
+			ramp.SetRGBA(x, y, color.RGBA{v, v, v, 0xFF})
+			v = 0x40
+			if x >= w/2 {
+				v = 0xC0
+			}
+			step.SetRGBA(x, y, color.RGBA{v, v, v, 0xFF})
+		}
+	}
+	sharpen(ramp, 1)
+	sharpen(step, 1)
+
+	for x := 4; x < w-4; x++ {
+		if c := ramp.RGBAAt(x, h/2); absDiff(c.R, uint8(x*8)) > 1 || c.A != 0xFF {
+			t.Fatalf("ramp pixel %d = %v, want %d", x, c, x*8)
+		}
+	}
+	if c := step.RGBAAt(w/2-1, h/2); c.R >= 0x40 {
+		t.Fatalf("dark side of the edge = %v, want darker than 0x40", c)
+	}
+	if c := step.RGBAAt(w/2, h/2); c.R <= 0xC0 {
+		t.Fatalf("bright side of the edge = %v, want brighter than 0xC0", c)
+	}
+	if c := step.RGBAAt(2, h/2); c.R != 0x40 {
+		t.Fatalf("flat area = %v, want unchanged", c)
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// solidICO builds an ico with one frame of a single color per size, in the given order.
+func solidICO(t *testing.T, sizes []int, colors []color.RGBA) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	iw := NewICOWriter(&buf)
+	for i, s := range sizes {
+		img := image.NewRGBA(image.Rect(0, 0, s, s))
+		draw.Draw(img, img.Bounds(), image.NewUniform(colors[i]), image.Point{}, draw.Src)
+		if err := iw.AddFrame(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPreferLarger(t *testing.T) {
+	// 32是红色，48是蓝色，按输出的颜色判断用的是哪一帧
+	red, blue := color.RGBA{0xFF, 0, 0, 0xFF}, color.RGBA{0, 0, 0xFF, 0xFF}
+	ascending := solidICO(t, []int{32, 48}, []color.RGBA{red, blue})
+	descending := solidICO(t, []int{48, 32}, []color.RGBA{blue, red})
+	for _, c := range []struct {
+		ico    []byte
+		size   int
+		prefer bool
+		want   color.RGBA
+	}{
+		{ascending, 38, false, red},
+		{ascending, 38, true, blue},
+		// 40与两者距离相同，不论顺序都用48缩小
+		{ascending, 40, true, blue},
+		{descending, 40, true, blue},
+	} {
+		var buf bytes.Buffer
+		if err := ICO2ICO(&buf, bytes.NewReader(c.ico), Config{Width: c.size, Height: c.size, PreferLarger: c.prefer, Format: "png"}); err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != c.size {
+			t.Fatalf("got %v, want %dpx", img.Bounds(), c.size)
+		}
+		if got := color.RGBAModel.Convert(img.At(c.size/2, c.size/2)); got != c.want {
+			t.Fatalf("%dpx, PreferLarger %v: got %v, want %v", c.size, c.prefer, got, c.want)
+		}
+	}
+}
+
+// icnsRLE compresses each plane with the run length encoding of 24-bit icns images.
+func icnsRLE(planes ...[]byte) []byte {
+	var b []byte
+	for _, p := range planes {
+		for i := 0; i < len(p); {
+			n := 1
+			for i+n < len(p) && p[i+n] == p[i] && n < 130 {
+				n++
+			}
+			if n >= 3 {
+				b = append(b, byte(n-3+0x80), p[i])
+			} else {
+				b = append(b, byte(n-1))
+				b = append(b, p[i:i+n]...)
+			}
+			i += n
+		}
+	}
+	return b
+}
+
+func TestICNSMasklessRGB(t *testing.T) {
+	// 三个通道各不相同，错位一个平面时颜色会变
+	plane := func(size int, v byte) []byte { return bytes.Repeat([]byte{v}, size*size) }
+	rgb := append(append(plane(16, 0x10), plane(16, 0x80)...), plane(16, 0xF0)...)
+	want := color.NRGBA{0x10, 0x80, 0xF0, 0xFF}
+	for _, c := range []struct {
+		name string
+		d    []byte
+		size int
+	}{
+		{"raw is32", rgb, 16},
+		{"rle il32", icnsRLE(plane(32, 0x10), plane(32, 0x80), plane(32, 0xF0)), 32},
+	} {
+		typ := map[int]string{16: "is32", 32: "il32"}[c.size]
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(testICNS(icnsElem{typ, c.d}))); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(d[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != c.size {
+			t.Fatalf("%s: got %v", c.name, img.Bounds())
+		}
+		if got := color.NRGBAModel.Convert(img.At(c.size/2, c.size/2)); got != want {
+			t.Fatalf("%s: got %v, want %v", c.name, got, want)
+		}
+	}
+}
+
+func TestICNSStraightAlpha(t *testing.T) {
+	// 半透明的(200,100,50)，按预乘保存再反预乘时颜色会变
+	plane := func(size int, v byte) []byte { return bytes.Repeat([]byte{v}, size*size) }
+	rgb := func(size int) []byte {
+		return append(append(plane(size, 200), plane(size, 100)...), plane(size, 50)...)
+	}
+	argb := func(size int) []byte {
+		return append([]byte("ARGB"), icnsRLE(plane(size, 128), plane(size, 200), plane(size, 100), plane(size, 50))...)
+	}
+	for _, c := range []struct {
+		name  string
+		elems []icnsElem
+	}{
+		{"is32+s8mk", []icnsElem{{"is32", rgb(16)}, {"s8mk", plane(16, 128)}}},
+		{"il32+l8mk", []icnsElem{{"il32", icnsRLE(plane(32, 200), plane(32, 100), plane(32, 50))}, {"l8mk", plane(32, 128)}}},
+		{"ic04", []icnsElem{{"ic04", argb(16)}}},
+		{"ic05", []icnsElem{{"ic05", argb(32)}}},
+	} {
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(testICNS(c.elems...))); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(d[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.NRGBAModel.Convert(img.At(8, 8)); got != (color.NRGBA{200, 100, 50, 128}) {
+			t.Fatalf("%s: got %v, want {200 100 50 128}", c.name, got)
+		}
+	}
+}
+
+// rawICO builds an ico from image data as given, the directory sizes read from the data.
+func rawICO(data ...[]byte) []byte {
+	var buf bytes.Buffer
+	entries := make([]ICONDIRENTRY, len(data))
+	offset := 6 + 16*len(data)
+	for i, d := range data {
+		w, h := entrySize(ICONDIRENTRY{}, d)
+		entries[i] = ICONDIRENTRY{IconCommon: IconCommon{Width: dirSize(w), Height: dirSize(h), Planes: 1, BitCount: 32, BytesInRes: uint32(len(d))}, Offset: uint32(offset)}
+		offset += len(d)
+	}
+	WriteRaw(&buf, ICONDIR{Type: 1, Count: uint16(len(data))}, entries, data)
+	return buf.Bytes()
+}
+
+func TestICOJPEGEntry(t *testing.T) {
+	var jb bytes.Buffer
+	if err := jpeg.Encode(&jb, testImage(48, 48), nil); err != nil {
+		t.Fatal(err)
+	}
+	ico := rawICO(testPNG(t, 16, 16), jb.Bytes())
+	path := filepath.Join(t.TempDir(), "jpeg.ico")
+	if err := os.WriteFile(path, ico, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	frames, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[1].Width != 48 || frames[1].Height != 48 {
+		t.Fatalf("got %+v, want a 48px jpeg frame", frames)
+	}
+
+	// 选中JPEG的一帧转换成png
+	var buf bytes.Buffer
+	if err := ICO2ICO(&buf, bytes.NewReader(ico), Config{Width: 48, Height: 48, Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := png.Decode(&buf); err != nil || img.Bounds().Dx() != 48 {
+		t.Fatalf("png output: %v", err)
+	}
+
+	// 按尺寸过滤后只剩JPEG的一帧
+	buf.Reset()
+	if err := ICO2ICO(&buf, bytes.NewReader(ico), Config{MinSize: 32}); err != nil {
+		t.Fatal(err)
+	}
+	if frames, err := parseICOFrames(buf.Bytes()); err != nil || len(frames) != 1 || frames[0].Width != 48 {
+		t.Fatalf("got %+v, %v", frames, err)
+	}
+}
+
+// pngChunkOf encodes a PNG chunk with its CRC.
+func pngChunkOf(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(append(b, typ...), data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+func TestDeterministic(t *testing.T) {
+	// 两个只有时间戳和注释不同的PNG
+	stamped := func(year uint16, comment string) []byte {
+		d := addPNGChunk(testPNG(t, 32, 32), pngChunkOf("tIME", append(binary.BigEndian.AppendUint16(nil, year), 1, 2, 3, 4, 5)))
+		return addPNGChunk(d, pngChunkOf("tEXt", []byte("Comment\x00"+comment)))
+	}
+	a, b := rawICO(stamped(2020, "a")), rawICO(stamped(2024, "b"))
+	var plain bytes.Buffer
+	if err := ICO2ICO(&plain, bytes.NewReader(a)); err != nil || !bytes.Contains(plain.Bytes(), []byte("tIME")) {
+		t.Fatalf("expected the timestamp to be copied by default: %v", err)
+	}
+
+	for _, cfg := range []Config{{Deterministic: true}, {Deterministic: true, Width: 32, Height: 32}, {Deterministic: true, Format: "png"}} {
+		var out [3]bytes.Buffer
+		for i, d := range [][]byte{a, a, b} {
+			if err := ICO2ICO(&out[i], bytes.NewReader(d), cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(out[0].Bytes(), out[1].Bytes()) || !bytes.Equal(out[0].Bytes(), out[2].Bytes()) {
+			t.Fatalf("%+v: outputs differ", cfg)
+		}
+		if bytes.Contains(out[0].Bytes(), []byte("tIME")) || bytes.Contains(out[0].Bytes(), []byte("tEXt")) {
+			t.Fatalf("%+v: metadata left in the output", cfg)
+		}
+	}
+}
+
+type zipFile struct {
+	name string
+	data []byte
+}
+
+// testZip builds a zip archive of entries, in the given order.
+func testZip(t *testing.T, entries ...zipFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fw, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAPKDensityDPI(t *testing.T) {
+	zr, err := apkparser.OpenZipReader(bytes.NewReader(testZip(t,
+		zipFile{"res/mipmap-anydpi-v26/ic_launcher.xml", []byte("<adaptive-icon/>")},
+		zipFile{"res/mipmap-hdpi-v4/ic_launcher.png", testPNG(t, 72, 72)},
+		zipFile{"res/mipmap-mdpi-v4/ic_launcher.png", testPNG(t, 48, 48)},
+		zipFile{"res/mipmap-xxxhdpi-v4/ic_launcher.png", testPNG(t, 192, 192)},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	for _, c := range []struct {
+		dpi  int
+		want string
+	}{
+		{0, "res/mipmap-xxxhdpi-v4/ic_launcher.png"},
+		{120, "res/mipmap-mdpi-v4/ic_launcher.png"},
+		{160, "res/mipmap-mdpi-v4/ic_launcher.png"},
+		// 200与mdpi、hdpi的距离相同，取密度高的
+		{200, "res/mipmap-hdpi-v4/ic_launcher.png"},
+		{480, "res/mipmap-xxxhdpi-v4/ic_launcher.png"},
+	} {
+		f := apkDensityFile(zr, "res/mipmap-xxxhdpi-v4/ic_launcher.png", Config{DPI: c.dpi})
+		if f == nil || f.Name != c.want {
+			t.Errorf("dpi %d: got %v, want %s", c.dpi, f, c.want)
+		}
+	}
+}
+
+func TestICNSSizeRange(t *testing.T) {
+	d := testICNS(
+		icnsElem{"icp4", testPNG(t, 16, 16)},
+		icnsElem{"icp5", testPNG(t, 32, 32)},
+		icnsElem{"icp6", testPNG(t, 64, 64)},
+		icnsElem{"ic07", testPNG(t, 128, 128)},
+		icnsElem{"ic08", testPNG(t, 256, 256)},
+		icnsElem{"ic09", testPNG(t, 512, 512)},
+	)
+	for _, c := range []struct {
+		min, max int
+		want     []int
+	}{
+		{0, 0, []int{16, 32, 64, 128, 256, 512}},
+		{32, 128, []int{32, 64, 128}},
+		{100, 0, []int{128, 256, 512}},
+		{0, 20, []int{16}},
+	} {
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(d), Config{MinSize: c.min, MaxSize: c.max}); err != nil {
+			t.Fatal(err)
+		}
+		frames, err := parseICOFrames(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sizes []int
+		for _, f := range frames {
+			sizes = append(sizes, f.Width)
+		}
+		sort.Ints(sizes)
+		if !slices.Equal(sizes, c.want) {
+			t.Fatalf("%d-%d: got %v, want %v", c.min, c.max, sizes, c.want)
+		}
+	}
+}
+
+func TestICNSOSTypeSizes(t *testing.T) {
+	plane := func(size int, v byte) []byte { return bytes.Repeat([]byte{v}, size*size) }
+	rle := func(size int) []byte { return icnsRLE(plane(size, 0x10), plane(size, 0x80), plane(size, 0xF0)) }
+	argb := func(size int) []byte {
+		return append([]byte("ARGB"), icnsRLE(plane(size, 0xFF), plane(size, 0x10), plane(size, 0x80), plane(size, 0xF0))...)
+	}
+	for _, c := range []struct {
+		elems []icnsElem
+		size  int
+	}{
+		{[]icnsElem{{"is32", rle(16)}, {"s8mk", plane(16, 0xFF)}}, 16},
+		{[]icnsElem{{"il32", rle(32)}, {"l8mk", plane(32, 0xFF)}}, 32},
+		{[]icnsElem{{"ih32", rle(48)}, {"h8mk", plane(48, 0xFF)}}, 48},
+		{[]icnsElem{{"it32", append(make([]byte, 4), rle(128)...)}, {"t8mk", plane(128, 0xFF)}}, 128},
+		{[]icnsElem{{"icp4", rle(16)}}, 16},
+		{[]icnsElem{{"icp5", rle(32)}}, 32},
+		{[]icnsElem{{"ic04", argb(16)}}, 16},
+		{[]icnsElem{{"ic05", argb(32)}}, 32},
+	} {
+		typ := c.elems[0].typ
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(testICNS(c.elems...))); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(d[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != c.size || img.Bounds().Dy() != c.size {
+			t.Fatalf("%s: got %v, want %dx%d", typ, img.Bounds(), c.size, c.size)
+		}
+		if got := color.NRGBAModel.Convert(img.At(c.size-1, c.size-1)); got != (color.NRGBA{0x10, 0x80, 0xF0, 0xFF}) {
+			t.Fatalf("%s: got %v", typ, got)
+		}
+	}
+}
+
+func TestF2ICOExtensionless(t *testing.T) {
+	dir := t.TempDir()
+	icon, text := filepath.Join(dir, "icon"), filepath.Join(dir, "Makefile")
+	os.WriteFile(icon, testPNG(t, 32, 32), 0o644)
+	os.WriteFile(text, []byte("all:\n\tgo build ./...\n"), 0o644)
+
+	// 没有扩展名时按内容识别
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, icon); err != nil {
+		t.Fatal(err)
+	}
+	if frames, err := parseICOFrames(buf.Bytes()); err != nil || len(frames) != 1 || frames[0].Width != 32 {
+		t.Fatalf("got %+v, %v", frames, err)
+	}
+	if err := F2ICO(io.Discard, text); err != ErrUnsupportedFormat {
+		t.Fatalf("got %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestRes2BMP32TopDown(t *testing.T) {
+	// 上半部分红色，下半部分蓝色，分别按从下往上和从上往下存储
+	const s = 16
+	red, blue := []byte{0, 0, 0xFF, 0xFF}, []byte{0xFF, 0, 0, 0xFF}
+	var bottomUp, topDown []byte
+	for y := 0; y < s; y++ {
+		top, bottom := red, blue
+		if y >= s/2 {
+			top, bottom = blue, red
+		}
+		topDown = append(topDown, bytes.Repeat(top, s)...)
+		bottomUp = append(bottomUp, bytes.Repeat(bottom, s)...)
+	}
+	and := make([]byte, 4*s)
+
+	td := testDIB(32, s, s, nil, topDown, and)
+	height := int32(-2 * s)
+	binary.LittleEndian.PutUint32(td[8:], uint32(height))
+	for name, d := range map[string][]byte{"bottom-up": testDIB(32, s, s, nil, bottomUp, and), "top-down": td} {
+		img, err := res2BMP32(d)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if img.Bounds().Dx() != s || img.Bounds().Dy() != s {
+			t.Fatalf("%s: got bounds %v", name, img.Bounds())
+		}
+		if c := img.RGBAAt(s/2, 0); c != (color.RGBA{0xFF, 0, 0, 0xFF}) {
+			t.Fatalf("%s: top pixel = %v, want red", name, c)
+		}
+		if c := img.RGBAAt(s/2, s-1); c != (color.RGBA{0, 0, 0xFF, 0xFF}) {
+			t.Fatalf("%s: bottom pixel = %v, want blue", name, c)
+		}
+	}
+}
+
+func TestLegacyBMPMask(t *testing.T) {
+	// 宽10，掩码每行按4字节对齐，从下往上存储
+	const s = 10
+	img := image.NewRGBA(image.Rect(0, 0, s, s))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0x20, 0x40, 0x60, 0xFF}), image.Point{}, draw.Src)
+	img.SetRGBA(0, 0, color.RGBA{})
+	img.SetRGBA(9, 0, color.RGBA{0, 0, 0, 127})
+	img.SetRGBA(8, s-1, color.RGBA{0, 0, 0, 50})
+
+	mask := func(top ...byte) []byte {
+		m := make([]byte, 4*s)
+		m[1] = 0x80 // 最下面一行的(8, 9)
+		copy(m[4*(s-1):], top)
+		return m
+	}
+	for _, c := range []struct {
+		threshold uint8
+		want      []byte
+	}{
+		{0, mask(0x80, 0x40)}, // 默认128
+		{100, mask(0x80, 0)},
+	} {
+		var buf bytes.Buffer
+		iw := NewICOWriter(&buf, Config{LegacyBMP: true, MaskThreshold: c.threshold})
+		if err := iw.AddFrame(img); err != nil {
+			t.Fatal(err)
+		}
+		if err := iw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, entries, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d) != 1 || isPNG(d[0]) || entries[0].BitCount != 32 {
+			t.Fatalf("threshold %d: got %+v, want a 32-bit DIB", c.threshold, entries)
+		}
+		if len(d[0]) != 40+s*s*4+len(c.want) || !bytes.Equal(d[0][40+s*s*4:], c.want) {
+			t.Fatalf("threshold %d: mask % x, want % x", c.threshold, d[0][40+s*s*4:], c.want)
+		}
+	}
+}
+
+func TestEmptyImage(t *testing.T) {
+	// 16x0的bmp，解码器返回空图
+	le := binary.LittleEndian
+	b := le.AppendUint32([]byte("BM"), 54)
+	b = le.AppendUint32(b, 0)
+	b = le.AppendUint32(b, 54)
+	b = le.AppendUint32(b, 40)
+	b = le.AppendUint32(b, 16)
+	b = le.AppendUint32(b, 0)
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint16(b, 24)
+	b = append(b, make([]byte, 24)...)
+
+	for _, cfg := range []Config{{}, {Width: 32, Height: 32}, {Format: "png"}} {
+		if err := IMG2ICO(io.Discard, bytes.NewReader(b), cfg); err != ErrEmptyImage {
+			t.Fatalf("%+v: got %v, want ErrEmptyImage", cfg, err)
+		}
+	}
+	if _, err := zoomImg(image.NewRGBA(image.Rect(0, 0, 0, 16)), Config{Width: 32, Height: 32}); err != ErrEmptyImage {
+		t.Fatalf("got %v, want ErrEmptyImage", err)
+	}
+}
+
+func TestAPKLauncherNamePriority(t *testing.T) {
+	// 同为最高密度时，完整的ic_launcher优先于排在前面的前景图层
+	zr, err := apkparser.OpenZipReader(bytes.NewReader(testZip(t,
+		zipFile{"res/mipmap-xxxhdpi-v4/ic_launcher_foreground.png", testPNG(t, 192, 192)},
+		zipFile{"res/mipmap-xxxhdpi-v4/ic_launcher_round.png", testPNG(t, 192, 192)},
+		zipFile{"res/mipmap-xxxhdpi-v4/ic_launcher.png", testPNG(t, 192, 192)},
+		zipFile{"res/mipmap-mdpi-v4/ic_launcher.png", testPNG(t, 48, 48)},
+		zipFile{"res/drawable-xxxhdpi/ic_launcher_background.png", testPNG(t, 192, 192)},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	if f := apkLauncherFile(zr); f == nil || f.Name != "res/mipmap-xxxhdpi-v4/ic_launcher.png" {
+		t.Fatalf("got %v, want res/mipmap-xxxhdpi-v4/ic_launcher.png", f)
+	}
+	// 只有图层时也能用
+	zr2, err := apkparser.OpenZipReader(bytes.NewReader(testZip(t,
+		zipFile{"res/mipmap-xxxhdpi-v4/ic_launcher_foreground.png", testPNG(t, 192, 192)},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr2.Close()
+	if f := apkLauncherFile(zr2); f == nil {
+		t.Fatal("expected the foreground layer when nothing else exists")
+	}
+}
+
+func TestSizeTolerance(t *testing.T) {
+	// 33与32只差一个像素，在容差内时不缩放
+	for _, c := range []struct {
+		tol, want int
+	}{{0, 32}, {1, 33}, {2, 33}} {
+		cfg := Config{Width: 32, Height: 32, SizeTolerance: c.tol}
+		var a, b bytes.Buffer
+		if err := IMG2ICO(&a, bytes.NewReader(testPNG(t, 33, 33)), cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := ICO2ICO(&b, bytes.NewReader(testICO(t, 16, 33, 64)), cfg); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range [][]byte{a.Bytes(), b.Bytes()} {
+			frames, err := parseICOFrames(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 1 || frames[0].Width != c.want {
+				t.Fatalf("tolerance %d: got %+v, want one %dpx frame", c.tol, frames, c.want)
+			}
+		}
+	}
+}
+
+func TestPerceptualHash(t *testing.T) {
+	// 随机灰度方块组成的图，近似的图是同一张加上噪点后缩小的版本
+	blocks := func(seed int64, size int, noise bool) []byte {
+		rnd := rand.New(rand.NewSource(seed))
+		var cells [9][9]uint8
+		for y := range cells {
+			for x := range cells[y] {
+				cells[y][x] = uint8(rnd.Intn(256))
+			}
+		}
+		img := image.NewRGBA(image.Rect(0, 0, 72, 72))
+		for y := 0; y < 72; y++ {
+			for x := 0; x < 72; x++ {
+				v := int(cells[y/8][x/8])
+				if noise && rnd.Intn(20) == 0 {
+					v = min(max(v+rnd.Intn(41)-20, 0), 255)
+				}
+				img.SetRGBA(x, y, color.RGBA{uint8(v), uint8(v), uint8(v), 0xFF})
+			}
+		}
+		var buf bytes.Buffer
+		png.Encode(&buf, Scale(img, size, size))
+		return buf.Bytes()
+	}
+	dir := t.TempDir()
+	hash := func(name string, d []byte) uint64 {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, d, 0o644)
+		h, err := PerceptualHash(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a := hash("a.png", blocks(1, 72, false))
+	near := hash("near.png", blocks(1, 48, true))
+	other := hash("other.png", blocks(2, 72, false))
+
+	if d := bits.OnesCount64(a ^ near); d > 10 {
+		t.Fatalf("near-identical images are %d bits apart", d)
+	}
+	if d := bits.OnesCount64(a ^ other); d <= 10 {
+		t.Fatalf("different images are only %d bits apart", d)
+	}
+}
+
+func TestShortDIB(t *testing.T) {
+	// 只有10字节，连位图头都不完整
+	d := []byte{40, 0, 0, 0, 16, 0, 0, 0, 32, 0}
+	if _, err := res2BMP32(d); err == nil {
+		t.Fatal("expected an error for a 10-byte DIB")
+	}
+	// 原样拷贝时不解码，需要解码的转换返回错误
+	ICO2ICO(io.Discard, bytes.NewReader(rawICO(d)))
+	for _, cfg := range []Config{{Width: 16, Height: 16}, {Format: "png"}} {
+		if err := ICO2ICO(io.Discard, bytes.NewReader(rawICO(d)), cfg); err == nil {
+			t.Fatalf("%+v: expected an error for a 10-byte DIB entry", cfg)
+		}
+	}
+}
+
+func BenchmarkIMG2ICO(b *testing.B) {
+	d := testPNG(b, 256, 256)
+	cfg := Config{Width: 64, Height: 64}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := IMG2ICO(io.Discard, bytes.NewReader(d), cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodePNG(b *testing.B) {
+	img := testImage(64, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encodePNG(img); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestICNSPNGMask(t *testing.T) {
+	// 不透明的32x32 PNG，同尺寸的l8mk是1/4的透明度
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xFF, 0x80, 0, 0xFF}), image.Point{}, draw.Src)
+	var pb bytes.Buffer
+	png.Encode(&pb, img)
+	d := testICNS(icnsElem{"icp5", pb.Bytes()}, icnsElem{"l8mk", bytes.Repeat([]byte{0x40}, 32*32)})
+
+	for _, c := range []struct {
+		mask bool
+		want uint8
+	}{{false, 0xFF}, {true, 0x40}} {
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(d), Config{PNGMask: c.mask}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, data, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 {
+			t.Fatalf("got %d frames, want 1", len(data))
+		}
+		out, err := png.Decode(bytes.NewReader(data[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.NRGBAModel.Convert(out.At(16, 16)).(color.NRGBA); got.A != c.want || got.R != 0xFF || got.G != 0x80 {
+			t.Fatalf("PNGMask %v: got %v, want alpha %#x", c.mask, got, c.want)
+		}
+	}
+}
+
+func TestICNSIcp6(t *testing.T) {
+	plane := func(v byte) []byte { return bytes.Repeat([]byte{v}, 64*64) }
+	argb := append([]byte("ARGB"), icnsRLE(plane(0xFF), plane(0x10), plane(0x80), plane(0xF0))...)
+	for _, c := range []struct {
+		name string
+		d    []byte
+	}{
+		{"png", testPNG(t, 64, 64)},
+		{"argb", argb},
+	} {
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(testICNS(icnsElem{"icp6", c.d}))); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(d[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+			t.Fatalf("%s: got %v, want 64x64", c.name, img.Bounds())
+		}
+	}
+}
+
+func TestF2ICOTee(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, testPNG(t, 48, 48), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := F2ICO(&want, path); err != nil {
+		t.Fatal(err)
+	}
+
+	var a, b bytes.Buffer
+	n, err := F2ICOTee([]io.Writer{&a, &b}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(want.Len()) {
+		t.Fatalf("got %d bytes, want %d", n, want.Len())
+	}
+	for _, w := range []*bytes.Buffer{&a, &b} {
+		if !bytes.Equal(w.Bytes(), want.Bytes()) {
+			t.Fatal("every writer should get the whole icon")
+		}
+	}
+}
+
+func TestRes2BMP32CoreHeader(t *testing.T) {
+	// 16色的OS/2图标：12字节的BITMAPCOREHEADER和3字节（BGR）的调色板项
+	const s = 16
+	le := binary.LittleEndian
+	d := le.AppendUint32(nil, 12)
+	d = le.AppendUint16(d, s)
+	d = le.AppendUint16(d, s*2)
+	d = le.AppendUint16(d, 1)
+	d = le.AppendUint16(d, 4)
+	pal := make([]byte, 16*3)
+	copy(pal[3:], []byte{0, 0, 0xFF, 0xFF, 0, 0}) // 1红，2蓝
+	d = append(d, pal...)
+	// 左半边红，右半边蓝；掩码只有最左一列透明
+	for y := 0; y < s; y++ {
+		d = append(d, bytes.Repeat([]byte{0x11}, s/4)...)
+		d = append(d, bytes.Repeat([]byte{0x22}, s/4)...)
+	}
+	for y := 0; y < s; y++ {
+		d = append(d, 0x80, 0, 0, 0)
+	}
+
+	img, err := res2BMP32(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != s || img.Bounds().Dy() != s {
+		t.Fatalf("got bounds %v", img.Bounds())
+	}
+	for _, c := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{}},
+		{1, 0, color.RGBA{0xFF, 0, 0, 0xFF}},
+		{s - 1, 0, color.RGBA{0, 0, 0xFF, 0xFF}},
+		{s - 1, s - 1, color.RGBA{0, 0, 0xFF, 0xFF}},
+	} {
+		if got := img.RGBAAt(c.x, c.y); got != c.want {
+			t.Fatalf("(%d, %d) = %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+}
+
+func TestTransparentColor(t *testing.T) {
+	// 24位bmp没有透明通道，左半边是品红的颜色键
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0, 0x80, 0, 0xFF}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 16, 32), image.NewUniform(color.RGBA{0xFF, 0, 0xFF, 0xFF}), image.Point{}, draw.Src)
+	var b bytes.Buffer
+	if err := bmp.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		key  color.Color
+		want uint8
+	}{{nil, 0xFF}, {color.RGBA{0xFF, 0, 0xFF, 0xFF}, 0}} {
+		var buf bytes.Buffer
+		if err := IMG2ICO(&buf, bytes.NewReader(b.Bytes()), Config{TransparentColor: c.key}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := png.Decode(bytes.NewReader(d[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, a := out.At(4, 16).RGBA(); uint8(a>>8) != c.want {
+			t.Fatalf("key %v: alpha %#x, want %#x", c.key, a>>8, c.want)
+		}
+		if got := color.NRGBAModel.Convert(out.At(28, 16)); got != (color.NRGBA{0, 0x80, 0, 0xFF}) {
+			t.Fatalf("key %v: got %v, want opaque green", c.key, got)
+		}
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, testPNG(t, 32, 32), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		format, mime string
+	}{
+		{"", "image/x-icon"},
+		{"png", "image/png"},
+		{"icns", "image/icns"},
+	} {
+		uri, err := DataURI(path, Config{Format: c.format})
+		if err != nil {
+			t.Fatalf("%q: %v", c.format, err)
+		}
+		if prefix := "data:" + c.mime + ";base64,"; !strings.HasPrefix(uri, prefix) {
+			t.Fatalf("%q: got %.40s, want %s", c.format, uri, prefix)
+		}
+	}
+}
@@ -6,13 +6,18 @@ require (
 	github.com/andrianbdn/iospng v0.0.0-20180730113000-dccef1992541
 	github.com/appflight/apkparser v1.0.1
 	github.com/cbeer/jpeg2000 v0.0.0-20200310160555-fbd1cc642f07
+	github.com/klauspost/compress v1.11.0
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
 	github.com/tmc/icns v0.0.0-20171229010138-5677fdfa7a3e
+	github.com/ulikunitz/xz v0.5.11
 	golang.org/x/image v0.15.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
 	github.com/appflight/androidbinary v1.0.3 // indirect
-	github.com/klauspost/compress v1.11.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/net v0.0.0-20211118161319-6a13c67c3ce4 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,148 @@
+package fico
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// https://wiki.osdev.org/ISO_9660
+const isoSectorSize = 2048
+
+type iso9660 struct {
+	r      io.ReaderAt
+	root   isoDirRecord
+	joliet bool // 文件名是UCS-2编码的Joliet扩展
+}
+
+type isoDirRecord struct {
+	Extent uint32
+	Size   uint32
+	IsDir  bool
+	Name   string
+}
+
+func openISO(r io.ReaderAt) (*iso9660, error) {
+	iso := &iso9660{r: r}
+	found := false
+	// 卷描述符从第16个扇区开始，以类型255结束
+	for sector := int64(16); sector < 16+64; sector++ {
+		vd := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(vd, sector*isoSectorSize); err != nil {
+			return nil, err
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, errors.New("invalid iso signature")
+		}
+
+		switch vd[0] {
+		case 1: // Primary Volume Descriptor
+			if !found {
+				iso.root, found = parseISODirRecord(vd[156:], false), true
+			}
+		case 2: // Supplementary Volume Descriptor，优先使用Joliet的长文件名
+			switch string(vd[88:91]) {
+			case "%/@", "%/C", "%/E":
+				iso.root, iso.joliet, found = parseISODirRecord(vd[156:], true), true, true
+			}
+		case 255:
+			if !found {
+				return nil, errors.New("no primary volume descriptor")
+			}
+			return iso, nil
+		}
+	}
+	if !found {
+		return nil, errors.New("no primary volume descriptor")
+	}
+	return iso, nil
+}
+
+func parseISODirRecord(b []byte, joliet bool) isoDirRecord {
+	le := binary.LittleEndian
+	rec := isoDirRecord{
+		Extent: le.Uint32(b[2:]),
+		Size:   le.Uint32(b[10:]),
+		IsDir:  b[25]&0x02 != 0,
+	}
+
+	n := int(b[32])
+	if 33+n > len(b) {
+		n = len(b) - 33
+	}
+	name := b[33 : 33+n]
+	if joliet && n != 1 {
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(name[i*2:])
+		}
+		rec.Name = string(utf16.Decode(u))
+	} else {
+		rec.Name = string(name)
+	}
+	// 去掉版本号和结尾的点，如"AUTORUN.INF;1"
+	if i := strings.IndexByte(rec.Name, ';'); i >= 0 {
+		rec.Name = rec.Name[:i]
+	}
+	rec.Name = strings.TrimSuffix(rec.Name, ".")
+	return rec
+}
+
+// readDir lists the records of a directory, without the "." and ".." entries.
+func (iso *iso9660) readDir(dir isoDirRecord) ([]isoDirRecord, error) {
+	if dir.Size > 16<<20 {
+		return nil, errors.New("iso directory too large")
+	}
+	d := make([]byte, dir.Size)
+	if _, err := iso.r.ReadAt(d, int64(dir.Extent)*isoSectorSize); err != nil {
+		return nil, err
+	}
+
+	var recs []isoDirRecord
+	for p := 0; p < len(d); {
+		l := int(d[p])
+		if l == 0 {
+			// 记录不会跨扇区，剩余部分填充为0
+			p = (p/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if l < 34 || p+l > len(d) {
+			return nil, errors.New("invalid iso directory record")
+		}
+		if nl := d[p+32]; nl != 1 || (d[p+33] != 0 && d[p+33] != 1) {
+			recs = append(recs, parseISODirRecord(d[p:p+l], iso.joliet))
+		}
+		p += l
+	}
+	return recs, nil
+}
+
+// open returns a reader for the file at name, a path relative to the root with "/" or "\"
+// separators, matched case-insensitively. File data is stored contiguously in an ISO.
+func (iso *iso9660) open(name string) (*io.SectionReader, error) {
+	cur := iso.root
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' })
+	for i, part := range parts {
+		recs, err := iso.readDir(cur)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, rec := range recs {
+			if strings.EqualFold(rec.Name, part) && rec.IsDir == (i < len(parts)-1) {
+				cur, found = rec, true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("file not found in iso: " + name)
+		}
+	}
+	if cur.IsDir {
+		return nil, errors.New("not a file in iso: " + name)
+	}
+	return io.NewSectionReader(iso.r, int64(cur.Extent)*isoSectorSize, int64(cur.Size)), nil
+}
@@ -0,0 +1,406 @@
+package fico
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// LZX是chm第1节（MSCompressed）的压缩格式，实现参考libmspack的lzxd.c
+// https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-patch/cc78752a-b4af-4eee-88cb-01f4d8a4c2bf
+const (
+	lzxFrameSize      = 32768
+	lzxNumChars       = 256
+	lzxMinMatch       = 2
+	lzxPrimaryLengths = 7
+	lzxLengthSymbols  = 249
+	lzxPretreeSymbols = 20
+	lzxAlignedSymbols = 8
+	lzxMaxBits        = 16
+
+	lzxBlockVerbatim     = 1
+	lzxBlockAligned      = 2
+	lzxBlockUncompressed = 3
+)
+
+// 窗口大小（15～21位）对应的位置槽数量
+var lzxPositionSlots = [...]int{30, 32, 34, 36, 38, 42, 50}
+
+var lzxExtraBits, lzxPositionBase [51]uint32
+
+func init() {
+	j := uint32(0)
+	for i := 0; i < len(lzxExtraBits)-1; i += 2 {
+		lzxExtraBits[i], lzxExtraBits[i+1] = j, j
+		if i != 0 && j < 17 {
+			j++
+		}
+	}
+	lzxExtraBits[len(lzxExtraBits)-1] = 17
+	for i := 1; i < len(lzxPositionBase); i++ {
+		lzxPositionBase[i] = lzxPositionBase[i-1] + 1<<lzxExtraBits[i-1]
+	}
+}
+
+// lzxHuffman is a canonical Huffman code, decoded one bit at a time.
+type lzxHuffman struct {
+	count [lzxMaxBits + 1]uint16
+	syms  []uint16
+}
+
+func (h *lzxHuffman) build(lens []uint8) {
+	h.count = [lzxMaxBits + 1]uint16{}
+	h.syms = h.syms[:0]
+	for l := 1; l <= lzxMaxBits; l++ {
+		for s, n := range lens {
+			if int(n) == l {
+				h.count[l]++
+				h.syms = append(h.syms, uint16(s))
+			}
+		}
+	}
+}
+
+type lzxDecoder struct {
+	in    []byte
+	pos   int
+	bits  uint64
+	nbits uint
+
+	slots      int
+	main       [lzxNumChars + 50*8]uint8
+	length     [lzxLengthSymbols]uint8
+	aligned    [lzxAlignedSymbols]uint8
+	mainTree   lzxHuffman
+	lengthTree lzxHuffman
+	alignTree  lzxHuffman
+
+	r          [3]uint32
+	headerRead bool
+	e8Size     int32
+	blockType  int
+	blockLen   int
+	remaining  int
+}
+
+func (d *lzxDecoder) readBits(n uint) (uint32, error) {
+	for d.nbits < n {
+		// 输入以16位小端字为单位，每个字从高位读起
+		var w uint64
+		if d.pos+2 <= len(d.in) {
+			w = uint64(binary.LittleEndian.Uint16(d.in[d.pos:]))
+		} else if d.pos >= len(d.in)+4 {
+			return 0, errors.New("lzx stream truncated")
+		}
+		d.pos += 2
+		d.bits = d.bits<<16 | w
+		d.nbits += 16
+	}
+	d.nbits -= n
+	return uint32(d.bits>>d.nbits) & (1<<n - 1), nil
+}
+
+func (d *lzxDecoder) decode(h *lzxHuffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= lzxMaxBits; l++ {
+		b, err := d.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		n := int(h.count[l])
+		if code-first < n {
+			return int(h.syms[index+code-first]), nil
+		}
+		index += n
+		first = (first + n) << 1
+		code <<= 1
+	}
+	return 0, errors.New("invalid lzx huffman code")
+}
+
+// readLengths reads the code lengths lens[first:last], delta coded against their
+// previous values through a pretree.
+func (d *lzxDecoder) readLengths(lens []uint8, first, last int) error {
+	var pre [lzxPretreeSymbols]uint8
+	for i := range pre {
+		n, err := d.readBits(4)
+		if err != nil {
+			return err
+		}
+		pre[i] = uint8(n)
+	}
+	var pt lzxHuffman
+	pt.build(pre[:])
+
+	for x := first; x < last; {
+		z, err := d.decode(&pt)
+		if err != nil {
+			return err
+		}
+		var run uint32
+		val := uint8(0)
+		switch z {
+		case 17:
+			run, err = d.readBits(4)
+			run += 4
+		case 18:
+			run, err = d.readBits(5)
+			run += 20
+		case 19:
+			run, err = d.readBits(1)
+			run += 4
+			if err == nil {
+				z, err = d.decode(&pt)
+				val = uint8((int(lens[x]) - z + 17) % 17)
+			}
+		default:
+			run, val = 1, uint8((int(lens[x])-z+17)%17)
+		}
+		if err != nil {
+			return err
+		}
+		for ; run > 0 && x < last; run-- {
+			lens[x] = val
+			x++
+		}
+	}
+	return nil
+}
+
+func (d *lzxDecoder) reset() {
+	d.r = [3]uint32{1, 1, 1}
+	d.headerRead = false
+	d.blockType, d.remaining = 0, 0
+	d.main = [len(d.main)]uint8{}
+	d.length = [lzxLengthSymbols]uint8{}
+}
+
+func (d *lzxDecoder) readBlockHeader() error {
+	// 上一个未压缩块的长度是奇数时有一个填充字节
+	if d.blockType == lzxBlockUncompressed && d.blockLen&1 != 0 {
+		d.pos++
+	}
+
+	if !d.headerRead {
+		// 重置后的第一个块前有E8转换的标志和文件大小
+		e8, err := d.readBits(1)
+		if err != nil {
+			return err
+		}
+		d.e8Size = 0
+		if e8 != 0 {
+			hi, _ := d.readBits(16)
+			lo, err := d.readBits(16)
+			if err != nil {
+				return err
+			}
+			d.e8Size = int32(hi<<16 | lo)
+		}
+		d.headerRead = true
+	}
+
+	typ, _ := d.readBits(3)
+	hi, _ := d.readBits(16)
+	lo, err := d.readBits(8)
+	if err != nil {
+		return err
+	}
+	d.blockType, d.blockLen = int(typ), int(hi<<8|lo)
+	d.remaining = d.blockLen
+	if d.blockLen == 0 {
+		return errors.New("invalid lzx block")
+	}
+
+	switch d.blockType {
+	case lzxBlockAligned:
+		for i := range d.aligned {
+			n, err := d.readBits(3)
+			if err != nil {
+				return err
+			}
+			d.aligned[i] = uint8(n)
+		}
+		d.alignTree.build(d.aligned[:])
+		fallthrough
+	case lzxBlockVerbatim:
+		n := lzxNumChars + d.slots<<3
+		if err := d.readLengths(d.main[:], 0, lzxNumChars); err != nil {
+			return err
+		}
+		if err := d.readLengths(d.main[:], lzxNumChars, n); err != nil {
+			return err
+		}
+		d.mainTree.build(d.main[:n])
+		if err := d.readLengths(d.length[:], 0, lzxLengthSymbols); err != nil {
+			return err
+		}
+		d.lengthTree.build(d.length[:])
+	case lzxBlockUncompressed:
+		// 对齐到16位（已对齐时跳过一整个字），然后是12字节的R0～R2
+		if d.nbits == 0 {
+			d.pos += 2
+		}
+		d.nbits = 0
+		if d.pos+12 > len(d.in) {
+			return errors.New("lzx stream truncated")
+		}
+		for i := range d.r {
+			d.r[i] = binary.LittleEndian.Uint32(d.in[d.pos+i*4:])
+		}
+		d.pos += 12
+	default:
+		return errors.New("invalid lzx block type")
+	}
+	return nil
+}
+
+// decodeMatch decodes a match whose main tree symbol is sym and returns its length
+// and offset.
+func (d *lzxDecoder) decodeMatch(sym int) (int, int, error) {
+	sym -= lzxNumChars
+	n := sym & 7
+	if n == lzxPrimaryLengths {
+		l, err := d.decode(&d.lengthTree)
+		if err != nil {
+			return 0, 0, err
+		}
+		n += l
+	}
+	n += lzxMinMatch
+
+	slot := sym >> 3
+	var off uint32
+	switch slot {
+	case 0:
+		off = d.r[0]
+	case 1, 2:
+		// 与R0交换
+		off = d.r[slot]
+		d.r[slot] = d.r[0]
+		d.r[0] = off
+	default:
+		extra := lzxExtraBits[slot]
+		off = lzxPositionBase[slot] - 2
+		if d.blockType == lzxBlockAligned && extra >= 3 {
+			if extra > 3 {
+				v, err := d.readBits(uint(extra - 3))
+				if err != nil {
+					return 0, 0, err
+				}
+				off += v << 3
+			}
+			a, err := d.decode(&d.alignTree)
+			if err != nil {
+				return 0, 0, err
+			}
+			off += uint32(a)
+		} else if extra > 0 {
+			v, err := d.readBits(uint(extra))
+			if err != nil {
+				return 0, 0, err
+			}
+			off += v
+		}
+		d.r[2], d.r[1], d.r[0] = d.r[1], d.r[0], off
+	}
+	return n, int(off), nil
+}
+
+// lzxDecompress decodes n bytes from in, an LZX stream starting at a reset point whose
+// position in the uncompressed data is offset. windowBits is the window size and
+// resetInterval the bytes between two resets of the decoder, a multiple of the frame size.
+func lzxDecompress(in []byte, windowBits uint, resetInterval int, offset int64, n int) ([]byte, error) {
+	if windowBits < 15 || windowBits > 21 || resetInterval <= 0 || resetInterval%lzxFrameSize != 0 || offset%lzxFrameSize != 0 {
+		return nil, errors.New("invalid lzx parameters")
+	}
+	d := &lzxDecoder{in: in, slots: lzxPositionSlots[windowBits-15]}
+
+	// win是解码的原始数据，匹配引用的是它；out是做过E8转换后的结果
+	win := make([]byte, 0, n+lzxFrameSize)
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		start := len(out)
+		if (offset+int64(start))%int64(resetInterval) == 0 {
+			if d.remaining != 0 {
+				return nil, errors.New("lzx block crosses a reset point")
+			}
+			d.reset()
+		}
+
+		end := min(start+lzxFrameSize, n)
+		for len(win) < end {
+			if d.remaining == 0 {
+				if err := d.readBlockHeader(); err != nil {
+					return nil, err
+				}
+			}
+			run := min(d.remaining, end-len(win))
+
+			if d.blockType == lzxBlockUncompressed {
+				if d.pos+run > len(d.in) {
+					return nil, errors.New("lzx stream truncated")
+				}
+				win = append(win, d.in[d.pos:d.pos+run]...)
+				d.pos += run
+				d.remaining -= run
+				continue
+			}
+
+			// 匹配可以越过帧的结尾，但不能越过块的结尾
+			target := len(win) + run
+			for len(win) < target {
+				sym, err := d.decode(&d.mainTree)
+				if err != nil {
+					return nil, err
+				}
+				if sym < lzxNumChars {
+					win = append(win, byte(sym))
+					continue
+				}
+				l, off, err := d.decodeMatch(sym)
+				if err != nil {
+					return nil, err
+				}
+				if off <= 0 || off > len(win) {
+					return nil, errors.New("invalid lzx match offset")
+				}
+				for i := 0; i < l; i++ {
+					win = append(win, win[len(win)-off])
+				}
+			}
+			if len(win)-target > d.remaining-run {
+				return nil, errors.New("lzx match crosses a block")
+			}
+			d.remaining -= len(win) - target + run
+		}
+
+		out = append(out, win[start:end]...)
+		if d.e8Size != 0 {
+			lzxE8(out[start:], offset+int64(start), d.e8Size)
+		}
+		// 每一帧结束后输入对齐到16位
+		d.nbits = 0
+	}
+	return out, nil
+}
+
+// lzxE8 reverts the translation of the relative addresses after x86 CALL (0xE8)
+// instructions into absolute ones, for a frame at pos in the uncompressed data.
+func lzxE8(b []byte, pos int64, size int32) {
+	le := binary.LittleEndian
+	for i := 0; i < len(b)-10; i++ {
+		if b[i] != 0xE8 {
+			continue
+		}
+		cur := int32(pos + int64(i))
+		abs := int32(le.Uint32(b[i+1:]))
+		if abs >= -cur && abs < size {
+			rel := abs + size
+			if abs >= 0 {
+				rel = abs - cur
+			}
+			le.PutUint32(b[i+1:], uint32(rel))
+		}
+		i += 4
+	}
+}
@@ -0,0 +1,665 @@
+package fico
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// peRes is a resource of a test PE, <typ>/<name>/<lang> with numeric IDs.
+type peRes struct {
+	typ, name, lang uint32
+	typName         string // 字符串名字的类型（如MUI），typ只用于区分
+	data            []byte
+	size            uint32 // 数据项中的大小，0为len(data)
+	rva             uint32 // 数据在其他节中时数据项的RVA，0为放在资源节中
+}
+
+type peSection struct {
+	name string
+	data []byte
+	code bool
+}
+
+type peOptions struct {
+	secName    string // 资源节的名字，默认.rsrc
+	dll        bool
+	subsystem  uint16 // 默认GUI
+	imageBase  uint32
+	pe64       bool
+	noResDir   bool        // 不在数据目录中登记资源节
+	noOptional bool        // 没有可选头（目标文件）
+	extra      []peSection // 资源节之前的其他节
+}
+
+const (
+	peFileAlign    = 0x200
+	peSectionAlign = 0x1000
+)
+
+// rsrcTree lays out the resource directory of res at base, the RVA of the section.
+func rsrcTree(res []peRes, base uint32) []byte {
+	tree := map[uint32]map[uint32]map[uint32]peRes{}
+	typNames := map[uint32]string{}
+	for _, r := range res {
+		if r.typName != "" {
+			typNames[r.typ] = r.typName
+		}
+		if tree[r.typ] == nil {
+			tree[r.typ] = map[uint32]map[uint32]peRes{}
+		}
+		if tree[r.typ][r.name] == nil {
+			tree[r.typ][r.name] = map[uint32]peRes{}
+		}
+		tree[r.typ][r.name][r.lang] = r
+	}
+	keys := func(m any) []uint32 {
+		var ks []uint32
+		switch m := m.(type) {
+		case map[uint32]map[uint32]map[uint32]peRes:
+			for k := range m {
+				ks = append(ks, k)
+			}
+		case map[uint32]map[uint32]peRes:
+			for k := range m {
+				ks = append(ks, k)
+			}
+		case map[uint32]peRes:
+			for k := range m {
+				ks = append(ks, k)
+			}
+		}
+		sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+		return ks
+	}
+	dirSize := func(n int) uint32 { return uint32(16 + 8*n) }
+
+	// 根目录、类型目录、名字目录、数据项、数据依次排列
+	off := dirSize(len(tree))
+	typeOff := map[uint32]uint32{}
+	for _, t := range keys(tree) {
+		typeOff[t] = off
+		off += dirSize(len(tree[t]))
+	}
+	nameOff := map[[2]uint32]uint32{}
+	for _, t := range keys(tree) {
+		for _, n := range keys(tree[t]) {
+			nameOff[[2]uint32{t, n}] = off
+			off += dirSize(len(tree[t][n]))
+		}
+	}
+	entryOff := map[[3]uint32]uint32{}
+	for _, t := range keys(tree) {
+		for _, n := range keys(tree[t]) {
+			for _, l := range keys(tree[t][n]) {
+				entryOff[[3]uint32{t, n, l}] = off
+				off += 16
+			}
+		}
+	}
+	strOff := map[uint32]uint32{}
+	for _, t := range keys(tree) {
+		if name, ok := typNames[t]; ok {
+			strOff[t] = off
+			off += uint32(2 + 2*len(name))
+		}
+	}
+	dataOff := map[[3]uint32]uint32{}
+	for _, t := range keys(tree) {
+		for _, n := range keys(tree[t]) {
+			for _, l := range keys(tree[t][n]) {
+				if tree[t][n][l].rva != 0 {
+					continue
+				}
+				off = (off + 3) &^ 3
+				dataOff[[3]uint32{t, n, l}] = off
+				off += uint32(len(tree[t][n][l].data))
+			}
+		}
+	}
+
+	le := binary.LittleEndian
+	b := make([]byte, off)
+	dir := func(o uint32, n int) { le.PutUint16(b[o+14:], uint16(n)) }
+	dir(0, len(tree))
+	for i, t := range keys(tree) {
+		le.PutUint32(b[16+8*i:], t)
+		if name, ok := typNames[t]; ok {
+			le.PutUint32(b[16+8*i:], strOff[t]|0x80000000)
+			le.PutUint16(b[strOff[t]:], uint16(len(name)))
+			for j, c := range name {
+				le.PutUint16(b[strOff[t]+2+2*uint32(j):], uint16(c))
+			}
+		}
+		le.PutUint32(b[20+8*i:], typeOff[t]|0x80000000)
+		dir(typeOff[t], len(tree[t]))
+		for j, n := range keys(tree[t]) {
+			no := nameOff[[2]uint32{t, n}]
+			le.PutUint32(b[typeOff[t]+16+8*uint32(j):], n)
+			le.PutUint32(b[typeOff[t]+20+8*uint32(j):], no|0x80000000)
+			dir(no, len(tree[t][n]))
+			for k, l := range keys(tree[t][n]) {
+				key := [3]uint32{t, n, l}
+				r := tree[t][n][l]
+				le.PutUint32(b[no+16+8*uint32(k):], l)
+				le.PutUint32(b[no+20+8*uint32(k):], entryOff[key])
+				rva, size := r.rva, r.size
+				if rva == 0 {
+					rva = base + dataOff[key]
+					copy(b[dataOff[key]:], r.data)
+				}
+				if size == 0 {
+					size = uint32(len(r.data))
+				}
+				le.PutUint32(b[entryOff[key]:], rva)
+				le.PutUint32(b[entryOff[key]+4:], size)
+			}
+		}
+	}
+	return b
+}
+
+// buildPE writes a PE (or, with noOptional, an object file) holding res in its resource
+// section, which comes after the extra sections.
+func buildPE(res []peRes, o peOptions) []byte {
+	if o.secName == "" {
+		o.secName = SECTION_RESOURCES
+	}
+	if o.subsystem == 0 {
+		o.subsystem = pe.IMAGE_SUBSYSTEM_WINDOWS_GUI
+	}
+	if o.imageBase == 0 {
+		o.imageBase = 0x400000
+	}
+
+	sections := append([]peSection(nil), o.extra...)
+	rsrcRVA := uint32(peSectionAlign * (1 + len(sections)))
+	rsrc := rsrcTree(res, rsrcRVA)
+	sections = append(sections, peSection{name: o.secName, data: rsrc})
+
+	optSize := 224
+	if o.pe64 {
+		optSize = 240
+	}
+	if o.noOptional {
+		optSize = 0
+	}
+	hdrSize := (0x40 + 4 + 20 + optSize + 40*len(sections) + peFileAlign - 1) / peFileAlign * peFileAlign
+	sizeImage := uint32(peSectionAlign * (1 + len(sections)))
+
+	var out bytes.Buffer
+	le := binary.LittleEndian
+	if !o.noOptional {
+		dos := make([]byte, 0x40)
+		copy(dos, "MZ")
+		le.PutUint32(dos[0x3C:], 0x40)
+		out.Write(dos)
+		out.WriteString("PE\x00\x00")
+	}
+
+	fh := pe.FileHeader{
+		Machine:              pe.IMAGE_FILE_MACHINE_I386,
+		NumberOfSections:     uint16(len(sections)),
+		SizeOfOptionalHeader: uint16(optSize),
+		Characteristics:      pe.IMAGE_FILE_EXECUTABLE_IMAGE | pe.IMAGE_FILE_32BIT_MACHINE,
+	}
+	if o.pe64 {
+		fh.Machine = pe.IMAGE_FILE_MACHINE_AMD64
+	}
+	if o.dll {
+		fh.Characteristics |= pe.IMAGE_FILE_DLL
+	}
+	binary.Write(&out, le, fh)
+
+	var dd [16]pe.DataDirectory
+	if !o.noResDir {
+		dd[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE] = pe.DataDirectory{VirtualAddress: rsrcRVA, Size: uint32(len(rsrc))}
+	}
+	switch {
+	case o.noOptional:
+	case o.pe64:
+		binary.Write(&out, le, pe.OptionalHeader64{
+			Magic: 0x20b, ImageBase: uint64(o.imageBase), SectionAlignment: peSectionAlign, FileAlignment: peFileAlign,
+			MajorOperatingSystemVersion: 4, MajorSubsystemVersion: 4, SizeOfImage: sizeImage, SizeOfHeaders: uint32(hdrSize),
+			Subsystem: o.subsystem, NumberOfRvaAndSizes: 16, DataDirectory: dd,
+		})
+	default:
+		binary.Write(&out, le, pe.OptionalHeader32{
+			Magic: 0x10b, ImageBase: o.imageBase, SectionAlignment: peSectionAlign, FileAlignment: peFileAlign,
+			MajorOperatingSystemVersion: 4, MajorSubsystemVersion: 4, SizeOfImage: sizeImage, SizeOfHeaders: uint32(hdrSize),
+			Subsystem: o.subsystem, NumberOfRvaAndSizes: 16, DataDirectory: dd,
+		})
+	}
+
+	raw := uint32(hdrSize)
+	if o.noOptional {
+		raw = uint32(20 + 40*len(sections))
+	}
+	var body []byte
+	for i, s := range sections {
+		var name [8]uint8
+		copy(name[:], s.name)
+		rawSize := uint32(len(s.data)+peFileAlign-1) / peFileAlign * peFileAlign
+		chars := uint32(pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ)
+		if s.code {
+			chars = pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ
+		}
+		binary.Write(&out, le, pe.SectionHeader32{
+			Name:             name,
+			VirtualSize:      uint32(len(s.data)),
+			VirtualAddress:   uint32(peSectionAlign * (1 + i)),
+			SizeOfRawData:    rawSize,
+			PointerToRawData: raw + uint32(len(body)),
+			Characteristics:  chars,
+		})
+		body = append(body, s.data...)
+		body = append(body, make([]byte, int(rawSize)-len(s.data))...)
+	}
+	if pad := int(raw) - out.Len(); pad > 0 {
+		out.Write(make([]byte, pad))
+	}
+	out.Write(body)
+	return out.Bytes()
+}
+
+type grpEntry struct {
+	w, h     uint8
+	bitCount uint16
+	size     uint32
+	id       uint16
+}
+
+// grpIcon encodes an RT_GROUP_ICON.
+func grpIcon(entries ...grpEntry) []byte {
+	le := binary.LittleEndian
+	b := le.AppendUint16(nil, 0)
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = append(b, e.w, e.h, 0, 0)
+		b = le.AppendUint16(b, 1)
+		b = le.AppendUint16(b, e.bitCount)
+		b = le.AppendUint32(b, e.size)
+		b = le.AppendUint16(b, e.id)
+	}
+	return b
+}
+
+// iconRes returns the RT_ICON resources of pngs, numbered from 1, and the RT_GROUP_ICON
+// 1 listing them.
+func iconRes(pngs ...[]byte) []peRes {
+	var res []peRes
+	var entries []grpEntry
+	for i, d := range pngs {
+		w, h := entrySize(ICONDIRENTRY{}, d)
+		res = append(res, peRes{typ: 3, name: uint32(i + 1), lang: 1033, data: d})
+		entries = append(entries, grpEntry{dirSize(w), dirSize(h), 32, uint32(len(d)), uint16(i + 1)})
+	}
+	return append(res, peRes{typ: 14, name: 1, lang: 1033, data: grpIcon(entries...)})
+}
+
+func writeTemp(t *testing.T, name string, d []byte) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, d, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPE2ICODuplicateIconID(t *testing.T) {
+	// 图标组中两个目录项引用同一个图标
+	small, big := testPNG(t, 16, 16), testPNG(t, 32, 32)
+	res := []peRes{
+		{typ: 3, name: 1, lang: 1033, data: small},
+		{typ: 3, name: 2, lang: 1033, data: big},
+		{typ: 14, name: 1, lang: 1033, data: grpIcon(
+			grpEntry{16, 16, 32, uint32(len(small)), 1},
+			grpEntry{32, 32, 32, uint32(len(big)), 2},
+			grpEntry{16, 16, 32, uint32(len(small)), 1},
+		)},
+	}
+	path := writeTemp(t, "dup.exe", buildPE(res, peOptions{}))
+
+	for _, raw := range []bool{false, true} {
+		var buf bytes.Buffer
+		var err error
+		if raw {
+			err = PE2ICORaw(&buf, path)
+		} else {
+			err = PE2ICO(&buf, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, entries, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("raw %v: got %d entries, want 3", raw, len(entries))
+		}
+		if entries[0].Offset != entries[2].Offset || !bytes.Equal(d[2], small) || !bytes.Equal(d[1], big) {
+			t.Fatalf("raw %v: duplicate entries don't share their data: %+v", raw, entries)
+		}
+		if want := 6 + 3*16 + len(small) + len(big); buf.Len() != want {
+			t.Fatalf("raw %v: got %d bytes, want %d", raw, buf.Len(), want)
+		}
+		if errs := VerifyICO(bytes.NewReader(buf.Bytes())); len(errs) > 0 {
+			t.Fatalf("raw %v: %v", raw, errs)
+		}
+	}
+}
+
+func TestPE2ICORedirectedToMUN(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"System32", "SystemResources", "Apps"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := []peSection{{name: ".text", data: []byte{0xC3}, code: true}}
+	mui := []peRes{{typ: 100, typName: "MUI", name: 1, lang: 0, data: []byte("MUI config")}}
+	mun := buildPE(iconRes(testPNG(t, 32, 32)), peOptions{dll: true})
+
+	// 系统文件是带MUI资源的存根，图标在SystemResources下只有资源的.mun中
+	stub := filepath.Join(root, "System32", "imageres.dll")
+	os.WriteFile(stub, buildPE(mui, peOptions{dll: true, extra: text}), 0o644)
+	os.WriteFile(filepath.Join(root, "SystemResources", "imageres.dll.mun"), mun, 0o644)
+
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, stub); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Width != 32 {
+		t.Fatalf("got %+v, want the 32px icon of the .mun", frames)
+	}
+	if ok, err := HasIcon(stub); !ok || err != nil {
+		t.Fatalf("HasIcon = %v, %v", ok, err)
+	}
+
+	// .mun本身就能直接转换
+	buf.Reset()
+	if err := F2ICO(&buf, filepath.Join(root, "SystemResources", "imageres.dll.mun")); err != nil {
+		t.Fatal(err)
+	}
+	if frames, err = parseICOFrames(buf.Bytes()); err != nil || len(frames) != 1 {
+		t.Fatalf("got %+v, %v", frames, err)
+	}
+
+	// 普通的没有图标的程序不去找同名的.mun
+	app := filepath.Join(root, "Apps", "tool.exe")
+	os.WriteFile(app, buildPE(nil, peOptions{extra: text}), 0o644)
+	os.WriteFile(app+".mun", mun, 0o644)
+	if err := F2ICO(io.Discard, app, Config{NoFallback: true}); err != ErrNoIcon {
+		t.Fatalf("got %v, want ErrNoIcon", err)
+	}
+}
+
+func TestPE2ICOResourceSectionName(t *testing.T) {
+	// 资源节不叫.rsrc，另有一个叫.rsrc的节里不是资源
+	junk := []peSection{{name: ".rsrc", data: bytes.Repeat([]byte{0xFF}, 64)}}
+	path := writeTemp(t, "a.exe", buildPE(iconRes(testPNG(t, 32, 32)), peOptions{secName: ".res2", extra: junk}))
+
+	var buf bytes.Buffer
+	if err := PE2ICO(&buf, path); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Width != 32 {
+		t.Fatalf("got %+v, want one 32px frame", frames)
+	}
+}
+
+func TestPE2ICOKeepDIBEntry(t *testing.T) {
+	// 8位的DIB图标，尺寸完全匹配时原样输出，保留色深
+	const s = 16
+	dib := testDIB(8, s, s, make([]byte, 256*4), bytes.Repeat([]byte{1}, s*s), make([]byte, 4*s))
+	big := testPNG(t, 32, 32)
+	res := []peRes{
+		{typ: 3, name: 1, lang: 1033, data: dib},
+		{typ: 3, name: 2, lang: 1033, data: big},
+		{typ: 14, name: 1, lang: 1033, data: grpIcon(
+			grpEntry{s, s, 8, uint32(len(dib)), 1},
+			grpEntry{32, 32, 32, uint32(len(big)), 2},
+		)},
+	}
+	path := writeTemp(t, "dib.exe", buildPE(res, peOptions{}))
+
+	var buf bytes.Buffer
+	if err := PE2ICO(&buf, path, Config{Width: s, Height: s}); err != nil {
+		t.Fatal(err)
+	}
+	_, entries, d, err := parseICO(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].BitCount != 8 || entries[0].Width != s || !bytes.Equal(d[0], dib) {
+		t.Fatalf("got %+v, want the 8-bit DIB entry unchanged", entries)
+	}
+
+	// 需要缩放时重新编码为32位
+	buf.Reset()
+	if err := PE2ICO(&buf, path, Config{Width: 24, Height: 24}); err != nil {
+		t.Fatal(err)
+	}
+	if _, entries, _, err = parseICO(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].BitCount != 32 || entries[0].Width != 24 {
+		t.Fatalf("got %+v, want a 32-bit 24px entry", entries)
+	}
+}
+
+func TestPE2ICOResourceOverrun(t *testing.T) {
+	// 第一个图标的数据项长度超出了资源节，跳过它
+	small, big := testPNG(t, 16, 16), testPNG(t, 32, 32)
+	res := iconRes(small, big)
+	res[0].size = 1 << 20
+	path := writeTemp(t, "overrun.exe", buildPE(res, peOptions{}))
+
+	for _, raw := range []bool{false, true} {
+		var buf bytes.Buffer
+		var err error
+		if raw {
+			err = PE2ICORaw(&buf, path)
+		} else {
+			err = PE2ICO(&buf, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, err := parseICOFrames(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || frames[0].Width != 32 {
+			t.Fatalf("raw %v: got %+v, want only the 32px icon", raw, frames)
+		}
+	}
+}
+
+func TestPE2ICOObjectFile(t *testing.T) {
+	// 目标文件没有可选头，不是可执行的映像，有资源也不转换
+	for _, res := range [][]peRes{nil, iconRes(testPNG(t, 32, 32))} {
+		path := writeTemp(t, "a.obj.dll", buildPE(res, peOptions{noOptional: true}))
+		if err := PE2ICO(io.Discard, path); err != ErrNoOptionalHeader {
+			t.Fatalf("got %v, want ErrNoOptionalHeader", err)
+		}
+		if err := PE2ICORaw(io.Discard, path); err != ErrNoOptionalHeader {
+			t.Fatalf("raw: got %v, want ErrNoOptionalHeader", err)
+		}
+	}
+}
+
+func TestPE2ICOLanguage(t *testing.T) {
+	// 每种语言的图标组都引用ID为1的图标，各语言的图标尺寸不同
+	langRes := func(langs map[uint32]int) []peRes {
+		var res []peRes
+		for lang, size := range langs {
+			d := testPNG(t, size, size)
+			res = append(res,
+				peRes{typ: 3, name: 1, lang: lang, data: d},
+				peRes{typ: 14, name: 1, lang: lang, data: grpIcon(grpEntry{uint8(size), uint8(size), 32, uint32(len(d)), 1})},
+			)
+		}
+		return res
+	}
+	all := writeTemp(t, "all.exe", buildPE(langRes(map[uint32]int{2052: 16, 0: 32, 1033: 48}), peOptions{}))
+	noNeutral := writeTemp(t, "en.exe", buildPE(langRes(map[uint32]int{2052: 16, 1033: 48}), peOptions{}))
+	zhOnly := writeTemp(t, "zh.exe", buildPE(langRes(map[uint32]int{2052: 16}), peOptions{}))
+
+	for _, c := range []struct {
+		path string
+		lang uint16
+		want int
+	}{
+		{all, 2052, 16},
+		{all, 1041, 32},       // 没有日语，用中性语言
+		{noNeutral, 1041, 48}, // 没有中性语言，用英语
+		{zhOnly, 1041, 16},    // 都没有，用第一个
+	} {
+		var buf bytes.Buffer
+		if err := PE2ICO(&buf, c.path, Config{Language: c.lang}); err != nil {
+			t.Fatal(err)
+		}
+		frames, err := parseICOFrames(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || frames[0].Width != c.want {
+			t.Fatalf("%s, language %d: got %+v, want %dpx", filepath.Base(c.path), c.lang, frames, c.want)
+		}
+	}
+
+	langs, err := PEIconLanguages(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := append([]uint16(nil), langs[1]...)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(langs) != 1 || len(got) != 3 || got[0] != 0 || got[1] != 1033 || got[2] != 2052 {
+		t.Fatalf("got languages %v", langs)
+	}
+}
+
+func TestPE2ICOLargePNG(t *testing.T) {
+	// 256和768的目录项宽高都记为0，按PNG头区分
+	path := writeTemp(t, "big.dll", buildPE(iconRes(testPNG(t, 768, 768), testPNG(t, 256, 256), testPNG(t, 32, 32)), peOptions{dll: true}))
+
+	frames, err := Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, f := range frames {
+		sizes = append(sizes, f.Width)
+	}
+	if len(sizes) != 3 || sizes[0] != 768 || sizes[1] != 256 || sizes[2] != 32 {
+		t.Fatalf("got sizes %v, want [768 256 32]", sizes)
+	}
+
+	for _, want := range []int{256, 768} {
+		var buf bytes.Buffer
+		if err := PE2ICO(&buf, path, Config{Width: want, Height: want}); err != nil {
+			t.Fatal(err)
+		}
+		frames, err := parseICOFrames(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || frames[0].Width != want {
+			t.Fatalf("got %+v, want one %dpx frame", frames, want)
+		}
+	}
+}
+
+func TestPE2ICONoFallback(t *testing.T) {
+	path := writeTemp(t, "noicon.exe", buildPE(nil, peOptions{}))
+
+	// 默认输出内置的默认图标
+	var buf bytes.Buffer
+	if err := PE2ICO(&buf, path); err != nil {
+		t.Fatal(err)
+	}
+	if frames, err := parseICOFrames(buf.Bytes()); err != nil || len(frames) == 0 {
+		t.Fatalf("got %+v, %v, want the default icon", frames, err)
+	}
+
+	if err := PE2ICO(io.Discard, path, Config{NoFallback: true}); err != ErrNoIcon {
+		t.Fatalf("got %v, want ErrNoIcon", err)
+	}
+	if err := F2ICO(io.Discard, path, Config{NoFallback: true}); err != ErrNoIcon {
+		t.Fatalf("F2ICO: got %v, want ErrNoIcon", err)
+	}
+}
+
+func TestPE2ICOKeepAllFrames(t *testing.T) {
+	pngs := [][]byte{testPNG(t, 16, 16), testPNG(t, 32, 32), testPNG(t, 48, 48)}
+	path := writeTemp(t, "frames.exe", buildPE(iconRes(pngs...), peOptions{}))
+
+	var buf bytes.Buffer
+	if err := PE2ICO(&buf, path, Config{Width: 32, Height: 32, KeepAllFrames: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, entries, d, err := parseICO(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 所有帧原样保留，最匹配的32放在最前面
+	if len(d) != 3 || !bytes.Equal(d[0], pngs[1]) || !bytes.Equal(d[1], pngs[0]) || !bytes.Equal(d[2], pngs[2]) {
+		t.Fatalf("got %+v, want the 32px frame first and all frames unchanged", entries)
+	}
+	if errs := VerifyICO(bytes.NewReader(buf.Bytes())); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	// 按EntryOrder排序
+	buf.Reset()
+	if err := PE2ICO(&buf, path, Config{Width: 32, Height: 32, KeepAllFrames: true, EntryOrder: SizeDescending}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, d, err = parseICO(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(d) != 3 || !bytes.Equal(d[0], pngs[2]) || !bytes.Equal(d[2], pngs[0]) {
+		t.Fatal("expected the frames from the largest to the smallest")
+	}
+}
+
+func TestPE2ICORelocatedDLL(t *testing.T) {
+	// 非默认基址的DLL，图标数据在另一个节（RVA 0x1000起）中，数据项只有RVA
+	icon := testPNG(t, 32, 32)
+	rdata := append(bytes.Repeat([]byte{0xCC}, 0x100), icon...)
+	res := []peRes{
+		{typ: 3, name: 1, lang: 1033, data: icon, rva: peSectionAlign + 0x100},
+		{typ: 14, name: 1, lang: 1033, data: grpIcon(grpEntry{32, 32, 32, uint32(len(icon)), 1})},
+	}
+	for _, pe64 := range []bool{false, true} {
+		path := writeTemp(t, "a.dll", buildPE(res, peOptions{dll: true, imageBase: 0x10000000, pe64: pe64, extra: []peSection{{name: ".rdata", data: rdata}}}))
+		var buf bytes.Buffer
+		if err := PE2ICO(&buf, path); err != nil {
+			t.Fatalf("pe64 %v: %v", pe64, err)
+		}
+		_, _, d, err := parseICO(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d) != 1 || !bytes.Equal(d[0], icon) {
+			t.Fatalf("pe64 %v: the icon should be read from .rdata", pe64)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package fico
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+// parseBPlistDict reads the top level dictionary of a binary property list, keeping only
+// the integer and string values; nested containers and other types are skipped.
+// https://opensource.apple.com/source/CF/CF-1153.18/CFBinaryPList.c
+func parseBPlistDict(d []byte) (map[string]any, error) {
+	be := binary.BigEndian
+	if len(d) < 8+32 || string(d[:8]) != "bplist00" {
+		return nil, errors.New("invalid bplist header")
+	}
+
+	// 结尾32字节：偏移量和对象引用的字节数、对象数、顶层对象、偏移表的位置
+	t := d[len(d)-32:]
+	offSize, refSize := int(t[6]), int(t[7])
+	num, top, table := be.Uint64(t[8:]), be.Uint64(t[16:]), be.Uint64(t[24:])
+	// 偏移表的位置来自文件，先检查它再做乘法和加法，避免溢出
+	if offSize < 1 || offSize > 8 || refSize < 1 || refSize > 8 || top >= num ||
+		num > uint64(len(d)) || table > uint64(len(d)-32) || num*uint64(offSize) > uint64(len(d)-32)-table {
+		return nil, errors.New("invalid bplist trailer")
+	}
+
+	readUint := func(b []byte) uint64 {
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v
+	}
+	offset := func(ref uint64) (int, bool) {
+		if ref >= num {
+			return 0, false
+		}
+		p := table + ref*uint64(offSize)
+		o := readUint(d[p : p+uint64(offSize)])
+		return int(o), o < table && o < uint64(len(d))
+	}
+	// 对象的长度小于15时在标记的低4位，否则紧跟一个整数对象
+	length := func(p int) (int, int, bool) {
+		n := int(d[p] & 0x0F)
+		p++
+		if n != 0x0F {
+			return n, p, true
+		}
+		if p >= len(d) || d[p]>>4 != 0x1 {
+			return 0, 0, false
+		}
+		s := 1 << (d[p] & 0x0F)
+		if s > 8 || p+1+s > len(d) {
+			return 0, 0, false
+		}
+		return int(readUint(d[p+1 : p+1+s])), p + 1 + s, true
+	}
+	object := func(ref uint64) (any, bool) {
+		p, ok := offset(ref)
+		if !ok {
+			return nil, false
+		}
+		switch d[p] >> 4 {
+		case 0x1: // 整数
+			s := 1 << (d[p] & 0x0F)
+			if s > 8 || p+1+s > len(d) {
+				return nil, false
+			}
+			return int64(readUint(d[p+1 : p+1+s])), true
+		case 0x5: // ASCII字符串
+			n, p, ok := length(p)
+			if !ok || n > len(d)-p {
+				return nil, false
+			}
+			return string(d[p : p+n]), true
+		case 0x6: // UTF-16字符串
+			n, p, ok := length(p)
+			if !ok || n > (len(d)-p)/2 {
+				return nil, false
+			}
+			u := make([]uint16, n)
+			for i := range u {
+				u[i] = be.Uint16(d[p+i*2:])
+			}
+			return string(utf16.Decode(u)), true
+		}
+		return nil, false
+	}
+
+	p, ok := offset(top)
+	if !ok || d[p]>>4 != 0xD {
+		return nil, errors.New("bplist top object is not a dictionary")
+	}
+	n, p, ok := length(p)
+	if !ok || n > (len(d)-p)/(2*refSize) {
+		return nil, errors.New("invalid bplist dictionary")
+	}
+
+	dict := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, kok := object(readUint(d[p+i*refSize : p+(i+1)*refSize]))
+		v, vok := object(readUint(d[p+(n+i)*refSize : p+(n+i+1)*refSize]))
+		if key, ok := k.(string); ok && kok && vok {
+			dict[key] = v
+		}
+	}
+	return dict, nil
+}
@@ -0,0 +1,77 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testBPlist writes a binary plist whose top object is a dictionary of the string keys and
+// the string or small integer values of kv, with 1-byte offsets and references.
+func testBPlist(kv ...any) []byte {
+	objs := [][]byte{nil}
+	dict := []byte{0xD0 | byte(len(kv)/2)}
+	var vals []byte
+	for i, v := range kv {
+		switch v := v.(type) {
+		case string:
+			objs = append(objs, append([]byte{0x50 | byte(len(v))}, v...))
+		case int:
+			objs = append(objs, []byte{0x10, byte(v)})
+		}
+		if i%2 == 0 {
+			dict = append(dict, byte(len(objs)-1))
+		} else {
+			vals = append(vals, byte(len(objs)-1))
+		}
+	}
+	objs[0] = append(dict, vals...)
+
+	d := []byte("bplist00")
+	var table []byte
+	for _, o := range objs {
+		table = append(table, byte(len(d)))
+		d = append(d, o...)
+	}
+	t := make([]byte, 32)
+	t[6], t[7] = 1, 1
+	binary.BigEndian.PutUint64(t[8:], uint64(len(objs)))
+	binary.BigEndian.PutUint64(t[24:], uint64(len(d)))
+	return append(append(d, table...), t...)
+}
+
+func TestBPlistDict(t *testing.T) {
+	dict, err := parseBPlistDict(testBPlist("primary", "ic09", "size", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dict["primary"] != "ic09" || dict["size"] != int64(64) {
+		t.Fatalf("got %v", dict)
+	}
+}
+
+func TestBPlistCorruptTrailer(t *testing.T) {
+	be := binary.BigEndian
+	for _, c := range []struct {
+		name  string
+		patch func(d []byte)
+	}{
+		// 偏移表位置接近2^64时，加上3个8字节的偏移量会溢出
+		{"table overflow", func(d []byte) { d[len(d)-26] = 8; be.PutUint64(d[len(d)-8:], 1<<64-8) }},
+		{"table past end", func(d []byte) { be.PutUint64(d[len(d)-8:], uint64(len(d))) }},
+		{"huge object count", func(d []byte) { be.PutUint64(d[len(d)-24:], 1<<62) }},
+		// 偏移表中的对象偏移在偏移表之后
+		{"object past table", func(d []byte) { d[len(d)-32-3] = 0xF0 }},
+	} {
+		d := testBPlist("primary", "ic09")
+		c.patch(d)
+		if _, err := parseBPlistDict(d); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+		// 通过icns的info元素也不能崩溃
+		var buf bytes.Buffer
+		if err := ICNS2ICO(&buf, bytes.NewReader(testICNS(icnsElem{"info", d}, icnsElem{"ic07", testPNG(t, 128, 128)}))); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package fico
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// rawPNG encodes an 8-bit PNG of the given color type from rows of raw samples, with the
+// extra chunks (PLTE, tRNS) placed before the image data.
+func rawPNG(w, h int, colorType byte, rows [][]byte, chunks ...pngChunkData) []byte {
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(w))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(h))
+	ihdr = append(ihdr, 8, colorType, 0, 0, 0)
+
+	var idat bytes.Buffer
+	zw := zlib.NewWriter(&idat)
+	for _, row := range rows {
+		zw.Write(append([]byte{0}, row...))
+	}
+	zw.Close()
+
+	d := appendPNGChunk([]byte("\x89PNG\r\n\x1a\n"), "IHDR", ihdr)
+	for _, c := range chunks {
+		d = appendPNGChunk(d, c.Type, c.Data)
+	}
+	d = appendPNGChunk(d, "IDAT", idat.Bytes())
+	return appendPNGChunk(d, "IEND", nil)
+}
+
+func TestPNGColorTypesTransparency(t *testing.T) {
+	// 8x8，左上角的4x4透明，右上角的4x4半透明（类型支持时），下半部分不透明
+	const n = 8
+	rows := func(samples func(class int) []byte) [][]byte {
+		var r [][]byte
+		for y := 0; y < n; y++ {
+			var row []byte
+			for x := 0; x < n; x++ {
+				class := 2
+				if y < n/2 {
+					class = x * 2 / n
+				}
+				row = append(row, samples(class)...)
+			}
+			r = append(r, row)
+		}
+		return r
+	}
+	for _, c := range []struct {
+		name      string
+		d         []byte
+		halfAlpha bool
+	}{
+		{"gray tRNS", rawPNG(n, n, 0, rows(func(c int) []byte { return []byte{[]byte{0, 0x80, 0x80}[c]} }),
+			pngChunkData{"tRNS", []byte{0, 0}}), false},
+		{"rgb tRNS", rawPNG(n, n, 2, rows(func(c int) []byte { return [][]byte{{0xFF, 0, 0xFF}, {0, 0x80, 0}, {0, 0x80, 0}}[c] }),
+			pngChunkData{"tRNS", []byte{0, 0xFF, 0, 0, 0, 0xFF}}), false},
+		{"palette tRNS", rawPNG(n, n, 3, rows(func(c int) []byte { return []byte{byte(c)} }),
+			pngChunkData{"PLTE", []byte{0xFF, 0, 0xFF, 0, 0x80, 0, 0, 0x80, 0}}, pngChunkData{"tRNS", []byte{0, 0x80}}), true},
+		{"gray alpha", rawPNG(n, n, 4, rows(func(c int) []byte { return [][]byte{{0, 0}, {0x80, 0x80}, {0x80, 0xFF}}[c] })), true},
+		{"rgba", rawPNG(n, n, 6, rows(func(c int) []byte { return [][]byte{{0, 0, 0, 0}, {0, 0x80, 0, 0x80}, {0, 0x80, 0, 0xFF}}[c] })), true},
+	} {
+		if _, err := png.Decode(bytes.NewReader(c.d)); err != nil {
+			t.Fatalf("%s: invalid test png: %v", c.name, err)
+		}
+		for _, cfg := range []Config{{}, {Width: 2 * n, Height: 2 * n}} {
+			var buf bytes.Buffer
+			if err := IMG2ICO(&buf, bytes.NewReader(c.d), cfg); err != nil {
+				t.Fatal(err)
+			}
+			_, _, d, err := parseICO(buf.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(d[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := img.Bounds().Dx()
+			at := func(x, y int) uint8 { return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).A }
+			if a := at(0, 0); a != 0 {
+				t.Fatalf("%s %dpx: transparent pixel has alpha %d", c.name, s, a)
+			}
+			if a := at(s-1, s-1); a != 0xFF {
+				t.Fatalf("%s %dpx: opaque pixel has alpha %d", c.name, s, a)
+			}
+			if a := at(s-1, 0); c.halfAlpha && a != 0x80 {
+				t.Fatalf("%s %dpx: half transparent pixel has alpha %d", c.name, s, a)
+			}
+		}
+	}
+}
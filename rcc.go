@@ -0,0 +1,228 @@
+package fico
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image/png"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// rcc是Qt编译后的资源文件：头部、节点树、名字表和数据区，整数都是大端
+// https://github.com/qt/qtbase/blob/dev/src/tools/rcc/rcc.cpp
+const (
+	rccCompressed     = 0x01 // qCompress：4字节原始长度加zlib数据
+	rccDirectory      = 0x02
+	rccCompressedZstd = 0x04
+)
+
+type rccFile struct {
+	flags  uint16
+	offset uint32 // 相对于数据区
+}
+
+type rcc struct {
+	r     io.ReaderAt
+	data  int64
+	files map[string]rccFile
+}
+
+// rcc中文件数和目录深度的上限，防止损坏的文件导致死循环
+const (
+	maxRCCFiles = 1 << 16
+	maxRCCDepth = 32
+)
+
+func openRCC(r io.ReaderAt) (*rcc, error) {
+	be := binary.BigEndian
+	var hdr [20]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	if string(hdr[:4]) != "qres" {
+		return nil, errors.New("invalid rcc signature")
+	}
+	version := be.Uint32(hdr[4:])
+	if version < 1 || version > 3 {
+		return nil, errors.New("unsupported rcc version")
+	}
+	tree, names := int64(be.Uint32(hdr[8:])), int64(be.Uint32(hdr[16:]))
+	// 版本2起每个节点多了8字节的修改时间
+	nodeSize := int64(14)
+	if version >= 2 {
+		nodeSize = 22
+	}
+
+	c := &rcc{r: r, data: int64(be.Uint32(hdr[12:])), files: make(map[string]rccFile)}
+	name := func(off uint32) (string, error) {
+		var b [6]byte
+		if _, err := r.ReadAt(b[:], names+int64(off)); err != nil {
+			return "", err
+		}
+		// 长度（UTF-16字符数）、哈希、UTF-16BE的名字
+		u := make([]byte, int(be.Uint16(b[:]))*2)
+		if _, err := r.ReadAt(u, names+int64(off)+6); err != nil {
+			return "", err
+		}
+		s := make([]uint16, len(u)/2)
+		for i := range s {
+			s[i] = be.Uint16(u[i*2:])
+		}
+		return string(utf16.Decode(s)), nil
+	}
+
+	// 每个目录只能出现一次，多个目录共用同一段子节点会让遍历的节点数指数增长
+	visited := make(map[uint32]bool)
+	nodes := 0
+	var walk func(idx uint32, dir string, depth int) error
+	walk = func(idx uint32, dir string, depth int) error {
+		if visited[idx] {
+			return errors.New("invalid rcc tree")
+		}
+		visited[idx] = true
+
+		var n [14]byte
+		if _, err := r.ReadAt(n[:], tree+int64(idx)*nodeSize); err != nil {
+			return err
+		}
+		flags := be.Uint16(n[4:])
+		if flags&rccDirectory == 0 {
+			return errors.New("rcc node is not a directory")
+		}
+		count, child := be.Uint32(n[6:]), be.Uint32(n[10:])
+		// 子节点总是排在父节点之后，否则是损坏的文件
+		if depth > maxRCCDepth || child <= idx || count > maxRCCFiles {
+			return errors.New("invalid rcc tree")
+		}
+		for i := child; i < child+count; i++ {
+			// 所有访问过的节点都计入上限
+			if nodes++; nodes > maxRCCFiles {
+				return errors.New("too many files in rcc")
+			}
+			if _, err := r.ReadAt(n[:], tree+int64(i)*nodeSize); err != nil {
+				return err
+			}
+			s, err := name(be.Uint32(n[:]))
+			if err != nil {
+				return err
+			}
+			if f := be.Uint16(n[4:]); f&rccDirectory != 0 {
+				if err = walk(i, dir+s+"/", depth+1); err != nil {
+					return err
+				}
+			} else {
+				c.files[dir+s] = rccFile{flags: f, offset: be.Uint32(n[10:])}
+			}
+		}
+		return nil
+	}
+	if err := walk(0, "", 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *rcc) readFile(name string) ([]byte, error) {
+	f, ok := c.files[name]
+	if !ok {
+		return nil, errors.New("no " + name + " in rcc")
+	}
+	var b [4]byte
+	if _, err := c.r.ReadAt(b[:], c.data+int64(f.offset)); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(b[:])
+	if size > maxAPKIconSize {
+		return nil, errors.New(name + " too large in rcc")
+	}
+	d := make([]byte, size)
+	if _, err := c.r.ReadAt(d, c.data+int64(f.offset)+4); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case f.flags&rccCompressedZstd != 0:
+		return nil, errors.New("unsupported rcc compression")
+	case f.flags&rccCompressed != 0:
+		if len(d) < 4 {
+			return nil, errors.New("invalid rcc compressed data")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(d[4:]))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		if d, err = io.ReadAll(io.LimitReader(zr, maxAPKIconSize+1)); err != nil {
+			return nil, err
+		}
+		if len(d) > maxAPKIconSize {
+			return nil, errors.New(name + " too large in rcc")
+		}
+	}
+	return d, nil
+}
+
+// rccIcon returns the icon of a Qt resource file: the largest png or ico whose name contains
+// "icon" (or else "logo"), e.g. :/icons/app.png. SVG icons are not decodable and skipped.
+func rccIcon(r io.ReaderAt) ([]byte, error) {
+	c, err := openRCC(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var best []byte
+	bp, ba := 0, 0
+	// map的遍历顺序是随机的，排序后保证相同的文件结果一致
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		prio := 0
+		if strings.Contains(lower, "icon") {
+			prio = 2
+		} else if strings.Contains(lower, "logo") {
+			prio = 1
+		}
+		ext := path.Ext(lower)
+		if prio == 0 || prio < bp || (ext != ".png" && ext != ".ico") {
+			continue
+		}
+
+		d, err := c.readFile(name)
+		if err != nil {
+			continue
+		}
+		area := 0
+		if ext == ".png" {
+			img, err := png.DecodeConfig(bytes.NewReader(d))
+			if err != nil {
+				continue
+			}
+			area = img.Width * img.Height
+		} else {
+			_, entries, ed, err := parseICO(d)
+			if err != nil {
+				continue
+			}
+			for i, e := range entries {
+				w, h := entrySize(e, ed[i])
+				area = max(area, w*h)
+			}
+		}
+		if prio > bp || area > ba {
+			best, bp, ba = d, prio, area
+		}
+	}
+	if best == nil {
+		return nil, ErrNoIcon
+	}
+	return best, nil
+}
@@ -0,0 +1,111 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+	"unicode/utf16"
+)
+
+type rccNode struct {
+	name         string
+	dir          bool
+	count, child uint32 // 目录的子节点
+	data         []byte // 文件内容
+}
+
+// buildRCC writes a version 2 rcc holding nodes as given, the first one being the root.
+func buildRCC(nodes []rccNode) []byte {
+	be := binary.BigEndian
+	var tree, data, names []byte
+	for i, n := range nodes {
+		no := uint32(0)
+		if i > 0 {
+			no = uint32(len(names))
+			u := utf16.Encode([]rune(n.name))
+			names = be.AppendUint16(names, uint16(len(u)))
+			names = be.AppendUint32(names, 0)
+			for _, c := range u {
+				names = be.AppendUint16(names, c)
+			}
+		}
+		tree = be.AppendUint32(tree, no)
+		if n.dir {
+			tree = be.AppendUint16(tree, rccDirectory)
+			tree = be.AppendUint32(tree, n.count)
+			tree = be.AppendUint32(tree, n.child)
+		} else {
+			tree = be.AppendUint16(tree, 0)
+			tree = be.AppendUint32(tree, 0)
+			tree = be.AppendUint32(tree, uint32(len(data)))
+			data = be.AppendUint32(data, uint32(len(n.data)))
+			data = append(data, n.data...)
+		}
+		tree = append(tree, make([]byte, 8)...)
+	}
+
+	hdr := append([]byte("qres"), be.AppendUint32(nil, 2)...)
+	hdr = be.AppendUint32(hdr, 20)
+	hdr = be.AppendUint32(hdr, uint32(20+len(tree)))
+	hdr = be.AppendUint32(hdr, uint32(20+len(tree)+len(data)))
+	return append(append(append(hdr, tree...), data...), names...)
+}
+
+// rccTree lays tree out breadth first as rcc does, the values being file contents
+// ([]byte) or subdirectories (map[string]any).
+func rccTree(tree map[string]any) []rccNode {
+	nodes := []rccNode{{dir: true}}
+	values := []any{tree}
+	for i := 0; i < len(nodes); i++ {
+		t, ok := values[i].(map[string]any)
+		if !ok {
+			continue
+		}
+		names := make([]string, 0, len(t))
+		for name := range t {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		nodes[i].count, nodes[i].child = uint32(len(names)), uint32(len(nodes))
+		for _, name := range names {
+			n := rccNode{name: name}
+			if d, ok := t[name].([]byte); ok {
+				n.data = d
+			} else {
+				n.dir = true
+			}
+			nodes = append(nodes, n)
+			values = append(values, t[name])
+		}
+	}
+	return nodes
+}
+
+func TestRCCIcon(t *testing.T) {
+	d := buildRCC(rccTree(map[string]any{
+		"icons":  map[string]any{"app.png": testPNG(t, 64, 64), "tray.png": testPNG(t, 16, 16), "app.svg": []byte("<svg/>")},
+		"images": map[string]any{"logo.png": testPNG(t, 128, 128)},
+	}))
+	icon, err := rccIcon(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(icon, testPNG(t, 64, 64)) {
+		t.Fatal("expected icons/app.png")
+	}
+}
+
+func TestRCCSharedDirectories(t *testing.T) {
+	// 每一层的两个目录都指向下一层的同一对目录，不检查的话要遍历2^30个目录（其中没有文件）
+	nodes := []rccNode{{dir: true, count: 2, child: 1}}
+	for level := 0; level < 30; level++ {
+		child := uint32(len(nodes) + 2)
+		nodes = append(nodes, rccNode{name: "a", dir: true, count: 2, child: child}, rccNode{name: "b", dir: true, count: 2, child: child})
+	}
+	nodes = append(nodes, rccNode{name: "a", dir: true, child: uint32(len(nodes) + 2)}, rccNode{name: "b", dir: true, child: uint32(len(nodes) + 2)})
+
+	if _, err := openRCC(bytes.NewReader(buildRCC(nodes))); err == nil {
+		t.Fatal("expected an error for directories sharing their children")
+	}
+}
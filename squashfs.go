@@ -0,0 +1,423 @@
+package fico
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// https://dr-emann.github.io/squashfs/squashfs.html
+type squashfsSuperblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	FragmentEntryCount  uint32
+	CompressionID       uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInodeRef        uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+const (
+	squashfsMagic = 0x73717368 // "hsqs"
+
+	squashfsGzip = 1
+	squashfsXZ   = 4
+	squashfsZstd = 6
+
+	squashfsBasicDir  = 1
+	squashfsBasicFile = 2
+	squashfsExtDir    = 8
+	squashfsExtFile   = 9
+
+	squashfsMetaSize       = 8192
+	squashfsUncompressed   = 1 << 24
+	squashfsNoFragment     = 0xFFFFFFFF
+	squashfsMetaUncompress = 0x8000
+)
+
+// 从squashfs中读出的单个文件的大小上限
+const maxSquashfsFileSize = 32 << 20
+
+type squashfs struct {
+	r  io.ReaderAt
+	sb squashfsSuperblock
+}
+
+// squashfsInode keeps the parts of a directory or regular file inode needed for reading.
+type squashfsInode struct {
+	Type       uint16
+	DirBlock   uint32 // 目录列表所在元数据块（相对目录表）
+	DirOffset  uint16 // 目录列表在块中的偏移
+	DirSize    uint32 // 目录列表大小
+	BlockStart uint64 // 文件数据起始位置
+	FileSize   uint64
+	Fragment   uint32
+	FragOffset uint32
+	Blocks     []uint32
+}
+
+// openSquashfs reads the superblock of a squashfs image of size bytes.
+func openSquashfs(r io.ReaderAt, size int64) (*squashfs, error) {
+	fs := &squashfs{r: r}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &fs.sb); err != nil {
+		return nil, err
+	}
+	if fs.sb.Magic != squashfsMagic {
+		return nil, errors.New("invalid squashfs magic")
+	}
+	if fs.sb.VersionMajor != 4 {
+		return nil, errors.New("unsupported squashfs version")
+	}
+	// 块大小是4KiB到1MiB之间2的幂，且与BlockLog一致
+	if bs := fs.sb.BlockSize; bs < 4<<10 || bs > 1<<20 || bs&(bs-1) != 0 || fs.sb.BlockLog >= 32 || 1<<fs.sb.BlockLog != bs {
+		return nil, errors.New("invalid squashfs block size")
+	}
+	switch fs.sb.CompressionID {
+	case squashfsGzip, squashfsXZ, squashfsZstd:
+	default:
+		return nil, errors.New("unsupported squashfs compression")
+	}
+	// 已用字节数用来限制块列表的长度，不能超过实际大小
+	if size < 0 || fs.sb.BytesUsed > uint64(size) {
+		return nil, errors.New("invalid squashfs size")
+	}
+	return fs, nil
+}
+
+func (fs *squashfs) decompress(d []byte) ([]byte, error) {
+	var rd io.Reader
+	var err error
+	switch fs.sb.CompressionID {
+	case squashfsGzip:
+		rd, err = zlib.NewReader(bytes.NewReader(d))
+	case squashfsXZ:
+		rd, err = xz.NewReader(bytes.NewReader(d))
+	case squashfsZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(bytes.NewReader(d))
+		if err == nil {
+			defer zr.Close()
+			rd = zr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 单个块不会超过块大小，多读1字节用于检查
+	return io.ReadAll(io.LimitReader(rd, int64(fs.sb.BlockSize)+1))
+}
+
+// metaReader reads a stream of metadata blocks starting at a given position.
+type metaReader struct {
+	fs   *squashfs
+	next int64 // 下一个元数据块的位置
+	buf  []byte
+}
+
+func (fs *squashfs) metaReader(start int64, offset int) (*metaReader, error) {
+	mr := &metaReader{fs: fs, next: start}
+	if err := mr.fill(); err != nil {
+		return nil, err
+	}
+	if offset > len(mr.buf) {
+		return nil, errors.New("squashfs metadata offset out of range")
+	}
+	mr.buf = mr.buf[offset:]
+	return mr, nil
+}
+
+func (mr *metaReader) fill() error {
+	var hdr [2]byte
+	if _, err := mr.fs.r.ReadAt(hdr[:], mr.next); err != nil {
+		return err
+	}
+	h := binary.LittleEndian.Uint16(hdr[:])
+	size := int64(h &^ squashfsMetaUncompress)
+	d := make([]byte, size)
+	if _, err := mr.fs.r.ReadAt(d, mr.next+2); err != nil {
+		return err
+	}
+	mr.next += 2 + size
+
+	if h&squashfsMetaUncompress == 0 {
+		var err error
+		if d, err = mr.fs.decompress(d); err != nil {
+			return err
+		}
+	}
+	if len(d) > squashfsMetaSize {
+		return errors.New("squashfs metadata block too large")
+	}
+	mr.buf = append(mr.buf, d...)
+	return nil
+}
+
+func (mr *metaReader) Read(p []byte) (int, error) {
+	for len(mr.buf) < len(p) {
+		if err := mr.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, mr.buf)
+	mr.buf = mr.buf[n:]
+	return n, nil
+}
+
+func (fs *squashfs) inode(ref uint64) (*squashfsInode, error) {
+	mr, err := fs.metaReader(int64(fs.sb.InodeTableStart+ref>>16), int(ref&0xFFFF))
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	var hdr struct {
+		Type, Permissions, UID, GID uint16
+		MTime, InodeNumber          uint32
+	}
+	if err = binary.Read(mr, le, &hdr); err != nil {
+		return nil, err
+	}
+
+	ino := &squashfsInode{Type: hdr.Type}
+	switch hdr.Type {
+	case squashfsBasicDir:
+		var d struct {
+			BlockIdx, LinkCount uint32
+			FileSize, BlockOff  uint16
+			ParentInode         uint32
+		}
+		if err = binary.Read(mr, le, &d); err != nil {
+			return nil, err
+		}
+		ino.DirBlock, ino.DirOffset, ino.DirSize = d.BlockIdx, d.BlockOff, uint32(d.FileSize)
+	case squashfsExtDir:
+		var d struct {
+			LinkCount, FileSize, BlockIdx, ParentInode uint32
+			IndexCount, BlockOff                       uint16
+			XattrIdx                                   uint32
+		}
+		if err = binary.Read(mr, le, &d); err != nil {
+			return nil, err
+		}
+		ino.DirBlock, ino.DirOffset, ino.DirSize = d.BlockIdx, d.BlockOff, d.FileSize
+	case squashfsBasicFile:
+		var f struct {
+			BlocksStart, FragIndex, BlockOffset, FileSize uint32
+		}
+		if err = binary.Read(mr, le, &f); err != nil {
+			return nil, err
+		}
+		ino.BlockStart, ino.FileSize = uint64(f.BlocksStart), uint64(f.FileSize)
+		ino.Fragment, ino.FragOffset = f.FragIndex, f.BlockOffset
+	case squashfsExtFile:
+		var f struct {
+			BlocksStart, FileSize, Sparse         uint64
+			LinkCount, FragIndex, BlockOffset, XI uint32
+		}
+		if err = binary.Read(mr, le, &f); err != nil {
+			return nil, err
+		}
+		ino.BlockStart, ino.FileSize = f.BlocksStart, f.FileSize
+		ino.Fragment, ino.FragOffset = f.FragIndex, f.BlockOffset
+	default:
+		return ino, nil
+	}
+
+	if ino.Type == squashfsBasicFile || ino.Type == squashfsExtFile {
+		n := ino.FileSize / uint64(fs.sb.BlockSize)
+		if ino.Fragment == squashfsNoFragment && ino.FileSize%uint64(fs.sb.BlockSize) != 0 {
+			n++
+		}
+		if n > uint64(fs.sb.BytesUsed) {
+			return nil, errors.New("squashfs file too large")
+		}
+		// 分批读取，块列表按实际读到的元数据增长
+		for n > 0 {
+			b := make([]uint32, min(n, 1024))
+			if err = binary.Read(mr, le, b); err != nil {
+				return nil, err
+			}
+			ino.Blocks = append(ino.Blocks, b...)
+			n -= uint64(len(b))
+		}
+	}
+	return ino, nil
+}
+
+// readDir returns the inode references of the entries in a directory, keyed by name.
+func (fs *squashfs) readDir(dir *squashfsInode) (map[string]uint64, error) {
+	entries := make(map[string]uint64)
+	// 目录列表大小比实际多3字节
+	if dir.DirSize <= 3 {
+		return entries, nil
+	}
+
+	mr, err := fs.metaReader(int64(fs.sb.DirectoryTableStart)+int64(dir.DirBlock), int(dir.DirOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	for remain := int(dir.DirSize) - 3; remain > 0; {
+		var hdr struct {
+			Count, Start uint32
+			InodeNumber  int32
+		}
+		if err = binary.Read(mr, le, &hdr); err != nil {
+			return nil, err
+		}
+		remain -= 12
+
+		for i := uint32(0); i <= hdr.Count && remain > 0; i++ {
+			var e struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			if err = binary.Read(mr, le, &e); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(e.NameSize)+1)
+			if _, err = io.ReadFull(mr, name); err != nil {
+				return nil, err
+			}
+			remain -= 8 + len(name)
+			entries[string(name)] = uint64(hdr.Start)<<16 | uint64(e.Offset)
+		}
+	}
+	return entries, nil
+}
+
+// walk calls fn for every regular file, with its slash-separated path relative to the root.
+func (fs *squashfs) walk(fn func(name string, ino *squashfsInode) error) error {
+	root, err := fs.inode(fs.sb.RootInodeRef)
+	if err != nil {
+		return err
+	}
+
+	var visit func(dir string, ino *squashfsInode, depth int) error
+	visit = func(dir string, ino *squashfsInode, depth int) error {
+		// 防止构造的文件形成环
+		if depth > 64 {
+			return errors.New("squashfs directory too deep")
+		}
+		entries, err := fs.readDir(ino)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child, err := fs.inode(entries[name])
+			if err != nil {
+				return err
+			}
+			p := path.Join(dir, name)
+			switch child.Type {
+			case squashfsBasicDir, squashfsExtDir:
+				err = visit(p, child, depth+1)
+			case squashfsBasicFile, squashfsExtFile:
+				err = fn(p, child)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit("", root, 0)
+}
+
+func (fs *squashfs) readBlock(pos int64, size uint32) ([]byte, error) {
+	// 块（包括碎片块）在磁盘上的大小不会超过块大小，分配前先检查
+	if size&^squashfsUncompressed > fs.sb.BlockSize {
+		return nil, errors.New("squashfs block too large")
+	}
+	d := make([]byte, size&^squashfsUncompressed)
+	if _, err := fs.r.ReadAt(d, pos); err != nil {
+		return nil, err
+	}
+	if size&squashfsUncompressed != 0 {
+		return d, nil
+	}
+	return fs.decompress(d)
+}
+
+func (fs *squashfs) readFile(ino *squashfsInode) ([]byte, error) {
+	// 块列表不会比文件大小所需的长，稀疏块也因此有上限
+	if ino.FileSize > maxSquashfsFileSize || uint64(len(ino.Blocks)) > ino.FileSize/uint64(fs.sb.BlockSize)+1 {
+		return nil, errors.New("squashfs file too large")
+	}
+	var ret []byte
+	pos := int64(ino.BlockStart)
+	for _, b := range ino.Blocks {
+		if b == 0 { // 稀疏块
+			ret = append(ret, make([]byte, fs.sb.BlockSize)...)
+			continue
+		}
+		d, err := fs.readBlock(pos, b)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d...)
+		pos += int64(b &^ squashfsUncompressed)
+	}
+
+	if ino.Fragment != squashfsNoFragment {
+		// 碎片表是指向元数据块的指针数组，每个元数据块有512个16字节的条目
+		var ptr [8]byte
+		if _, err := fs.r.ReadAt(ptr[:], int64(fs.sb.FragmentTableStart)+int64(ino.Fragment/512)*8); err != nil {
+			return nil, err
+		}
+		mr, err := fs.metaReader(int64(binary.LittleEndian.Uint64(ptr[:])), int(ino.Fragment%512)*16)
+		if err != nil {
+			return nil, err
+		}
+		var frag struct {
+			Start  uint64
+			Size   uint32
+			Unused uint32
+		}
+		if err = binary.Read(mr, binary.LittleEndian, &frag); err != nil {
+			return nil, err
+		}
+		d, err := fs.readBlock(int64(frag.Start), frag.Size)
+		if err != nil {
+			return nil, err
+		}
+		tail := ino.FileSize % uint64(fs.sb.BlockSize)
+		if uint64(ino.FragOffset)+tail > uint64(len(d)) {
+			return nil, errors.New("squashfs fragment out of range")
+		}
+		ret = append(ret, d[ino.FragOffset:uint64(ino.FragOffset)+tail]...)
+	}
+
+	if uint64(len(ret)) > ino.FileSize {
+		ret = ret[:ino.FileSize]
+	}
+	return ret, nil
+}
@@ -0,0 +1,239 @@
+package fico
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// buildSquashfs writes a gzip squashfs image of tree, whose values are either file
+// contents ([]byte) or subdirectories (map[string]any), with 4 KiB blocks. Metadata is
+// left uncompressed.
+func buildSquashfs(tree map[string]any) []byte {
+	const blockSize = 4096
+	le := binary.LittleEndian
+	data := make([]byte, 96)
+	var inodes, dirtab []byte
+
+	meta := func(b []byte) []byte {
+		return append(le.AppendUint16(nil, uint16(len(b))|squashfsMetaUncompress), b...)
+	}
+
+	addFile := func(content []byte) (uint16, uint16) {
+		start := len(data)
+		var sizes []uint32
+		for i := 0; i < len(content); i += int(blockSize) {
+			blk := content[i:min(i+int(blockSize), len(content))]
+			var c bytes.Buffer
+			zw := zlib.NewWriter(&c)
+			zw.Write(blk)
+			zw.Close()
+			if c.Len() < len(blk) {
+				data = append(data, c.Bytes()...)
+				sizes = append(sizes, uint32(c.Len()))
+			} else {
+				data = append(data, blk...)
+				sizes = append(sizes, uint32(len(blk))|squashfsUncompressed)
+			}
+		}
+		off := len(inodes)
+		for _, v := range []uint16{squashfsBasicFile, 0o644, 0, 0} {
+			inodes = le.AppendUint16(inodes, v)
+		}
+		for _, v := range []uint32{0, 1, uint32(start), squashfsNoFragment, 0, uint32(len(content))} {
+			inodes = le.AppendUint32(inodes, v)
+		}
+		for _, s := range sizes {
+			inodes = le.AppendUint32(inodes, s)
+		}
+		return uint16(off), squashfsBasicFile
+	}
+
+	var addDir func(t map[string]any) (uint16, uint16)
+	addDir = func(t map[string]any) (uint16, uint16) {
+		names := make([]string, 0, len(t))
+		for name := range t {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var listing []byte
+		if len(names) > 0 {
+			listing = le.AppendUint32(listing, uint32(len(names)-1))
+			listing = le.AppendUint32(listing, 0)
+			listing = le.AppendUint32(listing, 1)
+		}
+		for _, name := range names {
+			var off, typ uint16
+			switch v := t[name].(type) {
+			case []byte:
+				off, typ = addFile(v)
+			case map[string]any:
+				off, typ = addDir(v)
+			}
+			for _, v := range []uint16{off, 0, typ, uint16(len(name) - 1)} {
+				listing = le.AppendUint16(listing, v)
+			}
+			listing = append(listing, name...)
+		}
+		doff := len(dirtab)
+		dirtab = append(dirtab, listing...)
+
+		off := len(inodes)
+		for _, v := range []uint16{squashfsBasicDir, 0o755, 0, 0} {
+			inodes = le.AppendUint16(inodes, v)
+		}
+		inodes = le.AppendUint32(inodes, 0)
+		inodes = le.AppendUint32(inodes, 1)
+		inodes = le.AppendUint32(inodes, 0)
+		inodes = le.AppendUint32(inodes, 2)
+		inodes = le.AppendUint16(inodes, uint16(len(listing)+3))
+		inodes = le.AppendUint16(inodes, uint16(doff))
+		inodes = le.AppendUint32(inodes, 0)
+		return uint16(off), squashfsBasicDir
+	}
+	root, _ := addDir(tree)
+
+	inoStart := len(data)
+	data = append(data, meta(inodes)...)
+	dirStart := len(data)
+	data = append(data, meta(dirtab)...)
+	idStart := len(data)
+	data = le.AppendUint64(data, uint64(idStart+8))
+	data = append(data, meta(make([]byte, 4))...)
+
+	var sb bytes.Buffer
+	binary.Write(&sb, le, squashfsSuperblock{
+		Magic:               squashfsMagic,
+		InodeCount:          16,
+		BlockSize:           blockSize,
+		CompressionID:       squashfsGzip,
+		BlockLog:            12,
+		IDCount:             1,
+		VersionMajor:        4,
+		RootInodeRef:        uint64(root),
+		BytesUsed:           uint64(len(data)),
+		IDTableStart:        uint64(idStart),
+		XattrIDTableStart:   ^uint64(0),
+		InodeTableStart:     uint64(inoStart),
+		DirectoryTableStart: uint64(dirStart),
+		FragmentTableStart:  ^uint64(0),
+		ExportTableStart:    ^uint64(0),
+	})
+	copy(data, sb.Bytes())
+	return data
+}
+
+func snapICOSizes(t *testing.T, tree map[string]any) []int {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "a.snap")
+	if err := os.WriteFile(name, buildSquashfs(tree), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, name); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, f := range frames {
+		sizes = append(sizes, f.Width)
+	}
+	return sizes
+}
+
+func TestSnapIconLargestPNG(t *testing.T) {
+	sizes := snapICOSizes(t, map[string]any{
+		"meta": map[string]any{"gui": map[string]any{"icon.png": testPNG(t, 16, 16)}},
+		"usr": map[string]any{"share": map[string]any{"icons": map[string]any{"hicolor": map[string]any{
+			"64x64": map[string]any{"apps": map[string]any{"app.png": testPNG(t, 64, 64)}},
+		}}}},
+		"bin": map[string]any{"x": bytes.Repeat([]byte("hello"), 3000)},
+	})
+	if len(sizes) != 1 || sizes[0] != 64 {
+		t.Fatalf("got sizes %v, want [64]", sizes)
+	}
+}
+
+func TestSnapIconSVG(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect width="10" height="10" fill="#f00"/></svg>`)
+	sizes := snapICOSizes(t, map[string]any{
+		"meta": map[string]any{"gui": map[string]any{"icon.png": testPNG(t, 16, 16)}},
+		"usr": map[string]any{"share": map[string]any{"icons": map[string]any{"hicolor": map[string]any{
+			"scalable": map[string]any{"apps": map[string]any{"app.svg": svg}},
+		}}}},
+	})
+	if len(sizes) != 1 || sizes[0] != defaultSVGSize {
+		t.Fatalf("got sizes %v, want [%d]", sizes, defaultSVGSize)
+	}
+}
+
+func TestSquashfsInvalidBlockSize(t *testing.T) {
+	tree := map[string]any{"meta": map[string]any{"icon.png": testPNG(t, 16, 16)}}
+	for _, c := range []struct {
+		size uint32
+		log  uint16
+	}{{0, 0}, {1000, 10}, {1 << 21, 21}, {8192, 12}, {4096, 44}} {
+		d := buildSquashfs(tree)
+		binary.LittleEndian.PutUint32(d[12:], c.size)
+		binary.LittleEndian.PutUint16(d[22:], c.log)
+		if _, err := openSquashfs(bytes.NewReader(d), int64(len(d))); err == nil {
+			t.Errorf("block size %d (log %d) accepted", c.size, c.log)
+		}
+	}
+	d := buildSquashfs(tree)
+	if _, err := openSquashfs(bytes.NewReader(d), int64(len(d))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSquashfsCorruptSizes(t *testing.T) {
+	tree := map[string]any{"meta": map[string]any{"icon.png": testPNG(t, 16, 16)}}
+	le := binary.LittleEndian
+	// 第一个inode是icon.png，在inode表的元数据块头之后
+	file := func(d []byte) []byte { return d[le.Uint64(d[64:])+2:] }
+	for _, c := range []struct {
+		name  string
+		patch func(d []byte)
+	}{
+		// 压缩块的大小接近4GiB，分配前就要拒绝
+		{"huge block", func(d []byte) { le.PutUint32(file(d)[32:], 0xFEFFFFFF) }},
+		{"block larger than block size", func(d []byte) { le.PutUint32(file(d)[32:], 4097) }},
+		{"huge file", func(d []byte) { le.PutUint32(file(d)[28:], 0xFFFFFFFF) }},
+		{"bytes used past the end", func(d []byte) { le.PutUint64(d[40:], uint64(len(d))+1) }},
+	} {
+		d := buildSquashfs(tree)
+		c.patch(d)
+		name := filepath.Join(t.TempDir(), "a.snap")
+		if err := os.WriteFile(name, d, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := F2ICO(&bytes.Buffer{}, name); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestSquashfsSparseFileLimit(t *testing.T) {
+	// 块列表全是稀疏块，文件大小超过上限时不能逐块分配
+	fs := &squashfs{sb: squashfsSuperblock{BlockSize: 4096}}
+	ino := &squashfsInode{FileSize: maxSquashfsFileSize + 4096, Fragment: squashfsNoFragment, Blocks: make([]uint32, maxSquashfsFileSize/4096+1)}
+	if _, err := fs.readFile(ino); err == nil {
+		t.Fatal("expected an error for a file over the size limit")
+	}
+	ino = &squashfsInode{FileSize: 4096, Fragment: squashfsNoFragment, Blocks: make([]uint32, 1<<16)}
+	if _, err := fs.readFile(ino); err == nil {
+		t.Fatal("expected an error for more blocks than the file size needs")
+	}
+	ino = &squashfsInode{FileSize: 8192, Fragment: squashfsNoFragment, Blocks: make([]uint32, 2)}
+	if d, err := fs.readFile(ino); err != nil || len(d) != 8192 {
+		t.Fatalf("got %d bytes, %v", len(d), err)
+	}
+}
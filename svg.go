@@ -0,0 +1,55 @@
+package fico
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// 没有指定尺寸时矢量图渲染的边长，ico中最大的尺寸
+const defaultSVGSize = 256
+
+// svgImage rasterizes an SVG, or a gzipped one (.svgz) which is recognized by its magic
+// number whatever the extension. It is drawn centered on a w x h canvas keeping its
+// aspect ratio; with no size given it fits in 256 x 256 with no margin.
+func svgImage(r io.Reader, w, h int) (*image.RGBA, error) {
+	br := bufio.NewReader(r)
+	var rd io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+
+	// 限制解压后的大小，防止解压炸弹
+	icon, err := oksvg.ReadIconStream(io.LimitReader(rd, maxAPKIconSize))
+	if err != nil {
+		return nil, err
+	}
+	vw, vh := icon.ViewBox.W, icon.ViewBox.H
+	if vw <= 0 || vh <= 0 {
+		return nil, errors.New("svg has no size")
+	}
+
+	// 没有指定尺寸时画布就是缩放后的大小
+	fit := float64(defaultSVGSize) / max(vw, vh)
+	if w > 0 && h > 0 {
+		fit = min(float64(w)/vw, float64(h)/vh)
+	} else {
+		w, h = max(1, int(vw*fit+0.5)), max(1, int(vh*fit+0.5))
+	}
+	fw, fh := vw*fit, vh*fit
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	icon.SetTarget((float64(w)-fw)/2, (float64(h)-fh)/2, fw, fh)
+	icon.Draw(rasterx.NewDasher(w, h, rasterx.NewScannerGV(w, h, img, img.Bounds())), 1)
+	return img, nil
+}
@@ -0,0 +1,148 @@
+package fico
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// TGA没有签名，按"ID长度、无调色板、真彩色/灰度（RLE）"的文件头识别
+func init() {
+	for _, typ := range []string{"\x02", "\x03", "\x0a", "\x0b"} {
+		image.RegisterFormat("tga", "?\x00"+typ, decodeTGA, decodeTGAConfig)
+	}
+}
+
+type tgaHeader struct {
+	IDLength     uint8
+	ColorMapType uint8
+	ImageType    uint8
+	ColorMap     [5]byte
+	XOrigin      uint16
+	YOrigin      uint16
+	Width        uint16
+	Height       uint16
+	BitsPerPixel uint8
+	Descriptor   uint8
+}
+
+func readTGAHeader(r io.Reader) (tgaHeader, error) {
+	var h tgaHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return h, err
+	}
+
+	switch h.ImageType {
+	case 2, 10: // 真彩色，未压缩和RLE
+		if h.BitsPerPixel != 24 && h.BitsPerPixel != 32 {
+			return h, errors.New("unsupported tga bits per pixel")
+		}
+	case 3, 11: // 灰度
+		if h.BitsPerPixel != 8 {
+			return h, errors.New("unsupported tga bits per pixel")
+		}
+	default:
+		return h, errors.New("unsupported tga image type")
+	}
+	if h.ColorMapType != 0 {
+		return h, errors.New("unsupported tga color map")
+	}
+	return h, nil
+}
+
+func decodeTGAConfig(r io.Reader) (image.Config, error) {
+	h, err := readTGAHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: int(h.Width), Height: int(h.Height)}, nil
+}
+
+func decodeTGA(r io.Reader) (image.Image, error) {
+	h, err := readTGAHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(h.IDLength) > len(d) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	d = d[h.IDLength:]
+
+	w, ht, bpp := int(h.Width), int(h.Height), int(h.BitsPerPixel)/8
+	n := w * ht
+	// RLE一个包最多展开成128个像素，数据不够时不必分配
+	if n > (len(d)/(1+bpp)+1)*128 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	px := make([]byte, n*bpp)
+	if h.ImageType < 8 {
+		if len(d) < len(px) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		copy(px, d)
+	} else {
+		p := 0
+		for i := 0; i < len(px); {
+			if p >= len(d) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			c := int(d[p]&0x7F) + 1
+			if i+c*bpp > len(px) {
+				c = (len(px) - i) / bpp
+			}
+			if d[p]&0x80 != 0 {
+				// 重复包：一个像素重复c次
+				if p+1+bpp > len(d) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				for j := 0; j < c; j++ {
+					copy(px[i+j*bpp:], d[p+1:p+1+bpp])
+				}
+				p += 1 + bpp
+			} else {
+				// 原始包：c个像素
+				if p+1+c*bpp > len(d) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				copy(px[i:], d[p+1:p+1+c*bpp])
+				p += 1 + c*bpp
+			}
+			i += c * bpp
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, ht))
+	// 描述符第5位为0时原点在左下角，第4位为1时从右往左
+	topDown, rightToLeft := h.Descriptor&0x20 != 0, h.Descriptor&0x10 != 0
+	for y := 0; y < ht; y++ {
+		dy := y
+		if !topDown {
+			dy = ht - 1 - y
+		}
+		for x := 0; x < w; x++ {
+			dx := x
+			if rightToLeft {
+				dx = w - 1 - x
+			}
+			s := px[(y*w+x)*bpp:]
+			var c color.NRGBA
+			switch bpp {
+			case 1:
+				c = color.NRGBA{R: s[0], G: s[0], B: s[0], A: 0xFF}
+			case 3:
+				c = color.NRGBA{R: s[2], G: s[1], B: s[0], A: 0xFF}
+			default:
+				c = color.NRGBA{R: s[2], G: s[1], B: s[0], A: s[3]}
+			}
+			img.SetNRGBA(dx, dy, c)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,126 @@
+package fico
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 包清单大小的上限
+const maxManifestSize = 4 << 20
+
+// vsix（Visual Studio和VS Code扩展）和nupkg（NuGet包）都是zip，清单XML中声明了包内的图标路径
+// https://learn.microsoft.com/en-us/visualstudio/extensibility/vsix-extension-schema-2-0-reference
+// https://learn.microsoft.com/en-us/nuget/reference/nuspec#icon
+type vsixManifest struct {
+	Metadata struct {
+		Icon string `xml:"Icon"`
+	} `xml:"Metadata"`
+	// 1.0版本的清单
+	Identifier struct {
+		Icon string `xml:"Icon"`
+	} `xml:"Identifier"`
+	// VS Code扩展的图标是一个资源
+	Assets []struct {
+		Type string `xml:"Type,attr"`
+		Path string `xml:"Path,attr"`
+	} `xml:"Assets>Asset"`
+}
+
+type nuspec struct {
+	Metadata struct {
+		Icon string `xml:"icon"`
+	} `xml:"metadata"`
+}
+
+// packageIcon returns the icon a .vsix, .nupkg, .msix or .appx package declares in its
+// manifest: the <Icon> element or the default icon asset of extension.vsixmanifest, the
+// <icon> element of the .nuspec at the root, or the largest logo of AppxManifest.xml (see
+// appxIcon). The iconUrl of old NuGet packages is not fetched.
+func packageIcon(zr *zip.Reader) ([]byte, error) {
+	var icons []string
+	for _, f := range zr.File {
+		name := strings.ToLower(f.Name)
+		switch {
+		case name == "appxmanifest.xml":
+			return appxIcon(zr, f)
+		case name == "extension.vsixmanifest":
+			var m vsixManifest
+			if err := readManifest(f, &m); err != nil {
+				return nil, err
+			}
+			icons = append(icons, m.Metadata.Icon, m.Identifier.Icon)
+			for _, a := range m.Assets {
+				if a.Type == "Microsoft.VisualStudio.Services.Icons.Default" {
+					icons = append(icons, a.Path)
+				}
+			}
+		case path.Ext(name) == ".nuspec" && !strings.Contains(name, "/"):
+			var m nuspec
+			if err := readManifest(f, &m); err != nil {
+				return nil, err
+			}
+			icons = append(icons, m.Metadata.Icon)
+		}
+	}
+
+	for _, icon := range icons {
+		if icon == "" {
+			continue
+		}
+		if f := zipEntry(zr, icon); f != nil {
+			return readZipEntry(f)
+		}
+	}
+	return nil, ErrNoIcon
+}
+
+func readManifest(f *zip.File, v any) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(io.LimitReader(rc, maxManifestSize)).Decode(v)
+}
+
+// zipName normalizes a path in a package for comparison: lower case, "/" separators with
+// no leading one, and the percent-encoding of package part names (e.g. "%20") decoded.
+func zipName(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		s = u
+	}
+	return strings.ToLower(path.Clean(strings.TrimLeft(strings.ReplaceAll(s, `\`, "/"), "/")))
+}
+
+// zipEntry finds name in zr, compared as normalized by zipName.
+func zipEntry(zr *zip.Reader, name string) *zip.File {
+	name = zipName(name)
+	for _, f := range zr.File {
+		if zipName(f.Name) == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	d, err := io.ReadAll(io.LimitReader(rc, maxAPKIconSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxAPKIconSize {
+		return nil, errors.New(f.Name + " too large in package")
+	}
+	return d, nil
+}
@@ -0,0 +1,281 @@
+package fico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"gopkg.in/ini.v1"
+)
+
+// wim是Windows的映像格式：头部、资源偏移表、每个映像的元数据资源（目录树）
+// https://learn.microsoft.com/en-us/windows-hardware/manufacture/desktop/wim-file-format
+const (
+	wimHdrCompressed = 0x00000002 // 资源是分块压缩的（XPRESS、LZX或LZMS）
+	wimResCompressed = 0x04
+	wimResMetadata   = 0x02
+	wimAttrDirectory = 0x10
+)
+
+// wimResHdr is RESHDR_DISK_SHORT: the size in the low 7 bytes and the flags in the high
+// byte of the first field, then the offset in the file and the uncompressed size.
+type wimResHdr struct {
+	SizeFlags    uint64
+	Offset       int64
+	OriginalSize int64
+}
+
+func (h wimResHdr) size() int64  { return int64(h.SizeFlags & (1<<56 - 1)) }
+func (h wimResHdr) flags() uint8 { return uint8(h.SizeFlags >> 56) }
+
+type wim struct {
+	r     io.ReaderAt
+	res   map[[20]byte]wimResHdr
+	files map[string][20]byte // 小写的路径到数据流的SHA-1
+}
+
+// wim元数据、偏移表大小和文件数的上限
+const (
+	maxWIMMetadataSize = 64 << 20
+	maxWIMFiles        = 1 << 20
+	maxWIMDepth        = 64
+)
+
+// openWIM reads the directory tree of the first image of an uncompressed WIM. Compressed
+// WIMs (XPRESS, LZX, LZMS) are not supported, nor are .esd files which always use LZMS.
+func openWIM(r io.ReaderAt) (*wim, error) {
+	le := binary.LittleEndian
+	hdr := make([]byte, 208)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != "MSWIM\x00\x00\x00" {
+		return nil, errors.New("invalid wim signature")
+	}
+	if le.Uint32(hdr[16:])&wimHdrCompressed != 0 {
+		return nil, errors.New("unsupported wim compression")
+	}
+	var table wimResHdr
+	binary.Read(bytes.NewReader(hdr[48:]), le, &table)
+
+	read := func(h wimResHdr) ([]byte, error) {
+		if h.flags()&wimResCompressed != 0 {
+			return nil, errors.New("unsupported wim compression")
+		}
+		if h.size() > maxWIMMetadataSize || h.Offset < 0 {
+			return nil, errors.New("invalid wim resource")
+		}
+		d := make([]byte, h.size())
+		if _, err := r.ReadAt(d, h.Offset); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	// 偏移表每项50字节：资源头、分卷号、引用计数、SHA-1
+	t, err := read(table)
+	if err != nil {
+		return nil, err
+	}
+	w := &wim{r: r, res: make(map[[20]byte]wimResHdr), files: make(map[string][20]byte)}
+	var meta *wimResHdr
+	for ; len(t) >= 50; t = t[50:] {
+		var h wimResHdr
+		binary.Read(bytes.NewReader(t), le, &h)
+		if h.flags()&wimResMetadata != 0 {
+			if meta == nil {
+				meta = &h
+			}
+			continue
+		}
+		var hash [20]byte
+		copy(hash[:], t[30:50])
+		w.res[hash] = h
+	}
+	if meta == nil {
+		return nil, errors.New("no image in wim")
+	}
+
+	m, err := read(*meta)
+	if err != nil {
+		return nil, err
+	}
+	// 元数据开头是安全描述符表，按8字节对齐后是根目录项
+	if len(m) < 8 {
+		return nil, errors.New("invalid wim metadata")
+	}
+	root := (uint64(le.Uint32(m)) + 7) &^ 7
+	if root < 8 {
+		root = 8
+	}
+
+	// 目录项中用到的字段：长度、属性、子目录偏移、数据流的SHA-1、备用数据流数、名字
+	type dentry struct {
+		length, subdir uint64
+		attr           uint32
+		hash           [20]byte
+		streams        int
+		name           string
+	}
+	dentryAt := func(p uint64) (dentry, bool) {
+		var e dentry
+		// p来自文件，写成p+8可能溢出
+		if p > uint64(len(m))-8 {
+			return e, false
+		}
+		e.length = le.Uint64(m[p:])
+		if e.length < 106 || e.length > uint64(len(m))-p {
+			return e, false
+		}
+		b := m[p : p+e.length]
+		e.attr, e.subdir = le.Uint32(b[8:]), le.Uint64(b[16:])
+		copy(e.hash[:], b[64:84])
+		e.streams = int(le.Uint16(b[100:]))
+		n := int(le.Uint16(b[104:]))
+		if 106+n > len(b) {
+			return e, false
+		}
+		u := make([]uint16, n/2)
+		for i := range u {
+			u[i] = le.Uint16(b[106+i*2:])
+		}
+		e.name = string(utf16.Decode(u))
+		return e, true
+	}
+
+	// 每个子目录列表只能出现一次，防止损坏的文件中目录互相引用
+	seen := make(map[uint64]bool)
+	var walk func(p uint64, dir string, depth int) error
+	walk = func(p uint64, dir string, depth int) error {
+		if depth > maxWIMDepth || seen[p] || p > uint64(len(m))-8 {
+			return errors.New("invalid wim directory tree")
+		}
+		seen[p] = true
+		// 长度为0（不足一个目录项）的项表示目录结束
+		for p <= uint64(len(m))-8 && le.Uint64(m[p:]) >= 8 {
+			e, ok := dentryAt(p)
+			if !ok {
+				return errors.New("invalid wim directory entry")
+			}
+			p = (p + e.length + 7) &^ 7
+			// 跳过备用数据流项
+			for i := 0; i < e.streams && p <= uint64(len(m))-8; i++ {
+				l := le.Uint64(m[p:])
+				if l < 8 || l > uint64(len(m))-p {
+					return errors.New("invalid wim stream entry")
+				}
+				p = (p + l + 7) &^ 7
+			}
+
+			name := dir + strings.ToLower(e.name)
+			if e.attr&wimAttrDirectory != 0 {
+				if e.subdir != 0 {
+					if err := walk(e.subdir, name+"/", depth+1); err != nil {
+						return err
+					}
+				}
+			} else {
+				if len(w.files) >= maxWIMFiles {
+					return errors.New("too many files in wim")
+				}
+				w.files[name] = e.hash
+			}
+		}
+		return nil
+	}
+	e, ok := dentryAt(root)
+	if !ok {
+		return nil, errors.New("invalid wim root directory")
+	}
+	if err = walk(e.subdir, "", 0); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open returns a reader for the file at name, a path relative to the root of the image
+// with "/" or "\" separators, matched case-insensitively.
+func (w *wim) open(name string) (*io.SectionReader, error) {
+	name = strings.ToLower(strings.TrimLeft(strings.ReplaceAll(name, `\`, "/"), "/"))
+	hash, ok := w.files[name]
+	if !ok {
+		return nil, errors.New("file not found in wim: " + name)
+	}
+	// 空文件的SHA-1全为0，没有资源
+	h, ok := w.res[hash]
+	if !ok {
+		return io.NewSectionReader(w.r, 0, 0), nil
+	}
+	if h.flags()&wimResCompressed != 0 {
+		return nil, errors.New("unsupported wim compression")
+	}
+	return io.NewSectionReader(w.r, h.Offset, h.size()), nil
+}
+
+// wimICO converts the branding icon of the first image of a WIM: the one its root
+// autorun.inf points to, otherwise the largest .ico whose name contains "icon", "logo" or
+// "oem", otherwise the largest .ico.
+func wimICO(w io.Writer, r io.ReaderAt, cfg ...Config) error {
+	wm, err := openWIM(r)
+	if err != nil {
+		return err
+	}
+
+	if inf, err := wm.open("autorun.inf"); err == nil {
+		d, err := io.ReadAll(io.LimitReader(inf, 1<<20))
+		if err != nil {
+			return err
+		}
+		// 节和键名不区分大小写
+		if f, err := ini.LoadSources(ini.LoadOptions{Insensitive: true}, d); err == nil {
+			if section, err := f.GetSection("AutoRun"); err == nil {
+				if file, idx := autorunIcon(section); file != "" {
+					if icon, err := wm.open(file); err == nil {
+						c := Config{}
+						if len(cfg) > 0 {
+							c = cfg[0]
+						}
+						if c.Index == nil {
+							c.Index = idx
+						}
+						return f2ICO(w, strings.ToLower(path.Ext(strings.ReplaceAll(file, `\`, "/"))), icon, c)
+					}
+				}
+			}
+		}
+	}
+
+	// map的遍历顺序是随机的，排序后保证相同的文件结果一致
+	names := make([]string, 0, len(wm.files))
+	for name := range wm.files {
+		if path.Ext(name) == ".ico" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var best *io.SectionReader
+	bp := -1
+	for _, name := range names {
+		base := path.Base(name)
+		prio := 0
+		if strings.Contains(base, "icon") || strings.Contains(base, "logo") || strings.Contains(base, "oem") {
+			prio = 1
+		}
+		sr, err := wm.open(name)
+		if err != nil {
+			continue
+		}
+		if prio > bp || (prio == bp && sr.Size() > best.Size()) {
+			best, bp = sr, prio
+		}
+	}
+	if best == nil {
+		return ErrNoIcon
+	}
+	return ICO2ICO(w, best, cfg...)
+}
@@ -0,0 +1,106 @@
+package fico
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// wimDentry encodes a directory entry, padded to 8 bytes.
+func wimDentry(attr uint32, subdir uint64, hash [20]byte, name string) []byte {
+	le := binary.LittleEndian
+	u := utf16.Encode([]rune(name))
+	b := make([]byte, (106+2*len(u)+2+7)&^7)
+	le.PutUint64(b, uint64(106+2*len(u)+2))
+	le.PutUint32(b[8:], attr)
+	le.PutUint64(b[16:], subdir)
+	copy(b[64:], hash[:])
+	le.PutUint16(b[104:], uint16(2*len(u)))
+	for i, c := range u {
+		le.PutUint16(b[106+2*i:], c)
+	}
+	return b
+}
+
+type wimFile struct {
+	name string
+	data []byte
+}
+
+// buildWIM writes an uncompressed WIM whose only image holds files in its root directory.
+// The metadata resource comes right after the 208-byte header.
+func buildWIM(files ...wimFile) []byte {
+	le := binary.LittleEndian
+	// 安全描述符表（8字节）、根目录项、根目录的子项和结束标记
+	meta := le.AppendUint32(nil, 8)
+	meta = le.AppendUint32(meta, 0)
+	root := wimDentry(wimAttrDirectory, 0, [20]byte{}, "")
+	le.PutUint64(root[16:], uint64(len(meta)+len(root)))
+	meta = append(meta, root...)
+
+	resHdr := func(b []byte, size, off int, flags uint8, hash [20]byte) []byte {
+		b = le.AppendUint64(b, uint64(size)|uint64(flags)<<56)
+		b = le.AppendUint64(b, uint64(off))
+		b = le.AppendUint64(b, uint64(size))
+		b = le.AppendUint16(b, 1)
+		b = le.AppendUint32(b, 1)
+		return append(b, hash[:]...)
+	}
+	var data, table []byte
+	for _, f := range files {
+		hash := sha1.Sum(f.data)
+		meta = append(meta, wimDentry(0, 0, hash, f.name)...)
+		table = resHdr(table, len(f.data), len(data), 0, hash)
+		data = append(data, f.data...)
+	}
+	meta = append(meta, make([]byte, 8)...)
+
+	// 数据在元数据后面，偏移表在最后
+	dataOff := 208 + len(meta)
+	for i := range files {
+		p := table[i*50+8:]
+		le.PutUint64(p, le.Uint64(p)+uint64(dataOff))
+	}
+	table = resHdr(table, len(meta), 208, wimResMetadata, [20]byte{})
+
+	hdr := make([]byte, 208)
+	copy(hdr, "MSWIM\x00\x00\x00")
+	le.PutUint32(hdr[8:], 208)
+	le.PutUint32(hdr[12:], 0x10d00)
+	copy(hdr[48:72], resHdr(nil, len(table), dataOff+len(data), 0, [20]byte{}))
+	var b bytes.Buffer
+	b.Write(hdr)
+	b.Write(meta)
+	b.Write(data)
+	b.Write(table)
+	return b.Bytes()
+}
+
+func TestWIMIcon(t *testing.T) {
+	ico := testICO(t, 16, 32)
+	path := writeTemp(t, "a.wim", buildWIM(wimFile{"readme.txt", []byte("hi")}, wimFile{"Setup.ico", ico}))
+	var buf bytes.Buffer
+	if err := F2ICO(&buf, path, Config{Format: "ico"}); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := parseICOFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+}
+
+func TestWIMCorruptSubdir(t *testing.T) {
+	// 根目录项的子目录偏移在元数据之外，接近2^64时加8会溢出
+	for _, subdir := range []uint64{0xFFFFFFFFFFFFFFF9, 1 << 40, 0xFFFFFFFFFFFFFFFF} {
+		d := buildWIM(wimFile{"setup.ico", testICO(t, 16)})
+		binary.LittleEndian.PutUint64(d[208+8+16:], subdir)
+		if err := F2ICO(&bytes.Buffer{}, writeTemp(t, "a.wim", d)); err == nil {
+			t.Fatalf("subdir %#x: expected an error", subdir)
+		}
+	}
+}
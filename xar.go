@@ -0,0 +1,158 @@
+package fico
+
+import (
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// macOS的.pkg安装包是xar归档：头部、zlib压缩的XML目录、文件数据堆
+// https://github.com/mackyle/xar/wiki/xarformat
+type xarHeader struct {
+	Magic             [4]byte
+	Size              uint16
+	Version           uint16
+	TOCCompressed     uint64
+	TOCUncompressed   uint64
+	ChecksumAlgorithm uint32
+}
+
+type xarFile struct {
+	Name string `xml:"name"`
+	Type string `xml:"type"`
+	Data struct {
+		Offset   int64 `xml:"offset"`
+		Length   int64 `xml:"length"` // 存储（压缩后）的长度
+		Size     int64 `xml:"size"`
+		Encoding struct {
+			Style string `xml:"style,attr"`
+		} `xml:"encoding"`
+	} `xml:"data"`
+	Files []xarFile `xml:"file"`
+}
+
+type xar struct {
+	r     io.ReaderAt
+	heap  int64
+	files map[string]*xarFile
+}
+
+// xar目录大小的上限
+const maxXARTOCSize = 64 << 20
+
+func openXAR(r io.ReaderAt) (*xar, error) {
+	var hdr xarHeader
+	if err := binary.Read(io.NewSectionReader(r, 0, 28), binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != "xar!" {
+		return nil, errors.New("invalid xar signature")
+	}
+	if hdr.Size < 28 || hdr.TOCCompressed > maxXARTOCSize || hdr.TOCUncompressed > maxXARTOCSize {
+		return nil, errors.New("invalid xar header")
+	}
+
+	zr, err := zlib.NewReader(io.NewSectionReader(r, int64(hdr.Size), int64(hdr.TOCCompressed)))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var toc struct {
+		Files []xarFile `xml:"toc>file"`
+	}
+	if err = xml.NewDecoder(io.LimitReader(zr, maxXARTOCSize)).Decode(&toc); err != nil {
+		return nil, err
+	}
+
+	x := &xar{r: r, heap: int64(hdr.Size) + int64(hdr.TOCCompressed), files: make(map[string]*xarFile)}
+	var walk func(dir string, files []xarFile)
+	walk = func(dir string, files []xarFile) {
+		for i := range files {
+			f := &files[i]
+			if f.Type == "directory" {
+				walk(dir+f.Name+"/", f.Files)
+			} else if f.Type == "file" {
+				x.files[dir+f.Name] = f
+			}
+		}
+	}
+	walk("", toc.Files)
+	return x, nil
+}
+
+func (x *xar) readFile(name string) ([]byte, error) {
+	f := x.files[name]
+	if f == nil {
+		return nil, errors.New("no " + name + " in xar")
+	}
+	if f.Data.Offset < 0 || f.Data.Length < 0 || f.Data.Size > maxAPKIconSize {
+		return nil, errors.New("invalid xar entry")
+	}
+
+	var r io.Reader = io.NewSectionReader(x.r, x.heap+f.Data.Offset, f.Data.Length)
+	switch f.Data.Encoding.Style {
+	case "", "application/octet-stream":
+	case "application/x-gzip": // 名为gzip，实际是zlib格式
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case "application/x-bzip2":
+		r = bzip2.NewReader(r)
+	default:
+		return nil, errors.New("unsupported xar encoding " + f.Data.Encoding.Style)
+	}
+
+	d, err := io.ReadAll(io.LimitReader(r, maxAPKIconSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxAPKIconSize {
+		return nil, errors.New(name + " too large in xar")
+	}
+	return d, nil
+}
+
+// pkgIcon returns an icon bundled with a macOS installer package: an .icns first, then an
+// image whose name contains "icon", then the background image of the installer.
+func pkgIcon(r io.ReaderAt) ([]byte, error) {
+	x, err := openXAR(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var best string
+	bp := 0
+	for name := range x.files {
+		lower := strings.ToLower(name)
+		base := path.Base(lower)
+		prio := 0
+		switch path.Ext(base) {
+		case ".icns":
+			prio = 4
+		case ".png", ".jpg", ".jpeg", ".tiff", ".tif":
+			if strings.Contains(base, "icon") {
+				prio = 3
+			} else if strings.Contains(base, "logo") {
+				prio = 2
+			} else if strings.HasPrefix(base, "background") {
+				prio = 1
+			}
+		}
+		// 同样优先级时按名字排序取第一个，保证结果一致
+		if prio > bp || (prio == bp && prio > 0 && name < best) {
+			best, bp = name, prio
+		}
+	}
+	if best == "" {
+		return nil, ErrNoIcon
+	}
+	return x.readFile(best)
+}